@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+)
+
+// attributeClient is implemented by clients that can read only some of the
+// attributes of the beans, instead of all of them
+type attributeClient interface {
+	// queryAttributes is query, reading only the attrNames of each bean.
+	// A nil attrNames reads every attribute
+	queryAttributes(objectPattern string, attrNames []string, timeout int) (map[string]interface{}, error)
+}
+
+// batchClient is implemented by clients that can send several queries in a
+// single round trip
+type batchClient interface {
+	// batching reports whether queryBatch saves round trips. Wrappers
+	// implement queryBatch for any client, and report the wrapped one's
+	batching() bool
+	// queryBatch returns the result or the error of every objectPattern,
+	// in the same order. attrNames holds the attributes to read for each
+	// objectPattern, and may be nil to read them all
+	queryBatch(objectPatterns []string, attrNames [][]string, timeout int) ([]map[string]interface{}, []error)
+}
+
+// canBatch reports whether client sends batches in a single round trip
+func canBatch(client jmxClient) bool {
+	b, ok := client.(batchClient)
+	return ok && b.batching()
+}
+
+// batchSize returns the number of queries sent to client at once
+func batchSize(client jmxClient) int {
+	if args.QueryBatchSize > 1 && canBatch(client) {
+		return args.QueryBatchSize
+	}
+	return 1
+}
+
+// queryScoped reads only attrNames from the beans matching objectPattern
+// when client supports it, and every attribute otherwise. Unrequested
+// attributes are filtered out afterwards anyway
+func queryScoped(client jmxClient, objectPattern string, attrNames []string, timeout int) (map[string]interface{}, error) {
+	if c, ok := client.(attributeClient); ok {
+		return c.queryAttributes(objectPattern, attrNames, timeout)
+	}
+	return client.query(objectPattern, timeout)
+}
+
+// queryAll runs objectPatterns on client, in a single round trip when the
+// client can batch and one query after the other otherwise. attrNames may
+// be nil to read every attribute
+func queryAll(client jmxClient, objectPatterns []string, attrNames [][]string, timeout int) ([]map[string]interface{}, []error) {
+	if attrNames == nil {
+		attrNames = make([][]string, len(objectPatterns))
+	}
+	if len(objectPatterns) > 1 && canBatch(client) {
+		return client.(batchClient).queryBatch(objectPatterns, attrNames, timeout)
+	}
+
+	results := make([]map[string]interface{}, len(objectPatterns))
+	errs := make([]error, len(objectPatterns))
+	for n, objectPattern := range objectPatterns {
+		results[n], errs[n] = queryScoped(client, objectPattern, attrNames[n], timeout)
+	}
+	return results, errs
+}
+
+// notAnsweredError is the error of a query of a batch that was never
+// answered because an earlier query of the batch failed. The breaker
+// doesn't count it against the query
+type notAnsweredError struct {
+	query string
+	cause error
+}
+
+func (e *notAnsweredError) Error() string {
+	return fmt.Sprintf("query %s not answered: %s", e.query, e.cause)
+}
+
+// notAnswered returns the error of a query left unanswered by the failure
+// cause, retriable if cause is
+func notAnswered(query string, cause error) error {
+	err := &notAnsweredError{query: query, cause: cause}
+	if isRetriable(cause) {
+		return retriable(err)
+	}
+	return err
+}
+
+// isNotAnswered reports whether err is the error of a query that was
+// never answered
+func isNotAnswered(err error) bool {
+	if r, ok := err.(*retriableError); ok {
+		err = r.err
+	}
+	_, ok := err.(*notAnsweredError)
+	return ok
+}
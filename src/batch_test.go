@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+// fakeBatchClient is a fakeClient that records the batches it is sent,
+// and the attributes requested for each query
+type fakeBatchClient struct {
+	fakeClient
+	batches   [][]string
+	attrNames map[string][]string
+}
+
+func (c *fakeBatchClient) batching() bool {
+	return true
+}
+
+func (c *fakeBatchClient) queryBatch(objectPatterns []string, attrNames [][]string, timeout int) ([]map[string]interface{}, []error) {
+	c.batches = append(c.batches, objectPatterns)
+	results := make([]map[string]interface{}, len(objectPatterns))
+	errs := make([]error, len(objectPatterns))
+	for n, objectPattern := range objectPatterns {
+		results[n], errs[n] = c.queryAttributes(objectPattern, attrNames[n], timeout)
+	}
+	return results, errs
+}
+
+func (c *fakeBatchClient) queryAttributes(objectPattern string, attrNames []string, timeout int) (map[string]interface{}, error) {
+	if c.attrNames == nil {
+		c.attrNames = make(map[string][]string)
+	}
+	c.attrNames[objectPattern] = attrNames
+	return c.queryFn(objectPattern, timeout)
+}
+
+func TestQueryJMXBatches(t *testing.T) {
+	defer withArgs(argumentList{QueryBatchSize: 2})()
+
+	collection := []*domainDefinition{{
+		domain:    "java.lang",
+		eventType: "JavaLangSample",
+		beans: []*beanRequest{
+			{beanQuery: "type=Memory", attributes: []*attributeRequest{{attrName: "HeapMemoryUsage.Used"}}},
+			{beanQuery: "type=Threading"},
+			{beanQuery: "type=GarbageCollector,name=*", priority: 1},
+		},
+	}}
+
+	backend := &fakeBatchClient{fakeClient: fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		if name == "java.lang:type=Threading" {
+			return nil, errors.New("InstanceNotFoundException")
+		}
+		return map[string]interface{}{}, nil
+	}}}
+	client := newHealthClient(newRetryClient(backend, 1, 0), false)
+
+	i, _ := integration.New("jmxtest", "0.1.0")
+	if err := queryJMX(collection, client, &jmxTarget{}, i); err == nil {
+		t.Error("Expected the failed query to be returned")
+	}
+
+	// The last batch only has type=Threading, and is sent as a single query
+	expected := [][]string{{"java.lang:type=GarbageCollector,name=*", "java.lang:type=Memory"}}
+	if !reflect.DeepEqual(expected, backend.batches) {
+		t.Errorf("Expected batches %v, got %v", expected, backend.batches)
+	}
+	if h := client.health(); h.queriesAttempted != 3 || h.queriesFailed != 1 {
+		t.Errorf("Expected 3 queries and 1 failure, got %+v", h)
+	}
+	if names := backend.attrNames["java.lang:type=Memory"]; !reflect.DeepEqual([]string{"HeapMemoryUsage.Used", "HeapMemoryUsage"}, names) {
+		t.Errorf("Expected only HeapMemoryUsage.Used and HeapMemoryUsage to be read, got %v", names)
+	}
+	if names, ok := backend.attrNames["java.lang:type=Threading"]; !ok || names != nil {
+		t.Errorf("Expected every attribute of type=Threading to be read, got %v", names)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	defer withArgs(argumentList{QueryBatchSize: 10})()
+
+	if size := batchSize(newHealthClient(&fakeClient{}, false)); size != 1 {
+		t.Errorf("Expected a client that can't batch to get batches of 1, got %d", size)
+	}
+	if size := batchSize(newHealthClient(&fakeBatchClient{}, false)); size != 10 {
+		t.Errorf("Expected batches of 10, got %d", size)
+	}
+}
+
+func TestRetryClientBatch(t *testing.T) {
+	calls := make(map[string]int)
+	backend := &fakeBatchClient{fakeClient: fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		calls[name]++
+		if name == "java.lang:type=Threading" && calls[name] == 1 {
+			return nil, retriable(errors.New("timeout while waiting for query"))
+		}
+		return map[string]interface{}{name + ",attr=Value": 1.0}, nil
+	}}}
+	c := newRetryClient(backend, 3, 0)
+	c.sleep = func(time.Duration) {}
+
+	results, errs := c.queryBatch([]string{"java.lang:type=Memory", "java.lang:type=Threading"}, make([][]string, 2), 1000)
+	for n, err := range errs {
+		if err != nil || len(results[n]) != 1 {
+			t.Errorf("Expected query %d to succeed, got %v, %v", n, results[n], err)
+		}
+	}
+	if calls["java.lang:type=Memory"] != 1 || calls["java.lang:type=Threading"] != 2 {
+		t.Errorf("Expected only the failed query to be retried, got %v", calls)
+	}
+	if backend.opens != 1 || backend.closes != 1 {
+		t.Errorf("Expected the client to be reopened once, got %d opens and %d closes", backend.opens, backend.closes)
+	}
+}
+
+func TestNrjmxClientBatch(t *testing.T) {
+	defer fakeNrjmx()()
+
+	c := newNrjmxClient(nrjmxConfig{hostname: "jvm-a", port: "9999"})
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	patterns := []string{"java.lang:type=Memory", "java.lang:type=Threading", "java.lang:type=Runtime"}
+	results, errs := c.queryBatch(patterns, nil, 5000)
+	for n, pattern := range patterns {
+		expected := map[string]interface{}{pattern + ",attr=Host": "jvm-a"}
+		if errs[n] != nil || !reflect.DeepEqual(expected, results[n]) {
+			t.Errorf("Expected %v for %s, got %v, %v", expected, pattern, results[n], errs[n])
+		}
+	}
+
+	results, errs = c.queryBatch([]string{"java.lang:type=Memory", "slow:type=Memory", "java.lang:type=Runtime"}, nil, 200)
+	if errs[0] != nil || results[0] == nil {
+		t.Errorf("Expected the query before the slow one to succeed, got %v", errs[0])
+	}
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), "timeout") || !isRetriable(errs[1]) {
+		t.Errorf("Expected a retriable timeout, got %v", errs[1])
+	}
+	if errs[2] == nil || !isRetriable(errs[2]) {
+		t.Errorf("Expected the query after the slow one to fail, got %v", errs[2])
+	}
+}
+
+func TestJolokiaQueryBatch(t *testing.T) {
+	searches := map[string][]string{
+		"java.lang:type=GarbageCollector,*": {"java.lang:name=Copy,type=GarbageCollector", "java.lang:name=MarkSweep,type=GarbageCollector"},
+		"java.lang:type=Memory":             {"java.lang:type=Memory"},
+	}
+	handler := fakeJolokiaHandler(t, searches, map[string]map[string]interface{}{
+		"java.lang:name=Copy,type=GarbageCollector":      {"CollectionCount": 12},
+		"java.lang:name=MarkSweep,type=GarbageCollector": {"CollectionCount": 2},
+		"java.lang:type=Memory":                          {"HeapMemoryUsage": map[string]interface{}{"used": 100}},
+	})
+	var lock sync.Mutex
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		posts++
+		lock.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c, err := newJolokiaClient(server.URL, "", "", 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, errs := c.queryBatch([]string{"java.lang:type=Memory", "java.lang:type=Threading", "java.lang:type=GarbageCollector,*"}, make([][]string, 3), 1000)
+	expected := []map[string]interface{}{
+		{"java.lang:type=Memory,attr=HeapMemoryUsage.Used": 100.0},
+		{},
+		{
+			"java.lang:name=Copy,type=GarbageCollector,attr=CollectionCount":      12.0,
+			"java.lang:name=MarkSweep,type=GarbageCollector,attr=CollectionCount": 2.0,
+		},
+	}
+	if !reflect.DeepEqual(expected, results) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+	for n, err := range errs {
+		if err != nil {
+			t.Errorf("Unexpected error for query %d: %s", n, err)
+		}
+	}
+	if posts != 2 {
+		t.Errorf("Expected one search and one read request, got %d requests", posts)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"time"
+)
+
+// breakerState is the failure history of a bean query, kept in the store
+// so that it carries over between one-shot runs
+type breakerState struct {
+	// Failures counts the consecutive failed runs of the query
+	Failures int `json:"failures"`
+	// OpenUntil is the time, in Unix nanoseconds, until which the query is skipped
+	OpenUntil int64 `json:"openUntil"`
+}
+
+// breakerKey identifies a bean query of a target in the store
+func breakerKey(target *jmxTarget, query string) string {
+	return "breaker:" + target.String() + ":" + query
+}
+
+// breakerEnabled reports whether failing queries are ever skipped
+func breakerEnabled() bool {
+	return args.BreakerThreshold > 0 && collectionStore != nil
+}
+
+// breakerOpen reports whether a query is skipped after failing
+// args.BreakerThreshold runs in a row, and until when. Once the cooldown
+// is over the query is tried again, and a single failure skips it again
+func breakerOpen(key string, now time.Time) (bool, time.Time) {
+	if !breakerEnabled() {
+		return false, time.Time{}
+	}
+
+	var state breakerState
+	if _, err := collectionStore.Get(key, &state); err != nil {
+		return false, time.Time{}
+	}
+	until := time.Unix(0, state.OpenUntil)
+	return now.Before(until), until
+}
+
+// recordQueryFailure counts a failed run of a query, and skips it for
+// args.BreakerCooldown seconds once it reaches args.BreakerThreshold
+func recordQueryFailure(key, query string, now time.Time) {
+	if !breakerEnabled() {
+		return
+	}
+
+	var state breakerState
+	_, _ = collectionStore.Get(key, &state)
+	state.Failures++
+	if state.Failures >= args.BreakerThreshold {
+		cooldown := time.Duration(args.BreakerCooldown) * time.Second
+		state.OpenUntil = now.Add(cooldown).UnixNano()
+		logger.Warnf("Query %s failed %d runs in a row, skipping it for %s", query, state.Failures, cooldown)
+	}
+	collectionStore.Set(key, state)
+}
+
+// recordQuerySuccess clears the failure history of a query
+func recordQuerySuccess(key string) {
+	if !breakerEnabled() {
+		return
+	}
+	_ = collectionStore.Delete(key)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/integration"
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+func TestQueryJMXBreaker(t *testing.T) {
+	saved := collectionStore
+	collectionStore = persist.NewInMemoryStore()
+	defer func() {
+		collectionStore = saved
+	}()
+	defer withArgs(argumentList{BreakerThreshold: 2, BreakerCooldown: 60})()
+
+	file, _ := ioutil.ReadFile("../test/infra-intervals.yml")
+	domains, _ := infraJmxParser{}.parse(file)
+	target := &jmxTarget{JmxHost: "localhost", JmxPort: "9999"}
+	i, _ := integration.New("jmxtest", "0.1.0")
+
+	broken := "java.lang:type=GarbageCollector,name=*"
+	queried := make(map[string]int)
+	fail := true
+	client := newHealthClient(&fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		queried[name]++
+		if name == broken && fail {
+			return nil, errors.New("timeout while waiting for query: " + name)
+		}
+		return map[string]interface{}{}, nil
+	}}, false)
+
+	for run := 0; run < 3; run++ {
+		client.reset()
+		_ = queryJMX(domains, client, target, i)
+	}
+	if queried[broken] != 2 || queried["java.lang:type=Memory"] != 3 {
+		t.Errorf("Expected the failing query to be skipped after 2 failures, got %v", queried)
+	}
+	if h := client.health(); h.queriesSkipped != 1 || h.queriesFailed != 0 {
+		t.Errorf("Expected the last run to count one skipped query, got %+v", h)
+	}
+
+	key := breakerKey(target, broken)
+	if open, until := breakerOpen(key, time.Now()); !open || until.Sub(time.Now()) > time.Minute {
+		t.Errorf("Expected the breaker to be open for the cooldown, got %t until %s", open, until)
+	}
+	if open, _ := breakerOpen(key, time.Now().Add(time.Minute)); open {
+		t.Error("Expected the query to be tried again after the cooldown")
+	}
+
+	// A success after the cooldown clears the failure history
+	fail = false
+	collectionStore.Set(key, breakerState{Failures: 2, OpenUntil: time.Now().Add(-time.Second).UnixNano()})
+	_ = queryJMX(domains, client, target, i)
+	if queried[broken] != 3 {
+		t.Errorf("Expected the recovered query to run, got %d runs", queried[broken])
+	}
+	var state breakerState
+	if _, err := collectionStore.Get(key, &state); err != persist.ErrNotFound {
+		t.Errorf("Expected no failure history after a success, got %+v", state)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	saved := collectionStore
+	collectionStore = persist.NewInMemoryStore()
+	defer func() {
+		collectionStore = saved
+	}()
+	defer withArgs(argumentList{BreakerThreshold: 0})()
+
+	key := breakerKey(&jmxTarget{Name: "orders"}, "java.lang:type=Memory")
+	for n := 0; n < 5; n++ {
+		recordQueryFailure(key, "java.lang:type=Memory", time.Now())
+	}
+	if open, _ := breakerOpen(key, time.Now()); open || !strings.HasPrefix(key, "breaker:orders:") {
+		t.Error("Expected a zero threshold to never skip queries")
+	}
+}
+
+func TestBreakerIgnoresUnansweredQueries(t *testing.T) {
+	saved := collectionStore
+	collectionStore = persist.NewInMemoryStore()
+	defer func() {
+		collectionStore = saved
+	}()
+	defer withArgs(argumentList{BreakerThreshold: 1, BreakerCooldown: 60})()
+
+	file, _ := ioutil.ReadFile("../test/infra-intervals.yml")
+	domains, _ := infraJmxParser{}.parse(file)
+	target := &jmxTarget{JmxHost: "localhost", JmxPort: "9999"}
+	i, _ := integration.New("jmxtest", "0.1.0")
+
+	broken := "java.lang:type=GarbageCollector,name=*"
+	lost := retriable(errors.New("timeout while waiting for query: " + broken))
+	client := &fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		if name == broken {
+			return nil, lost
+		}
+		return nil, notAnswered(name, lost)
+	}}
+	_ = queryJMX(domains, client, target, i)
+
+	if open, _ := breakerOpen(breakerKey(target, broken), time.Now()); !open {
+		t.Error("Expected the breaker of the failing query to open")
+	}
+	if open, _ := breakerOpen(breakerKey(target, "java.lang:type=Memory"), time.Now()); open {
+		t.Error("Expected the unanswered query not to be counted")
+	}
+	if !isRetriable(notAnswered("java.lang:type=Memory", lost)) {
+		t.Error("Expected an unanswered query to be retriable like its cause")
+	}
+}
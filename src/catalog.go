@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errNrjmxNameCache is returned for nrjmx targets when name_cache_ttl is
+// set, as nrjmx searches the names of every query itself
+var errNrjmxNameCache = errors.New("name_cache_ttl is not supported by the nrjmx backend, set it to 0 or use the jolokia or native backend")
+
+// catalogEntry holds the names of the beans matched by a query, kept in the
+// store so that it carries over between one-shot runs
+type catalogEntry struct {
+	Names []string `json:"names"`
+	// Expires is the time, in Unix nanoseconds, after which the names are
+	// searched again
+	Expires int64 `json:"expires"`
+}
+
+// nameCatalog caches the names of the beans matched by the queries of a
+// target, so that the server doesn't match wildcard queries against all of
+// its beans on every run. A nil catalog caches nothing
+type nameCatalog struct {
+	target string
+	ttl    time.Duration
+}
+
+// newNameCatalog returns the catalog of a target, or nil when
+// args.NameCacheTTL disables it
+func newNameCatalog(target *jmxTarget) *nameCatalog {
+	if args.NameCacheTTL <= 0 || collectionStore == nil {
+		return nil
+	}
+	return &nameCatalog{target: target.String(), ttl: time.Duration(args.NameCacheTTL) * time.Second}
+}
+
+func (c *nameCatalog) key(objectPattern string) string {
+	return "catalog:" + c.target + ":" + objectPattern
+}
+
+// lookup returns the cached names of the beans matched by objectPattern,
+// unless they have expired
+func (c *nameCatalog) lookup(objectPattern string) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	var entry catalogEntry
+	if _, err := collectionStore.Get(c.key(objectPattern), &entry); err != nil {
+		return nil, false
+	}
+	if !time.Now().Before(time.Unix(0, entry.Expires)) {
+		return nil, false
+	}
+	return entry.Names, true
+}
+
+// remember caches the names of the beans matched by objectPattern. Queries
+// that match no bean are not cached, so that their beans are found as soon
+// as they are registered
+func (c *nameCatalog) remember(objectPattern string, names []string) {
+	if c == nil || len(names) == 0 {
+		return
+	}
+	collectionStore.Set(c.key(objectPattern), catalogEntry{
+		Names:   names,
+		Expires: time.Now().Add(c.ttl).UnixNano(),
+	})
+}
+
+// forget drops the names of objectPattern, after one of its beans was not
+// found
+func (c *nameCatalog) forget(objectPattern string) {
+	if c == nil {
+		return
+	}
+	logger.Debugf("A cached bean of %s is gone, searching its beans again", objectPattern)
+	_ = collectionStore.Delete(c.key(objectPattern))
+}
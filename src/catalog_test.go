@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+// withCatalog enables the name catalog with an in-memory store, and returns
+// a function that restores the previous settings
+func withCatalog() func() {
+	saved := collectionStore
+	collectionStore = persist.NewInMemoryStore()
+	restoreArgs := withArgs(argumentList{NameCacheTTL: 60})
+	return func() {
+		collectionStore = saved
+		restoreArgs()
+	}
+}
+
+func TestNameCatalog(t *testing.T) {
+	defer withCatalog()()
+
+	catalog := newNameCatalog(&jmxTarget{JmxHost: "localhost", JmxPort: "9999"})
+	pattern := "java.lang:type=GarbageCollector,*"
+	if _, ok := catalog.lookup(pattern); ok {
+		t.Error("Expected an empty catalog")
+	}
+
+	names := []string{"java.lang:name=Copy,type=GarbageCollector"}
+	catalog.remember(pattern, names)
+	if cached, ok := catalog.lookup(pattern); !ok || !reflect.DeepEqual(names, cached) {
+		t.Errorf("Expected %v to be cached, got %v", names, cached)
+	}
+
+	catalog.forget(pattern)
+	if _, ok := catalog.lookup(pattern); ok {
+		t.Error("Expected the names to be forgotten")
+	}
+
+	catalog.remember("java.lang:type=Missing,*", nil)
+	if _, ok := catalog.lookup("java.lang:type=Missing,*"); ok {
+		t.Error("Expected queries without beans not to be cached")
+	}
+
+	collectionStore.Set(catalog.key(pattern), catalogEntry{Names: names, Expires: time.Now().Add(-time.Second).UnixNano()})
+	if _, ok := catalog.lookup(pattern); ok {
+		t.Error("Expected expired names to be searched again")
+	}
+
+	args.NameCacheTTL = 0
+	if catalog := newNameCatalog(&jmxTarget{}); catalog != nil {
+		t.Error("Expected no catalog when name_cache_ttl is 0")
+	}
+}
+
+func TestJolokiaCatalog(t *testing.T) {
+	defer withCatalog()()
+
+	searches := map[string][]string{
+		"java.lang:type=Memory":             {"java.lang:type=Memory"},
+		"java.lang:type=GarbageCollector,*": {"java.lang:name=Copy,type=GarbageCollector", "java.lang:name=Gone,type=GarbageCollector"},
+	}
+	handler := fakeJolokiaHandler(t, searches, map[string]map[string]interface{}{
+		"java.lang:type=Memory":                     {"Verbose": false},
+		"java.lang:name=Copy,type=GarbageCollector": {"CollectionCount": 12},
+	})
+	var lock sync.Mutex
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		posts++
+		lock.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c, _ := newJolokiaClient(server.URL, "", "", 1000, nil)
+	c.catalog = newNameCatalog(&jmxTarget{JmxHost: "localhost", JmxPort: "9999"})
+	query := func(pattern string, expectedPosts int) map[string]interface{} {
+		lock.Lock()
+		posts = 0
+		lock.Unlock()
+		result, err := c.query(pattern, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if posts != expectedPosts {
+			t.Errorf("Expected %d requests for %s, got %d", expectedPosts, pattern, posts)
+		}
+		return result
+	}
+
+	query("java.lang:type=Memory", 2)
+	if result := query("java.lang:type=Memory", 1); len(result) != 1 {
+		t.Errorf("Expected the cached bean to be read, got %v", result)
+	}
+
+	query("java.lang:type=GarbageCollector,*", 2)
+	// The cached Gone bean is not found, so the query is searched again
+	expected := map[string]interface{}{"java.lang:name=Copy,type=GarbageCollector,attr=CollectionCount": 12.0}
+	if result := query("java.lang:type=GarbageCollector,*", 3); !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestRMIClientCatalog(t *testing.T) {
+	defer withCatalog()()
+
+	script := &rmiScript{
+		user:     "admin",
+		password: "secret",
+		beans: map[string]map[string]int64{
+			"java.lang:name=Copy,type=GarbageCollector": {"CollectionCount": 12},
+		},
+	}
+	l, port := startRMIScript(t, script)
+	defer func() {
+		_ = l.Close()
+	}()
+
+	c := newRMIClient("127.0.0.1", port, jmxRMIBindingName, "admin", "secret", 1000, nil)
+	c.catalog = newNameCatalog(&jmxTarget{JmxHost: "127.0.0.1", JmxPort: port})
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	for run := 0; run < 2; run++ {
+		if result, err := c.query("java.lang:type=GarbageCollector,*", 1000); err != nil || len(result) != 1 {
+			t.Errorf("Expected one attribute, got %v, %v", result, err)
+		}
+	}
+	c.close()
+
+	searches := 0
+	for _, call := range script.calls {
+		if call == rmiQueryNamesHash {
+			searches++
+		}
+	}
+	if searches != 1 {
+		t.Errorf("Expected the names to be queried once, got %d", searches)
+	}
+}
+
+func TestNrjmxRejectsNameCache(t *testing.T) {
+	defer withCatalog()()
+
+	if _, err := newBackendClient(&jmxTarget{JmxBackend: "nrjmx"}); err != errNrjmxNameCache {
+		t.Errorf("Expected name_cache_ttl to be rejected, got %v", err)
+	}
+	if _, err := newBackendClient(&jmxTarget{JmxBackend: "jolokia", JolokiaURL: "http://localhost:8778/jolokia"}); err != nil {
+		t.Errorf("Expected the jolokia backend to accept name_cache_ttl, got %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/newrelic/infra-integrations-sdk/data/metric"
 )
@@ -27,6 +29,9 @@ type domainDefinition struct {
 type attributeRequest struct {
 	// attrRegexp is a compiled regex pattern that matches the attribute
 	attrRegexp *regexp.Regexp
+	// attrName is the attribute name when it was given literally, and is
+	// empty for attr_regex
+	attrName   string
 	metricName string
 	metricType metric.SourceType
 }
@@ -39,6 +44,42 @@ type beanRequest struct {
 	// exclude is a list of compiled regex that matches beans to exclude from collection
 	exclude    []*regexp.Regexp
 	attributes []*attributeRequest
+	// interval is the minimum time between two collections of the bean,
+	// 0 to collect it on every run
+	interval time.Duration
+	// priority orders the queries of a target, highest first
+	priority int
+}
+
+// attributeNames returns the names of the JMX attributes to read, or nil
+// to read every attribute, when an attribute is matched by a regex.
+// A dotted name may be a composite field such as HeapMemoryUsage.Used, read
+// through its attribute, or an attribute whose name has a dot, as in Kafka
+// and Hibernate beans, so both the name and its prefixes are read. The
+// backends leave out the names the bean doesn't have
+func (r *beanRequest) attributeNames() []string {
+	if len(r.attributes) == 0 {
+		return nil
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, attribute := range r.attributes {
+		if attribute.attrName == "" {
+			return nil
+		}
+		add(attribute.attrName)
+		for i := strings.LastIndex(attribute.attrName, "."); i > 0; i = strings.LastIndex(attribute.attrName[:i], ".") {
+			add(attribute.attrName[:i])
+		}
+	}
+	return names
 }
 
 var parsers []parser
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/integration"
+	"gopkg.in/yaml.v2"
+)
+
+var errDaemonPretty = errors.New("pretty output can't be used with daemon, the agent reads one payload per line")
+
+// connectionPool keeps a connection open to every target between the
+// collection cycles of daemon mode, so nrjmx and its JVM start only once
+type connectionPool struct {
+	lock    sync.Mutex
+	clients map[string]*healthClient
+}
+
+func newConnectionPool() *connectionPool {
+	return &connectionPool{clients: make(map[string]*healthClient)}
+}
+
+// poolKey identifies a target by all of its settings, so that a target whose
+// settings changed gets a new connection
+func poolKey(target *jmxTarget) string {
+	key, _ := yaml.Marshal(target)
+	return string(key)
+}
+
+// collect collects a target with its pooled connection, connecting first if
+// there is none. A connection lost during the cycle is closed, and opened
+// again on the next one
+func (p *connectionPool) collect(target *jmxTarget, i *integration.Integration) (*connectionHealth, error) {
+	client, err := p.connect(target)
+	if client == nil {
+		return &connectionHealth{err: err, errorClass: errorClassConfig}, err
+	}
+	if err != nil {
+		return client.health(), err
+	}
+	client.reset()
+
+	collectFiles(target, client, i)
+
+	key := poolKey(target)
+	health := client.health()
+	if isRetriable(health.err) {
+		if health.queriesFailed == health.queriesAttempted {
+			health.connected = false
+		}
+		logger.Warnf("Reconnecting to %s on the next cycle: %s", target, health.err)
+		p.lock.Lock()
+		delete(p.clients, key)
+		p.lock.Unlock()
+		client.close()
+	}
+	return health, nil
+}
+
+// connect returns the pooled connection of a target, opening it first if
+// there is none. The client is nil when it can't be created, and is returned
+// with the error when it fails to open
+func (p *connectionPool) connect(target *jmxTarget) (*healthClient, error) {
+	key := poolKey(target)
+	p.lock.Lock()
+	client, ok := p.clients[key]
+	p.lock.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	c, err := newJMXClient(target)
+	if err != nil {
+		return nil, err
+	}
+	client = newHealthClient(c, backendName(target) == "nrjmx")
+	if err := client.open(); err != nil {
+		client.close()
+		return client, err
+	}
+	p.lock.Lock()
+	p.clients[key] = client
+	p.lock.Unlock()
+	return client, nil
+}
+
+// refresh reads the targets again between collections, closing the
+// connections of the targets that are gone and opening those of the new
+// ones. Targets that fail to connect are tried again on the next collection
+func (p *connectionPool) refresh() {
+	targets, err := getTargets()
+	if err != nil {
+		logger.Errorf("Failed to read JMX targets: %s", err)
+		return
+	}
+	p.retain(targets)
+	for _, target := range targets {
+		if target.configErr != nil {
+			continue
+		}
+		if _, err := p.connect(target); err != nil {
+			logger.Warnf("Failed to connect to %s, retrying on the next collection: %s", target, err)
+		}
+	}
+}
+
+// retain closes the connections of the targets that are no longer listed
+func (p *connectionPool) retain(targets []*jmxTarget) {
+	keep := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		keep[poolKey(target)] = true
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, client := range p.clients {
+		if !keep[key] {
+			client.close()
+			delete(p.clients, key)
+		}
+	}
+}
+
+// closeAll closes every connection
+func (p *connectionPool) closeAll() {
+	p.retain(nil)
+}
+
+// runDaemon collects every args.DaemonInterval seconds until the process
+// is interrupted, writing one payload per cycle. Targets are read again on
+// every cycle, while connections are kept open. The targets file is also
+// watched between cycles, so that the connections follow its changes
+func runDaemon(i *integration.Integration) {
+	pool := newConnectionPool()
+	defer pool.closeAll()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	interval := time.Duration(args.DaemonInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var watcher *targetsFileWatcher
+	var poll <-chan time.Time
+	if args.TargetsFile != "" {
+		watcher = newTargetsFileWatcher(args.TargetsFile)
+		pollTicker := time.NewTicker(targetsFilePoll)
+		defer pollTicker.Stop()
+		poll = pollTicker.C
+	}
+
+	for {
+		collectCycle(i, pool)
+
+	wait:
+		for {
+			select {
+			case <-ticker.C:
+				break wait
+			case <-poll:
+				if watcher.changed() {
+					logger.Infof("Targets file %s changed, updating JMX connections", args.TargetsFile)
+					pool.refresh()
+				}
+			case sig := <-signals:
+				logger.Infof("Received %s, closing JMX connections", sig)
+				return
+			}
+		}
+	}
+}
+
+// collectCycle collects every target and publishes the payload. Errors are
+// logged, as the next cycle may succeed
+func collectCycle(i *integration.Integration, pool *connectionPool) {
+	targets, err := getTargets()
+	if err != nil {
+		logger.Errorf("Failed to read JMX targets: %s", err)
+		return
+	}
+	pool.retain(targets)
+
+	_ = collectTargets(targets, i, pool)
+
+	i.Entities = checkMetricLimit(i.Entities)
+	if err := i.Publish(); err != nil {
+		logger.Errorf("Failed to publish integration: %s", err.Error())
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+// countingJolokia serves a Jolokia agent with a single bean and counts the
+// version requests made by every connection open
+func countingJolokia(t *testing.T, opens *int32) *httptest.Server {
+	handler := fakeJolokiaHandler(t,
+		map[string][]string{"java.lang:type=Memory": {"java.lang:type=Memory"}},
+		map[string]map[string]interface{}{"java.lang:type=Memory": {"HeapMemoryUsage": map[string]interface{}{"used": 100}}},
+	)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if bytes.Contains(body, []byte(`"type":"version"`)) {
+			atomic.AddInt32(opens, 1)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func TestConnectionPool(t *testing.T) {
+	var opens int32
+	server := countingJolokia(t, &opens)
+
+	defer withArgs(argumentList{Timeout: 1000})()
+	i, _ := integration.New("jmxtest", "0.1.0")
+	target := &jmxTarget{JmxBackend: "jolokia", JolokiaURL: server.URL, CollectionFiles: "../test/infra-good.yml"}
+	pool := newConnectionPool()
+
+	for cycle := 0; cycle < 3; cycle++ {
+		health, err := pool.collect(target, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !health.connected || health.queriesFailed != 0 || health.queriesAttempted == 0 {
+			t.Errorf("Unexpected health on cycle %d: %+v", cycle, health)
+		}
+	}
+	if opens != 1 {
+		t.Errorf("Expected the connection to be opened once, got %d", opens)
+	}
+
+	changed := *target
+	changed.JmxUser = "monitor"
+	pool.retain([]*jmxTarget{&changed})
+	if len(pool.clients) != 0 {
+		t.Error("Expected the connection of the changed target to be closed")
+	}
+
+	if _, err := pool.collect(&changed, i); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	health, _ := pool.collect(&changed, i)
+	if health.connected || health.errorClass != errorClassRefused || len(pool.clients) != 0 {
+		t.Errorf("Expected the lost connection to be dropped from the pool: %+v", health)
+	}
+}
+
+func TestCollectCycle(t *testing.T) {
+	var opens int32
+	server := countingJolokia(t, &opens)
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "nri-jmx-daemon")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	collection := filepath.Join(dir, "memory.yml")
+	_ = ioutil.WriteFile(collection, []byte("collect:\n  - domain: java.lang\n    beans:\n      - query: type=Memory\n"), 0600)
+
+	defer withArgs(argumentList{
+		Timeout:         1000,
+		Concurrency:     1,
+		JmxBackend:      "jolokia",
+		JolokiaURL:      server.URL,
+		CollectionFiles: collection,
+	})()
+	var out bytes.Buffer
+	i, _ := integration.New("jmxtest", "0.1.0", integration.Writer(&out))
+	pool := newConnectionPool()
+	defer pool.closeAll()
+
+	collectCycle(i, pool)
+	collectCycle(i, pool)
+
+	payloads := 0
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var payload struct {
+			Data []struct {
+				Entity struct {
+					Type string `json:"type"`
+				} `json:"entity"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &payload); err != nil {
+			t.Fatalf("Expected one JSON payload per line: %s", err)
+		}
+		if len(payload.Data) != 2 {
+			t.Errorf("Expected the domain and jvm entities in every payload, got %+v", payload.Data)
+		}
+		payloads++
+	}
+	if payloads != 2 || opens != 1 {
+		t.Errorf("Expected 2 payloads over a single connection, got %d payloads and %d opens", payloads, opens)
+	}
+}
+
+func TestConnectionPoolRefresh(t *testing.T) {
+	var opens int32
+	orders, billing := countingJolokia(t, &opens), countingJolokia(t, &opens)
+	defer orders.Close()
+	defer billing.Close()
+
+	dir, _ := ioutil.TempDir("", "nri-jmx-daemon")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file := filepath.Join(dir, "targets.yml")
+	entry := "- {name: %s, jmx_backend: jolokia, jolokia_url: %q}\n"
+	_ = ioutil.WriteFile(file, []byte(fmt.Sprintf(entry+entry, "orders", orders.URL, "billing", billing.URL)), 0600)
+
+	defer withArgs(argumentList{Timeout: 1000, Targets: file})()
+	pool := newConnectionPool()
+	defer pool.closeAll()
+
+	pool.refresh()
+	if len(pool.clients) != 2 || opens != 2 {
+		t.Fatalf("Expected the connections of both targets to be opened, got %d clients and %d opens", len(pool.clients), opens)
+	}
+
+	_ = ioutil.WriteFile(file, []byte(fmt.Sprintf(entry, "orders", orders.URL)), 0600)
+	pool.refresh()
+	if len(pool.clients) != 1 || opens != 2 {
+		t.Errorf("Expected the connection of the removed target to be closed, got %d clients and %d opens", len(pool.clients), opens)
+	}
+}
+
+func TestConnectionPoolClosesFailedOpen(t *testing.T) {
+	script := &rmiScript{user: "admin", password: "secret"}
+	l, port := startRMIScript(t, script)
+	defer func() {
+		_ = l.Close()
+	}()
+
+	defer withArgs(argumentList{Timeout: 1000})()
+	i, _ := integration.New("jmxtest", "0.1.0")
+	target := &jmxTarget{JmxBackend: "native", JmxHost: "127.0.0.1", JmxPort: port, JmxUser: "admin", JmxPass: "wrong"}
+	pool := newConnectionPool()
+	for cycle := 0; cycle < 3; cycle++ {
+		if _, err := pool.collect(target, i); err == nil {
+			t.Fatal("Expected the login to fail")
+		}
+	}
+
+	for wait := 0; atomic.LoadInt32(&script.open) != 0 && wait < 100; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if open := atomic.LoadInt32(&script.open); open != 0 || len(pool.clients) != 0 {
+		t.Errorf("Expected the connections of the failed logins to be closed, %d are open", open)
+	}
+}
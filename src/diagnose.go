@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	diagnosticPass = "PASS"
+	diagnosticWarn = "WARN"
+	diagnosticFail = "FAIL"
+	diagnosticSkip = "SKIP"
+)
+
+// diagnosticRuntimeBean is the bean read by the trial query. Every JVM
+// registers it
+const diagnosticRuntimeBean = "java.lang:type=Runtime"
+
+// diagnosticStep is the outcome of one check of a diagnosis
+type diagnosticStep struct {
+	name     string
+	status   string
+	duration time.Duration
+	detail   string
+	// hint suggests how to fix a failure or a warning
+	hint string
+}
+
+func passStep(format string, a ...interface{}) *diagnosticStep {
+	return &diagnosticStep{status: diagnosticPass, detail: fmt.Sprintf(format, a...)}
+}
+
+func warnStep(detail, hint string) *diagnosticStep {
+	return &diagnosticStep{status: diagnosticWarn, detail: detail, hint: hint}
+}
+
+func failStep(detail, hint string) *diagnosticStep {
+	return &diagnosticStep{status: diagnosticFail, detail: detail, hint: hint}
+}
+
+func skipStep(detail string) *diagnosticStep {
+	return &diagnosticStep{status: diagnosticSkip, detail: detail}
+}
+
+// diagnosis walks through the connection to a target one layer at a time,
+// so that a failure points at the layer that is broken
+type diagnosis struct {
+	target  *jmxTarget
+	timeout time.Duration
+	host    string
+	port    string
+	steps   []*diagnosticStep
+	failed  bool
+
+	client jmxClient
+}
+
+// run times a check and records its outcome. Once a check fails, the ones
+// after it are skipped, as they depend on it
+func (d *diagnosis) run(name string, check func() *diagnosticStep) {
+	if d.failed {
+		d.steps = append(d.steps, &diagnosticStep{name: name, status: diagnosticSkip, detail: "skipped after an earlier failure"})
+		return
+	}
+
+	start := time.Now()
+	step := check()
+	step.name = name
+	step.duration = time.Since(start)
+	d.steps = append(d.steps, step)
+	d.failed = step.status == diagnosticFail
+}
+
+// diagnoseTarget runs every check against a target
+func diagnoseTarget(target *jmxTarget) *diagnosis {
+	d := &diagnosis{
+		target:  target,
+		timeout: time.Duration(args.Timeout) * time.Millisecond,
+		host:    target.JmxHost,
+		port:    target.JmxPort,
+	}
+	defer func() {
+		if d.client != nil {
+			d.client.close()
+		}
+	}()
+
+	d.run("Configuration", d.checkAddress)
+	d.run("DNS resolution", d.checkDNS)
+	d.run("TCP connect", d.checkTCP)
+	d.run("TLS handshake", d.checkTLS)
+	d.run("nrjmx binary", d.checkNrjmx)
+	d.run("Authentication", d.checkAuthentication)
+	d.run("Trial query", d.checkQuery)
+
+	return d
+}
+
+// checkAddress finds the address the backend connects to
+func (d *diagnosis) checkAddress() *diagnosticStep {
+	if d.target.configErr != nil {
+		return failStep(d.target.configErr.Error(), "Fix the secret references and SSL settings of the target")
+	}
+	if d.target.JmxBackend != "jolokia" {
+		return passStep("backend %s, connecting to %s", backendName(d.target), net.JoinHostPort(d.host, d.port))
+	}
+
+	u, err := url.Parse(d.target.JolokiaURL)
+	if err != nil || u.Hostname() == "" {
+		return failStep(fmt.Sprintf("invalid jolokia_url %q", d.target.JolokiaURL), "Set jolokia_url to the agent endpoint, such as http://host:8778/jolokia")
+	}
+	d.host, d.port = u.Hostname(), u.Port()
+	if d.port == "" {
+		d.port = "80"
+		if u.Scheme == "https" {
+			d.port = "443"
+		}
+	}
+	return passStep("backend jolokia, connecting to %s", net.JoinHostPort(d.host, d.port))
+}
+
+func (d *diagnosis) checkDNS() *diagnosticStep {
+	if net.ParseIP(d.host) != nil {
+		return passStep("%s is an IP address", d.host)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupHost(ctx, d.host)
+	if err != nil {
+		return failStep(err.Error(), "Check the spelling of the host name and the DNS configuration of this host")
+	}
+	return passStep("%s resolves to %s", d.host, strings.Join(addresses, ", "))
+}
+
+func (d *diagnosis) checkTCP() *diagnosticStep {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(d.host, d.port), d.timeout)
+	if err != nil {
+		return failStep(err.Error(), fmt.Sprintf("Check that the JVM is running and listening on port %s, as set by -Dcom.sun.management.jmxremote.port or the Jolokia agent port, and that no firewall blocks it", d.port))
+	}
+	_ = conn.Close()
+	return passStep("connected to %s", conn.RemoteAddr())
+}
+
+// checkTLS validates the keystores and tries a TLS handshake. JMX over RMI
+// usually exports only the connector over SSL, not the registry on the JMX
+// port, so a failed handshake there is a warning rather than a failure
+func (d *diagnosis) checkTLS() *diagnosticStep {
+	jolokiaTLS := d.target.JmxBackend == "jolokia" && strings.HasPrefix(d.target.JolokiaURL, "https:")
+	if !d.target.keyStoreSSL() && d.target.tls == nil && !jolokiaTLS {
+		return skipStep("no SSL arguments set")
+	}
+
+	var notes []string
+	config := d.target.tlsConfig()
+	if d.target.keyStoreSSL() {
+		for _, store := range []struct{ name, path, password string }{
+			{"key_store", d.target.KeyStore, d.target.KeyStorePassword},
+			{"trust_store", d.target.TrustStore, d.target.TrustStorePassword},
+		} {
+			content, err := ioutil.ReadFile(store.path)
+			if err != nil {
+				return failStep(err.Error(), fmt.Sprintf("Check that %s points to a file readable by the user running the integration", store.name))
+			}
+			switch err := checkJKSPassword(content, store.password); err {
+			case nil:
+				notes = append(notes, store.name+" password verified")
+			case errNotJKS:
+				notes = append(notes, store.name+" is not a JKS file, its password is checked by nrjmx")
+			default:
+				return failStep(fmt.Sprintf("%s: %s", store.name, err), fmt.Sprintf("Check %s_password", store.name))
+			}
+		}
+		// The keystores are only readable by Java, so the server
+		// certificate is not verified here
+		config = &tls.Config{InsecureSkipVerify: true}
+		notes = append(notes, "server certificate not verified against trust_store")
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.ServerName = d.host
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: d.timeout}, "tcp", net.JoinHostPort(d.host, d.port), config)
+	if err != nil {
+		if !jolokiaTLS {
+			return warnStep(
+				fmt.Sprintf("port %s does not accept TLS: %s", d.port, err),
+				"This is expected unless -Dcom.sun.management.jmxremote.registry.ssl=true, as only the connector uses SSL. The authentication step checks the connector",
+			)
+		}
+		return failStep(err.Error(), "Check that tls_ca_file holds the CA that signed the agent certificate, and that the certificate matches the host name")
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		notes = append([]string{fmt.Sprintf("server certificate %s, expires %s", certs[0].Subject.CommonName, certs[0].NotAfter.Format("2006-01-02"))}, notes...)
+	}
+	return passStep("%s", strings.Join(notes, "; "))
+}
+
+// checkNrjmx finds the nrjmx tool and the Java runtime it needs
+func (d *diagnosis) checkNrjmx() *diagnosticStep {
+	if backendName(d.target) != "nrjmx" {
+		return skipStep("not used by the " + d.target.JmxBackend + " backend")
+	}
+
+	command := (&nrjmxConfig{}).command()
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return failStep(err.Error(), "Install the nrjmx package, or set NR_JMX_TOOL to the nrjmx command")
+	}
+	if filepath.Base(path) == "nrjmx" {
+		if _, err := exec.LookPath("java"); err != nil {
+			return failStep("java not found in PATH", "nrjmx runs on Java, install a Java runtime or add it to the PATH")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	version := "unknown"
+	output, err := exec.CommandContext(ctx, command[0], append(command[1:], "-version")...).Output()
+	if line := strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)[0]; err == nil && line != "" {
+		version = line
+	}
+	return passStep("found %s, version %s", path, version)
+}
+
+// checkAuthentication opens the connection. nrjmx only connects on its
+// first query, so a query of the MBean server delegate forces the login
+func (d *diagnosis) checkAuthentication() *diagnosticStep {
+	client, err := newBackendClient(d.target)
+	if err != nil {
+		return failStep(err.Error(), "Fix the backend arguments")
+	}
+	d.client = client
+
+	err = client.open()
+	if err == nil && backendName(d.target) == "nrjmx" {
+		_, err = client.query("JMImplementation:type=MBeanServerDelegate", args.Timeout)
+	}
+	if err == nil {
+		if d.target.JmxUser == "" || d.target.JmxPass == "" {
+			return passStep("connected without credentials")
+		}
+		return passStep("connected as %s", d.target.JmxUser)
+	}
+
+	message := err.Error()
+	switch {
+	case isAuthFailure(message):
+		return failStep(message, "Check jmx_user and jmx_pass against the jmxremote.password and jmxremote.access files of the JVM, or the agent credentials")
+	case strings.Contains(message, "SSL") || strings.Contains(message, "certificate") || strings.Contains(message, "handshake"):
+		return failStep(message, "Check the SSL arguments: the trust store must hold the CA of the JVM certificate, and the key store the client certificate when the JVM requires one")
+	default:
+		return failStep(message, "The port accepts connections but the JMX connection failed. Check jmx_remote or jmx_url for the connector protocol, and that -Djava.rmi.server.hostname is an address reachable from this host")
+	}
+}
+
+func (d *diagnosis) checkQuery() *diagnosticStep {
+	result, err := d.client.query(diagnosticRuntimeBean, args.Timeout)
+	if err != nil {
+		return failStep(err.Error(), "The connection works but the query failed. Check that the JMX user has read access to java.lang beans")
+	}
+	if len(result) == 0 {
+		return warnStep(diagnosticRuntimeBean+" returned no attributes", "Check that the JMX user has read access to java.lang beans")
+	}
+
+	detail := fmt.Sprintf("%s returned %d attributes", diagnosticRuntimeBean, len(result))
+	if vm, ok := result[diagnosticRuntimeBean+",attr=VmName"]; ok {
+		detail += fmt.Sprintf(" (%v %v)", vm, result[diagnosticRuntimeBean+",attr=VmVersion"])
+	}
+	return passStep("%s", detail)
+}
+
+// backendName returns the backend of a target, naming the default
+func backendName(target *jmxTarget) string {
+	if target.JmxBackend == "" {
+		return "nrjmx"
+	}
+	return target.JmxBackend
+}
+
+// write prints the steps as a table, with the hint below each failure or
+// warning. Secrets are masked, as errors may quote connection arguments
+func (d *diagnosis) write(w io.Writer) {
+	fmt.Fprintf(w, "Target %s\n", d.target)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, step := range d.steps {
+		fmt.Fprintf(tw, "  [%s]\t%s\t%s\t%s\n", step.status, step.name, step.duration.Round(time.Millisecond), redact(step.detail))
+		if step.hint != "" {
+			fmt.Fprintf(tw, "  \t\t\thint: %s\n", redact(step.hint))
+		}
+	}
+	_ = tw.Flush()
+	fmt.Fprintln(w)
+}
+
+// diagnose checks every target and prints a report to w. targetsErr is the
+// error getTargets returned, if any. It reports whether every check passed
+func diagnose(w io.Writer, targets []*jmxTarget, targetsErr error) bool {
+	if targetsErr != nil {
+		fmt.Fprintf(w, "Configuration\n  [%s]  %s\n         hint: Fix the arguments or the targets list, then run -diagnose again\n", diagnosticFail, redact(targetsErr.Error()))
+		return false
+	}
+
+	passed := 0
+	for _, target := range targets {
+		d := diagnoseTarget(target)
+		d.write(w)
+		if !d.failed {
+			passed++
+		}
+	}
+	fmt.Fprintf(w, "%d of %d targets passed\n", passed, len(targets))
+
+	return passed == len(targets)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func stepStatuses(d *diagnosis) []string {
+	var statuses []string
+	for _, step := range d.steps {
+		statuses = append(statuses, step.status)
+	}
+	return statuses
+}
+
+func TestDiagnoseJolokia(t *testing.T) {
+	server := fakeJolokia(t,
+		map[string][]string{diagnosticRuntimeBean: {diagnosticRuntimeBean}},
+		map[string]map[string]interface{}{
+			diagnosticRuntimeBean: {"VmName": "OpenJDK 64-Bit Server VM", "VmVersion": "11.0.2", "Uptime": 1000},
+		},
+	)
+	defer server.Close()
+
+	defer withArgs(argumentList{Timeout: 1000})()
+	target := &jmxTarget{JmxBackend: "jolokia", JolokiaURL: server.URL}
+	d := diagnoseTarget(target)
+
+	expected := []string{diagnosticPass, diagnosticPass, diagnosticPass, diagnosticSkip, diagnosticSkip, diagnosticPass, diagnosticPass}
+	if statuses := stepStatuses(d); !reflect.DeepEqual(expected, statuses) {
+		t.Errorf("Expected steps %v, got %v", expected, statuses)
+	}
+	if detail := d.steps[len(d.steps)-1].detail; detail != "java.lang:type=Runtime returned 3 attributes (OpenJDK 64-Bit Server VM 11.0.2)" {
+		t.Errorf("Unexpected trial query detail %q", detail)
+	}
+}
+
+func TestDiagnoseNrjmx(t *testing.T) {
+	defer fakeNrjmx()()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	defer withArgs(argumentList{Timeout: 5000})()
+	d := diagnoseTarget(&jmxTarget{JmxHost: host, JmxPort: port, JmxUser: "admin", JmxPass: "secret"})
+
+	expected := []string{diagnosticPass, diagnosticPass, diagnosticPass, diagnosticSkip, diagnosticPass, diagnosticPass, diagnosticPass}
+	if statuses := stepStatuses(d); !reflect.DeepEqual(expected, statuses) {
+		t.Errorf("Expected steps %v, got %v", expected, statuses)
+	}
+	if detail := d.steps[5].detail; detail != "connected as admin" {
+		t.Errorf("Unexpected authentication detail %q", detail)
+	}
+}
+
+func TestDiagnoseConnectionRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	_ = listener.Close()
+
+	defer withArgs(argumentList{Timeout: 1000})()
+	var out bytes.Buffer
+	if diagnose(&out, []*jmxTarget{{JmxHost: host, JmxPort: port}}, nil) {
+		t.Error("Expected the diagnosis to fail")
+	}
+
+	report := out.String()
+	for _, line := range []string{
+		"[FAIL]  TCP connect",
+		"hint: Check that the JVM is running and listening on port " + port,
+		"[SKIP]  Trial query",
+		"0 of 1 targets passed",
+	} {
+		if !strings.Contains(report, line) {
+			t.Errorf("Expected %q in report:\n%s", line, report)
+		}
+	}
+}
+
+func TestDiagnoseTargetsError(t *testing.T) {
+	var out bytes.Buffer
+	if diagnose(&out, nil, errors.New("partial SSL configuration")) {
+		t.Error("Expected the diagnosis to fail")
+	}
+	if !strings.Contains(out.String(), "[FAIL]  partial SSL configuration") {
+		t.Errorf("Unexpected report:\n%s", out.String())
+	}
+}
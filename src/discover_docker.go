@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Container labels that enable and configure JMX collection
+const (
+	dockerPortLabel       = "com.newrelic.jmx.port"
+	dockerCollectionLabel = "com.newrelic.jmx.collection_files"
+	dockerNetworkLabel    = "com.newrelic.jmx.network"
+)
+
+// dockerContainer holds the fields of the Engine API container list that
+// discovery needs
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Image           string            `json:"Image"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// name returns the container name without the leading slash
+func (c *dockerContainer) name() string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// ip returns the container address on the network named by the
+// com.newrelic.jmx.network label, or else on the first network, by name,
+// that gave it an address
+func (c *dockerContainer) ip() string {
+	networks := c.NetworkSettings.Networks
+	if network, ok := c.Labels[dockerNetworkLabel]; ok {
+		return networks[network].IPAddress
+	}
+
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ip := networks[name].IPAddress; ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// runningJMXContainers asks the Docker Engine listening on socket for the
+// running containers that have the com.newrelic.jmx.port label
+func runningJMXContainers(ctx context.Context, socket string, timeout time.Duration) ([]*dockerContainer, error) {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	filters, err := json.Marshal(map[string][]string{
+		"label":  {dockerPortLabel},
+		"status": {"running"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The host is ignored, requests go to the socket
+	req, err := http.NewRequest(http.MethodGet, "http://docker/containers/json?filters="+url.QueryEscape(string(filters)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing containers: unexpected HTTP status %s", resp.Status)
+	}
+
+	var containers []*dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("decoding container list: %s", err)
+	}
+	return containers, nil
+}
+
+// discoverDocker returns a target for every running container labelled with
+// com.newrelic.jmx.port. The target connects to the container IP and its
+// metric sets are labelled with the container name, image and id
+func discoverDocker(socket string, timeout time.Duration) ([]*jmxTarget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	containers, err := runningJMXContainers(ctx, socket, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*jmxTarget
+	for _, c := range containers {
+		port, ok := c.Labels[dockerPortLabel]
+		if !ok {
+			continue
+		}
+		ip := c.ip()
+		if ip == "" {
+			logger.Debugf("Skipping container %s: it has no IP address", c.name())
+			continue
+		}
+
+		t := newDiscoveredTarget(c.name(), ip, port)
+		t.withholdCredentials()
+		if collection := c.Labels[dockerCollectionLabel]; collection != "" {
+			files, err := collectionFilesIn(args.CollectionDir, collection)
+			if err != nil {
+				logger.Warnf("Skipping container %s: %s label: %s", c.name(), dockerCollectionLabel, err)
+				continue
+			}
+			t.CollectionFiles = files
+		}
+		t.Labels = map[string]string{
+			"container":    c.name(),
+			"image":        c.Image,
+			"container_id": c.ID,
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testContainerList = `[
+  {
+    "Id": "3f4e8a",
+    "Names": ["/orders"],
+    "Image": "shop/orders:1.2",
+    "Labels": {"com.newrelic.jmx.port": "9999", "com.newrelic.jmx.collection_files": "orders.yml"},
+    "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}
+  },
+  {
+    "Id": "9b1c2d",
+    "Names": ["/billing"],
+    "Image": "shop/billing:3.0",
+    "Labels": {"com.newrelic.jmx.port": "9010", "com.newrelic.jmx.network": "backend"},
+    "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.3"}, "backend": {"IPAddress": "10.0.9.3"}}}
+  },
+  {
+    "Id": "5d4e3f",
+    "Names": ["/evil"],
+    "Image": "shop/evil:1.0",
+    "Labels": {"com.newrelic.jmx.port": "9999", "com.newrelic.jmx.collection_files": "/root/.ssh/id_rsa"},
+    "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.4"}}}
+  },
+  {
+    "Id": "7a6b5c",
+    "Names": ["/host-network"],
+    "Image": "shop/batch:1.0",
+    "Labels": {"com.newrelic.jmx.port": "9999"},
+    "NetworkSettings": {"Networks": {"host": {"IPAddress": ""}}}
+  }
+]`
+
+// fakeDockerEngine serves the container list on a unix socket in dir and
+// returns the socket path
+func fakeDockerEngine(t *testing.T, dir string) (*httptest.Server, string) {
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil {
+			t.Errorf("Unexpected filters in %s: %s", r.URL, err)
+		}
+		expected := map[string][]string{"label": {"com.newrelic.jmx.port"}, "status": {"running"}}
+		if r.URL.Path != "/containers/json" || !reflect.DeepEqual(expected, filters) {
+			t.Errorf("Unexpected request %s", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, testContainerList)
+	}))
+	server.Listener = listener
+	server.Start()
+	return server, socket
+}
+
+func TestDiscoverDocker(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nri-jmx-docker")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	server, socket := fakeDockerEngine(t, dir)
+	defer server.Close()
+
+	defer withArgs(argumentList{
+		JmxUser:         "admin",
+		JmxPass:         "docker-secret",
+		CollectionFiles: "jvm-metrics.yml",
+		CollectionDir:   "/etc/jmx",
+		Timeout:         1000,
+		DiscoverDocker:  true,
+		DockerSocket:    socket,
+	})()
+	targets, err := getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 labelled containers with an IP and valid collection files, got %d", len(targets))
+	}
+
+	orders, billing := targets[0], targets[1]
+	if orders.JmxHost != "172.17.0.2" || orders.JmxPort != "9999" || orders.CollectionFiles != "/etc/jmx/orders.yml" || orders.JmxUser != "admin" {
+		t.Errorf("Unexpected target %+v", orders)
+	}
+	if name := orders.entityName("java.lang"); name != "orders:java.lang" {
+		t.Errorf("Expected entities qualified with the container, got %s", name)
+	}
+	if expected := map[string]string{"container": "orders", "image": "shop/orders:1.2", "container_id": "3f4e8a"}; !reflect.DeepEqual(expected, orders.Labels) {
+		t.Errorf("Expected labels %v, got %v", expected, orders.Labels)
+	}
+	if billing.JmxHost != "10.0.9.3" || billing.CollectionFiles != "jvm-metrics.yml" {
+		t.Errorf("Expected the labelled network address and default collection files, got %+v", billing)
+	}
+	if orders.JmxPass != "" {
+		t.Error("Expected the password to be withheld from discovered containers")
+	}
+
+	args.DiscoverCredentials = true
+	if targets, err = getTargets(); err != nil || len(targets) != 2 || targets[0].JmxPass != "docker-secret" {
+		t.Errorf("Expected discover_credentials to pass the password to discovered containers, got %v, %v", targets, err)
+	}
+}
+
+func TestDiscoverDockerNoEngine(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nri-jmx-docker")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	if _, err := discoverDocker(filepath.Join(dir, "docker.sock"), time.Second); err == nil {
+		t.Error("Expected error when the socket does not exist")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// targetGroup is an entry of a targets file. Like a Prometheus file_sd
+// group, it lists host:port addresses that share labels, along with the
+// collection files applied to all of them
+type targetGroup struct {
+	Targets         []string          `yaml:"targets"`
+	Labels          map[string]string `yaml:"labels"`
+	CollectionFiles string            `yaml:"collection_files"`
+}
+
+// targetsFilePoll is how often daemon mode checks the targets file for
+// changes between collections
+const targetsFilePoll = time.Second
+
+// targetsFiles returns path, or the .json, .yml and .yaml files of path when
+// it is a directory
+func targetsFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".json", ".yml", ".yaml":
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// discoverFile returns the targets listed in a JSON or YAML targets file, or
+// in every .json, .yml and .yaml file of a directory. It is read on every
+// run, so changes apply without restarting anything. Files that can't be
+// parsed are skipped, as they may be in the middle of being written
+func discoverFile(path string) ([]*jmxTarget, error) {
+	files, err := targetsFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*jmxTarget
+	for _, file := range files {
+		groups, err := readTargetGroups(file)
+		if err != nil {
+			logger.Errorf("Skipping targets file %s: %s", file, err)
+			continue
+		}
+
+		for _, group := range groups {
+			for _, address := range group.Targets {
+				host, port, err := net.SplitHostPort(address)
+				if err != nil {
+					logger.Errorf("Skipping target %s in %s: %s", address, file, err)
+					continue
+				}
+
+				t := newDiscoveredTarget("", host, port)
+				if group.CollectionFiles != "" {
+					t.CollectionFiles = group.CollectionFiles
+				}
+				t.Labels = group.Labels
+				targets = append(targets, t)
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+func readTargetGroups(file string) ([]*targetGroup, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is valid YAML, so a single decoder handles both formats
+	var groups []*targetGroup
+	if err := yaml.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("parsing targets: %s", err)
+	}
+	for i, group := range groups {
+		if group == nil {
+			return nil, fmt.Errorf("group %d is empty", i)
+		}
+	}
+
+	return groups, nil
+}
+
+// targetsFileWatcher notices changes to a targets file, or to the files of a
+// targets directory, by polling their names, sizes and modification times
+type targetsFileWatcher struct {
+	path  string
+	state string
+}
+
+func newTargetsFileWatcher(path string) *targetsFileWatcher {
+	w := &targetsFileWatcher{path: path}
+	w.state = w.stat()
+	return w
+}
+
+// stat describes the watched files, or the error listing them
+func (w *targetsFileWatcher) stat() string {
+	files, err := targetsFiles(w.path)
+	if err != nil {
+		return err.Error()
+	}
+	var state []string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			state = append(state, err.Error())
+			continue
+		}
+		state = append(state, fmt.Sprintf("%s %d %d", file, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(state, "\n")
+}
+
+// changed returns whether the files changed since the previous call
+func (w *targetsFileWatcher) changed() bool {
+	state := w.stat()
+	if state == w.state {
+		return false
+	}
+	w.state = state
+	return true
+}
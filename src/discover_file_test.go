@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+func TestDiscoverFileDirectory(t *testing.T) {
+	defer withArgs(argumentList{JmxUser: "admin", CollectionFiles: "jvm-metrics.yml", TargetsFile: "../test/targets.d"})()
+
+	targets, err := getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 3 {
+		t.Fatalf("Expected 3 targets, got %d", len(targets))
+	}
+
+	billing, orders := targets[0], targets[1]
+	if billing.String() != "billing.localnet:9010" || billing.CollectionFiles != "jvm-metrics.yml" || billing.Labels["env"] != "staging" {
+		t.Errorf("Unexpected billing target %+v", billing)
+	}
+	if orders.String() != "orders-1.localnet:9999" || orders.CollectionFiles != "/etc/newrelic-infra/integrations.d/tomcat-metrics.yml" {
+		t.Errorf("Unexpected orders target %+v", orders)
+	}
+	if expected := map[string]string{"env": "production", "service": "orders"}; !reflect.DeepEqual(expected, targets[2].Labels) {
+		t.Errorf("Expected labels %v, got %v", expected, targets[2].Labels)
+	}
+}
+
+func TestDiscoverFileMissing(t *testing.T) {
+	if _, err := discoverFile("../test/nonexistent.json"); err == nil {
+		t.Error("Expected error for a missing targets file")
+	}
+}
+
+func TestTargetsFileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nri-jmx-targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file := filepath.Join(dir, "jvms.yml")
+	if err := ioutil.WriteFile(file, []byte("- targets: [orders:9999]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newTargetsFileWatcher(dir)
+	if w.changed() {
+		t.Error("Expected no change before the file is written")
+	}
+	if err := ioutil.WriteFile(file, []byte("- targets: [orders:9999, billing:9010]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !w.changed() || w.changed() {
+		t.Error("Expected a single change for the rewritten file")
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(file, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if !w.changed() {
+		t.Error("Expected a change of modification time to be noticed")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if w.changed() {
+		t.Error("Expected files that aren't targets files to be ignored")
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if !w.changed() {
+		t.Error("Expected the removed file to be noticed")
+	}
+}
+
+func TestTargetLabelsAttributes(t *testing.T) {
+	client := &fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		if name != "java.lang:type=Memory" {
+			return nil, errors.New("unexpected query " + name)
+		}
+		return map[string]interface{}{"java.lang:type=Memory,attr=Used": 1.0}, nil
+	}}
+	collection := []*domainDefinition{{
+		domain:    "java.lang",
+		eventType: "JavaLangSample",
+		beans: []*beanRequest{{
+			beanQuery:  "type=Memory",
+			attributes: []*attributeRequest{{attrRegexp: regexp.MustCompile("attr=Used$"), metricName: "used", metricType: metric.GAUGE}},
+		}},
+	}}
+
+	i, _ := integration.New("jmxtest", "0.1.0")
+	target := &jmxTarget{JmxHost: "orders.localnet", Labels: map[string]string{"env": "production"}}
+	if err := queryJMX(collection, client, target, i); err != nil {
+		t.Fatal(err)
+	}
+	if env := i.Entities[0].Metrics[0].Metrics["label.env"]; env != "production" {
+		t.Errorf("Expected label attribute, got %v", i.Entities[0].Metrics[0].Metrics)
+	}
+}
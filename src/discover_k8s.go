@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Pod annotations that enable and configure JMX collection
+const (
+	k8sPortAnnotation       = "newrelic.com/jmx-port"
+	k8sCollectionAnnotation = "newrelic.com/jmx-collection"
+	k8sContainerAnnotation  = "newrelic.com/jmx-container"
+)
+
+// k8sServiceAccountDir holds the credentials mounted in every pod
+var k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sAPI is a minimal client for the Kubernetes API server
+type k8sAPI struct {
+	server   string
+	token    string
+	username string
+	password string
+	http     *http.Client
+}
+
+// k8sPodList holds the fields of a pod list that discovery needs
+type k8sPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			Containers []struct {
+				Name string `json:"name"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// kubeconfig holds the parts of a kubeconfig file used to reach the API
+// server. Exec and auth provider plugins are not supported
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string      `yaml:"token"`
+			TokenFile             string      `yaml:"tokenFile"`
+			ClientCertificate     string      `yaml:"client-certificate"`
+			ClientCertificateData string      `yaml:"client-certificate-data"`
+			ClientKey             string      `yaml:"client-key"`
+			ClientKeyData         string      `yaml:"client-key-data"`
+			Username              string      `yaml:"username"`
+			Password              string      `yaml:"password"`
+			Exec                  interface{} `yaml:"exec"`
+			AuthProvider          interface{} `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// newK8sAPI returns a client configured from a kubeconfig file, or from the
+// in-cluster service account when kubeconfigPath is empty
+func newK8sAPI(kubeconfigPath string, timeout time.Duration) (*k8sAPI, error) {
+	if kubeconfigPath == "" {
+		return inClusterK8sAPI(timeout)
+	}
+	return kubeconfigK8sAPI(kubeconfigPath, timeout)
+}
+
+func inClusterK8sAPI(timeout time.Duration) (*k8sAPI, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster, set kubeconfig")
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(k8sServiceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account token: %s", err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(k8sServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA: %s", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in the service account CA")
+	}
+
+	return &k8sAPI{
+		server: "https://" + net.JoinHostPort(host, port),
+		token:  strings.TrimSpace(string(token)),
+		http:   k8sHTTPClient(&tls.Config{RootCAs: roots}, timeout),
+	}, nil
+}
+
+func kubeconfigK8sAPI(path string, timeout time.Duration) (*k8sAPI, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading kubeconfig: %s", err)
+	}
+	var config kubeconfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("parsing kubeconfig: %s", err)
+	}
+
+	var clusterName, userName string
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("context %q not found in kubeconfig", config.CurrentContext)
+	}
+
+	api := &k8sAPI{}
+	tlsConfig := &tls.Config{}
+	for _, c := range config.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		api.server = c.Cluster.Server
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := kubeconfigData(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("reading certificate authority: %s", err)
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, errors.New("no certificates in the kubeconfig certificate authority")
+			}
+		}
+	}
+	if api.server == "" {
+		return nil, fmt.Errorf("cluster %q not found in kubeconfig", clusterName)
+	}
+
+	for _, u := range config.Users {
+		if u.Name != userName {
+			continue
+		}
+		if u.User.Exec != nil || u.User.AuthProvider != nil {
+			return nil, errors.New("kubeconfig exec and auth-provider credentials are not supported, use a token or a client certificate")
+		}
+
+		api.token, api.username, api.password = u.User.Token, u.User.Username, u.User.Password
+		if u.User.TokenFile != "" {
+			token, err := ioutil.ReadFile(u.User.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading kubeconfig token file: %s", err)
+			}
+			api.token = strings.TrimSpace(string(token))
+		}
+
+		cert, err := kubeconfigData(u.User.ClientCertificateData, u.User.ClientCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("reading client certificate: %s", err)
+		}
+		key, err := kubeconfigData(u.User.ClientKeyData, u.User.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("reading client key: %s", err)
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate: %s", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	registerSecret(api.token)
+	registerSecret(api.password)
+
+	api.http = k8sHTTPClient(tlsConfig, timeout)
+	return api, nil
+}
+
+// kubeconfigData returns inline base64 data, or else the content of a file
+func kubeconfigData(data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
+
+func k8sHTTPClient(tlsConfig *tls.Config, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}
+}
+
+// runningPods lists the running pods of a namespace, or of all namespaces
+// when it is empty, optionally only those scheduled on node
+func (api *k8sAPI) runningPods(ctx context.Context, namespace, node string) (*k8sPodList, error) {
+	path := "/api/v1/pods"
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+	}
+	selector := "status.phase=Running"
+	if node != "" {
+		selector += ",spec.nodeName=" + node
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(api.server, "/")+path+"?fieldSelector="+url.QueryEscape(selector), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if api.token != "" {
+		req.Header.Set("Authorization", "Bearer "+api.token)
+	} else if api.username != "" {
+		req.SetBasicAuth(api.username, api.password)
+	}
+
+	resp, err := api.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing pods: unexpected HTTP status %s", resp.Status)
+	}
+
+	var pods k8sPodList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("decoding pod list: %s", err)
+	}
+	return &pods, nil
+}
+
+// collectionFilesIn resolves a comma separated list of collection file
+// names, such as those of an annotation that anyone who can edit a pod may
+// set, to files inside dir. Absolute paths and names that leave dir are
+// rejected
+func collectionFilesIn(dir, names string) (string, error) {
+	if dir == "" {
+		return "", errors.New("no collection_dir is set")
+	}
+	root := filepath.Clean(dir)
+	var files []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if filepath.IsAbs(name) {
+			return "", fmt.Errorf("%s is an absolute path, name a file of %s instead", name, root)
+		}
+		file := filepath.Join(root, name)
+		if name == "" || !strings.HasPrefix(file, root+string(filepath.Separator)) {
+			return "", fmt.Errorf("%q is not a file of %s", name, root)
+		}
+		for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+			if part == ".." {
+				return "", fmt.Errorf("%s must not contain ..", name)
+			}
+		}
+		files = append(files, file)
+	}
+	return strings.Join(files, ","), nil
+}
+
+// discoverKubernetes returns a target for every running pod annotated with
+// newrelic.com/jmx-port. The target connects to the pod IP and its metric
+// sets are labelled with the pod, namespace and container names
+func discoverKubernetes(kubeconfigPath, namespace, node string, timeout time.Duration) ([]*jmxTarget, error) {
+	api, err := newK8sAPI(kubeconfigPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	pods, err := api.runningPods(ctx, namespace, node)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*jmxTarget
+	for _, pod := range pods.Items {
+		annotations := pod.Metadata.Annotations
+		port, ok := annotations[k8sPortAnnotation]
+		if !ok {
+			continue
+		}
+		name := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+		if pod.Status.PodIP == "" {
+			logger.Debugf("Skipping pod %s: it has no IP yet", name)
+			continue
+		}
+
+		container := annotations[k8sContainerAnnotation]
+		if container == "" && len(pod.Spec.Containers) > 0 {
+			container = pod.Spec.Containers[0].Name
+		}
+
+		t := newDiscoveredTarget(name, pod.Status.PodIP, port)
+		t.withholdCredentials()
+		if collection := annotations[k8sCollectionAnnotation]; collection != "" {
+			files, err := collectionFilesIn(args.CollectionDir, collection)
+			if err != nil {
+				logger.Warnf("Skipping pod %s: %s annotation: %s", name, k8sCollectionAnnotation, err)
+				continue
+			}
+			t.CollectionFiles = files
+		}
+		t.Labels = map[string]string{
+			"pod":       pod.Metadata.Name,
+			"namespace": pod.Metadata.Namespace,
+			"container": container,
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
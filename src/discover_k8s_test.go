@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPodList = `{
+  "kind": "PodList",
+  "items": [
+    {
+      "metadata": {"name": "orders-7d9f", "namespace": "shop", "annotations": {"newrelic.com/jmx-port": "9999", "newrelic.com/jmx-collection": "orders.yml"}},
+      "spec": {"containers": [{"name": "orders"}, {"name": "envoy"}]},
+      "status": {"podIP": "10.1.2.3"}
+    },
+    {
+      "metadata": {"name": "billing-5c8b", "namespace": "shop", "annotations": {"newrelic.com/jmx-port": "9010", "newrelic.com/jmx-container": "app"}},
+      "spec": {"containers": [{"name": "sidecar"}, {"name": "app"}]},
+      "status": {"podIP": "10.1.2.4"}
+    },
+    {
+      "metadata": {"name": "pending-1", "namespace": "shop", "annotations": {"newrelic.com/jmx-port": "9999"}},
+      "spec": {"containers": [{"name": "app"}]},
+      "status": {}
+    },
+    {
+      "metadata": {"name": "evil-1", "namespace": "shop", "annotations": {"newrelic.com/jmx-port": "9999", "newrelic.com/jmx-collection": "../../root/.ssh/id_rsa"}},
+      "spec": {"containers": [{"name": "app"}]},
+      "status": {"podIP": "10.1.2.6"}
+    },
+    {
+      "metadata": {"name": "nginx-1", "namespace": "shop"},
+      "spec": {"containers": [{"name": "nginx"}]},
+      "status": {"podIP": "10.1.2.5"}
+    }
+  ]
+}`
+
+// fakeK8sAPI serves the pod list to requests with the expected token and
+// writes a kubeconfig that points to it
+func fakeK8sAPI(t *testing.T, dir string) (*httptest.Server, string) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer k8s-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/namespaces/shop/pods" || r.URL.Query().Get("fieldSelector") != "status.phase=Running,spec.nodeName=node-1" {
+			t.Errorf("Unexpected request %s", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, testPodList)
+	}))
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+- name: test-cluster
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+contexts:
+- name: other
+  context: {cluster: other, user: other}
+- name: test
+  context: {cluster: test-cluster, user: test-user}
+users:
+- name: test-user
+  user:
+    token: k8s-token
+`, server.URL, base64.StdEncoding.EncodeToString(ca))
+
+	path := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return server, path
+}
+
+func TestDiscoverKubernetes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nri-jmx-k8s")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	server, kubeconfigPath := fakeK8sAPI(t, dir)
+	defer server.Close()
+
+	defer withArgs(argumentList{
+		JmxUser:             "admin",
+		JmxPass:             "k8s-secret",
+		CollectionFiles:     "jvm-metrics.yml",
+		CollectionDir:       "/etc/jmx",
+		Timeout:             1000,
+		DiscoverKubernetes:  true,
+		Kubeconfig:          kubeconfigPath,
+		KubernetesNamespace: "shop",
+		KubernetesNode:      "node-1",
+	})()
+	targets, err := getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 annotated pods with an IP, got %d", len(targets))
+	}
+
+	orders, billing := targets[0], targets[1]
+	if orders.JmxHost != "10.1.2.3" || orders.JmxPort != "9999" || orders.CollectionFiles != "/etc/jmx/orders.yml" || orders.JmxUser != "admin" {
+		t.Errorf("Unexpected target %+v", orders)
+	}
+	if name := orders.entityName("java.lang"); name != "shop/orders-7d9f:java.lang" {
+		t.Errorf("Expected entities qualified with the pod, got %s", name)
+	}
+	if expected := map[string]string{"pod": "orders-7d9f", "namespace": "shop", "container": "orders"}; !reflect.DeepEqual(expected, orders.Labels) {
+		t.Errorf("Expected labels %v, got %v", expected, orders.Labels)
+	}
+	if billing.CollectionFiles != "jvm-metrics.yml" || billing.Labels["container"] != "app" {
+		t.Errorf("Unexpected target %+v", billing)
+	}
+	if orders.JmxPass != "" {
+		t.Error("Expected the password to be withheld from discovered pods")
+	}
+
+	args.DiscoverCredentials = true
+	if targets, err = getTargets(); err != nil || len(targets) != 2 || targets[0].JmxPass != "k8s-secret" {
+		t.Errorf("Expected discover_credentials to pass the password to discovered pods, got %v, %v", targets, err)
+	}
+}
+
+func TestCollectionFilesIn(t *testing.T) {
+	files, err := collectionFilesIn("/etc/jmx/", "orders.yml, kafka/topics.yml")
+	if err != nil || files != "/etc/jmx/orders.yml,/etc/jmx/kafka/topics.yml" {
+		t.Errorf("Expected files of /etc/jmx, got %s, %v", files, err)
+	}
+	for _, names := range []string{"/etc/passwd", "../secrets.yml", "kafka/../../x.yml", "orders.yml,", "."} {
+		if _, err := collectionFilesIn("/etc/jmx", names); err == nil {
+			t.Errorf("Expected %q to be rejected", names)
+		}
+	}
+}
+
+func TestKubeconfigErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nri-jmx-k8s")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	testCases := []struct {
+		config   string
+		expected string
+	}{
+		{"current-context: missing", `context "missing" not found`},
+		{"current-context: a\ncontexts: [{name: a, context: {cluster: c, user: u}}]", `cluster "c" not found`},
+		{"current-context: a\ncontexts: [{name: a, context: {cluster: c, user: u}}]\nclusters: [{name: c, cluster: {server: 'https://k8s'}}]\nusers: [{name: u, user: {exec: {command: aws}}}]", "exec and auth-provider credentials are not supported"},
+	}
+	for _, tc := range testCases {
+		path := filepath.Join(dir, "kubeconfig")
+		_ = ioutil.WriteFile(path, []byte(tc.config), 0600)
+		if _, err := newK8sAPI(path, time.Second); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected error containing %q, got %v", tc.expected, err)
+		}
+	}
+}
+
+func TestInClusterK8sAPI(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nri-jmx-k8s")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	server, _ := fakeK8sAPI(t, dir)
+	defer server.Close()
+
+	saved := k8sServiceAccountDir
+	k8sServiceAccountDir = dir
+	defer func() {
+		k8sServiceAccountDir = saved
+	}()
+	_ = ioutil.WriteFile(filepath.Join(dir, "token"), []byte("k8s-token\n"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, "ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	address := strings.TrimPrefix(server.URL, "https://")
+	host, port := address[:strings.LastIndex(address, ":")], address[strings.LastIndex(address, ":")+1:]
+	_ = os.Setenv("KUBERNETES_SERVICE_HOST", host)
+	_ = os.Setenv("KUBERNETES_SERVICE_PORT", port)
+	defer func() {
+		_ = os.Unsetenv("KUBERNETES_SERVICE_HOST")
+		_ = os.Unsetenv("KUBERNETES_SERVICE_PORT")
+	}()
+
+	defer withArgs(argumentList{CollectionDir: "/etc/jmx"})()
+	targets, err := discoverKubernetes("", "shop", "node-1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Errorf("Expected 2 targets, got %d", len(targets))
+	}
+}
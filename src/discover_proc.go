@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	jmxRemotePortProperty = "com.sun.management.jmxremote.port"
+	jmxRemoteSSLProperty  = "com.sun.management.jmxremote.ssl"
+	jmxRemoteHostProperty = "com.sun.management.jmxremote.host"
+	rmiHostnameProperty   = "java.rmi.server.hostname"
+)
+
+// javaOptionsWithValue are the java launcher options whose value is the
+// next argument, so it is not taken for the main class
+var javaOptionsWithValue = map[string]bool{
+	"-cp":                   true,
+	"-classpath":            true,
+	"--class-path":          true,
+	"-p":                    true,
+	"--module-path":         true,
+	"--upgrade-module-path": true,
+	"--add-modules":         true,
+	"--add-reads":           true,
+	"--add-exports":         true,
+	"--add-opens":           true,
+	"--limit-modules":       true,
+	"--patch-module":        true,
+}
+
+// localJVM is a Java process that exposes the JMX remote connector
+type localJVM struct {
+	pid  int
+	name string
+	host string
+	port string
+	ssl  bool
+}
+
+// discoverLocal scans the processes under procRoot for JVMs started with
+// the com.sun.management.jmxremote.port system property, and returns a
+// target for each of them
+func discoverLocal(procRoot string) ([]*jmxTarget, error) {
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %s", procRoot, err)
+	}
+
+	var jvms []*localJVM
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		// The process may have exited since the directory was listed
+		cmdline, err := ioutil.ReadFile(filepath.Join(procRoot, entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		if jvm := parseJavaCmdline(pid, cmdline); jvm != nil {
+			jvms = append(jvms, jvm)
+		}
+	}
+	sort.Slice(jvms, func(i, j int) bool { return jvms[i].pid < jvms[j].pid })
+
+	names := make(map[string]int)
+	for _, jvm := range jvms {
+		names[jvm.name]++
+	}
+
+	var targets []*jmxTarget
+	for _, jvm := range jvms {
+		name := jvm.name
+		if names[name] > 1 {
+			name = name + "-" + jvm.port
+		}
+
+		t := newDiscoveredTarget(name, jvm.host, jvm.port)
+		if jvm.ssl && !t.keyStoreSSL() && t.TLSCaFile == "" {
+			logger.Warnf("Skipping JVM %s (pid %d): its JMX connector requires SSL, but no key_store or tls_ca_file is set", name, jvm.pid)
+			continue
+		}
+		logger.Debugf("Discovered JVM %s (pid %d) on %s:%s", name, jvm.pid, jvm.host, jvm.port)
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
+
+// parseJavaCmdline returns the JMX settings of a java command line, as read
+// from /proc/<pid>/cmdline, or nil if it is not a JVM exposing JMX
+func parseJavaCmdline(pid int, cmdline []byte) *localJVM {
+	argv := strings.Split(string(bytes.TrimRight(cmdline, "\x00")), "\x00")
+	if len(argv) == 0 || path.Base(argv[0]) != "java" {
+		return nil
+	}
+
+	// Like the JVM, an SSL connector is the default
+	jvm := &localJVM{pid: pid, host: "localhost", ssl: true}
+options:
+	for i := 1; i < len(argv); i++ {
+		arg := argv[i]
+		switch {
+		case strings.HasPrefix(arg, "-D"):
+			property := strings.SplitN(arg[2:], "=", 2)
+			if len(property) != 2 {
+				continue
+			}
+			switch property[0] {
+			case jmxRemotePortProperty:
+				jvm.port = property[1]
+			case jmxRemoteSSLProperty:
+				jvm.ssl = property[1] != "false"
+			case jmxRemoteHostProperty, rmiHostnameProperty:
+				jvm.host = property[1]
+			}
+		case arg == "-jar" || arg == "-m" || arg == "--module":
+			if i+1 < len(argv) {
+				jvm.name = mainName(argv[i+1])
+			}
+			break options
+		case javaOptionsWithValue[arg]:
+			i++
+		case !strings.HasPrefix(arg, "-"):
+			jvm.name = mainName(arg)
+			break options
+		}
+	}
+
+	if jvm.port == "" {
+		return nil
+	}
+	if jvm.name == "" {
+		jvm.name = fmt.Sprintf("pid-%d", pid)
+	}
+	return jvm
+}
+
+// mainName returns the name used for a target from its main class, module
+// or jar: the class name, or the jar file name without extension
+func mainName(main string) string {
+	if strings.HasSuffix(main, ".jar") {
+		return strings.TrimSuffix(path.Base(main), ".jar")
+	}
+	// A module launch is module/class, or only the module name
+	if slash := strings.Index(main, "/"); slash >= 0 {
+		return main[slash+1:]
+	}
+	return main
+}
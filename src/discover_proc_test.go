@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFakeProc creates a proc tree with a cmdline file per pid
+func writeFakeProc(t *testing.T, cmdlines map[string][]string) string {
+	root, err := ioutil.TempDir("", "nri-jmx-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pid, argv := range cmdlines {
+		dir := filepath.Join(root, pid)
+		_ = os.Mkdir(dir, 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte(strings.Join(argv, "\x00")+"\x00"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = ioutil.WriteFile(filepath.Join(root, "uptime"), []byte("1.0 1.0"), 0644)
+	return root
+}
+
+func TestDiscoverLocal(t *testing.T) {
+	root := writeFakeProc(t, map[string][]string{
+		"100": {"/usr/lib/jvm/bin/java", "-Xmx1g", "-Dcom.sun.management.jmxremote.port=9999", "-Dcom.sun.management.jmxremote.ssl=false", "-jar", "/opt/orders/orders-1.2.jar"},
+		"200": {"java", "-cp", "lib/*", "-Dcom.sun.management.jmxremote.port=9010", "-Dcom.sun.management.jmxremote.ssl=false", "-Djava.rmi.server.hostname=10.0.0.5", "com.example.billing.Main", "--port", "80"},
+		"300": {"java", "-Dcom.sun.management.jmxremote.port=9011", "-Dcom.sun.management.jmxremote.ssl=false", "-m", "com.example.billing/com.example.billing.Main"},
+		"400": {"java", "-Dcom.sun.management.jmxremote.port=9012", "com.example.Secure"},
+		"500": {"java", "-jar", "no-jmx.jar"},
+		"600": {"/usr/bin/python3", "-Dcom.sun.management.jmxremote.port=9999"},
+	})
+	defer func() {
+		_ = os.RemoveAll(root)
+	}()
+	defer withArgs(argumentList{JmxUser: "admin", JmxPass: "admin", CollectionFiles: "jvm-metrics.yml", DiscoverLocal: true, ProcRoot: root})()
+
+	targets, err := getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	for _, target := range targets {
+		found = append(found, target.Name+"="+target.JmxHost+":"+target.JmxPort)
+		if target.CollectionFiles != "jvm-metrics.yml" || target.JmxUser != "admin" {
+			t.Errorf("Expected settings inherited from the arguments: %+v", target)
+		}
+	}
+	expected := "orders-1.2=localhost:9999 com.example.billing.Main-9010=10.0.0.5:9010 com.example.billing.Main-9011=localhost:9011"
+	if strings.Join(found, " ") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(found, " "))
+	}
+	if name := targets[0].entityName("java.lang"); name != "orders-1.2:java.lang" {
+		t.Errorf("Expected entities qualified with the JVM name, got %s", name)
+	}
+}
+
+func TestDiscoverLocalMissingRoot(t *testing.T) {
+	if _, err := discoverLocal("/nonexistent/proc"); err == nil {
+		t.Error("Expected error for a missing proc root")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+const (
+	connectionSampleType = "JMXConnectionSample"
+	// jvmEntityType is the type of the entity that holds the connection
+	// sample of a target, next to its domain entities
+	jvmEntityType = "jvm"
+)
+
+// Classes of connection errors reported in errorClass
+const (
+	errorClassAuth    = "auth"
+	errorClassTimeout = "timeout"
+	errorClassRefused = "refused"
+	errorClassTLS     = "tls"
+	errorClassDNS     = "dns"
+	errorClassConfig  = "config"
+	errorClassOther   = "other"
+)
+
+// connectionHealth describes how the connection to a target fared in a run
+type connectionHealth struct {
+	connected        bool
+	connectLatency   time.Duration
+	err              error
+	errorClass       string
+	queriesAttempted int
+	queriesFailed    int
+	queriesSkipped   int
+	queriesLate      int
+	duration         time.Duration
+}
+
+// classifyError returns the class of a connection or query error, from the
+// messages of the Go backends and of the Java exceptions relayed by nrjmx
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	message := err.Error()
+	if isAuthFailure(message) {
+		return errorClassAuth
+	}
+	lower := strings.ToLower(message)
+	contains := func(fragments ...string) bool {
+		for _, f := range fragments {
+			if strings.Contains(lower, f) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case contains("ssl", "tls", "x509", "certificate", "handshake", "non-jrmp server"):
+		return errorClassTLS
+	case contains("timeout", "timed out", "deadline exceeded"):
+		return errorClassTimeout
+	case contains("connection refused", "connectexception"):
+		return errorClassRefused
+	case contains("no such host", "unknownhostexception"):
+		return errorClassDNS
+	default:
+		return errorClassOther
+	}
+}
+
+// healthClient wraps a jmxClient to time the connection and count the
+// queries of a run
+type healthClient struct {
+	client jmxClient
+	// lazy is set for backends that only connect on their first query
+	lazy bool
+
+	opened time.Time
+	// connected is the last known state of the connection, kept when no
+	// query of a run is answered or attempted
+	connected bool
+	// answered is set once a query is answered after open
+	answered         bool
+	connectLatency   time.Duration
+	queriesAttempted int
+	queriesFailed    int
+	queriesSkipped   int
+	queriesLate      int
+	lastErr          error
+}
+
+// skipCounter is implemented by clients that count the queries skipped
+// by the circuit breaker or the collection deadline
+type skipCounter interface {
+	querySkipped()
+	queryPastDeadline()
+}
+
+func newHealthClient(client jmxClient, lazy bool) *healthClient {
+	return &healthClient{client: client, lazy: lazy}
+}
+
+func (c *healthClient) open() error {
+	c.opened, c.answered = time.Now(), false
+	if err := c.client.open(); err != nil {
+		c.connected, c.lastErr = false, err
+		return err
+	}
+	c.connected = true
+	if !c.lazy {
+		c.connectLatency = time.Since(c.opened)
+	}
+	return nil
+}
+
+func (c *healthClient) query(objectPattern string, timeout int) (map[string]interface{}, error) {
+	return c.queryAttributes(objectPattern, nil, timeout)
+}
+
+func (c *healthClient) queryAttributes(objectPattern string, attrNames []string, timeout int) (map[string]interface{}, error) {
+	result, err := queryScoped(c.client, objectPattern, attrNames, timeout)
+	c.queriesAttempted++
+	if err != nil {
+		c.queriesFailed++
+		c.lastErr = err
+	}
+	c.setAnswered(err == nil)
+	return result, err
+}
+
+func (c *healthClient) batching() bool {
+	return canBatch(c.client)
+}
+
+func (c *healthClient) queryBatch(objectPatterns []string, attrNames [][]string, timeout int) ([]map[string]interface{}, []error) {
+	results, errs := queryAll(c.client, objectPatterns, attrNames, timeout)
+	for _, err := range errs {
+		c.queriesAttempted++
+		if err != nil {
+			c.queriesFailed++
+			// Keep the error of the query that failed the batch
+			if c.lastErr == nil || !isNotAnswered(err) {
+				c.lastErr = err
+			}
+		}
+		c.setAnswered(err == nil)
+	}
+	return results, errs
+}
+
+func (c *healthClient) setDeadline(deadline time.Time) {
+	if d, ok := c.client.(deadlineClient); ok {
+		d.setDeadline(deadline)
+	}
+}
+
+func (c *healthClient) querySkipped() {
+	c.queriesSkipped++
+}
+
+func (c *healthClient) queryPastDeadline() {
+	c.queriesLate++
+}
+
+func (c *healthClient) close() {
+	c.client.close()
+}
+
+// setAnswered updates the connection state after a query. A lazy client
+// only learns whether it reached the JVM from its first queries, so the
+// connection is down while they fail, and its latency is the time to the
+// first answer
+func (c *healthClient) setAnswered(answered bool) {
+	if !answered {
+		if c.lazy && !c.answered {
+			c.connected = false
+		}
+		return
+	}
+	if c.lazy && !c.answered {
+		c.connectLatency = time.Since(c.opened)
+	}
+	c.connected, c.answered = true, true
+}
+
+// reset clears the counts of the previous run of a client kept open
+// between runs. The connection state and latency are kept
+func (c *healthClient) reset() {
+	c.queriesAttempted, c.queriesFailed, c.queriesSkipped, c.queriesLate, c.lastErr = 0, 0, 0, 0, nil
+}
+
+// health returns the outcome of the run. The error is the last one seen,
+// and may come from a query even when the connection was established
+func (c *healthClient) health() *connectionHealth {
+	return &connectionHealth{
+		connected:        c.connected,
+		connectLatency:   c.connectLatency,
+		err:              c.lastErr,
+		errorClass:       classifyError(c.lastErr),
+		queriesAttempted: c.queriesAttempted,
+		queriesFailed:    c.queriesFailed,
+		queriesSkipped:   c.queriesSkipped,
+		queriesLate:      c.queriesLate,
+	}
+}
+
+// recordHealth adds the JMXConnectionSample of a target to its jvm entity.
+// It is reported on every run, so that an unreachable JVM can be told apart
+// from one that reports no data
+func recordHealth(target *jmxTarget, health *connectionHealth, i *integration.Integration) error {
+	e, err := i.Entity(target.String(), jvmEntityType)
+	if err != nil {
+		return err
+	}
+
+	attributes := []metric.Attribute{
+		{Key: "entityName", Value: jvmEntityType + ":" + e.Metadata.Name},
+		{Key: "displayName", Value: e.Metadata.Name},
+		{Key: "host", Value: target.JmxHost},
+		{Key: "port", Value: target.JmxPort},
+		{Key: "backend", Value: backendName(target)},
+	}
+	for key, val := range target.Labels {
+		attributes = append(attributes, metric.Attribute{Key: "label." + key, Value: val})
+	}
+	ms := e.NewMetricSet(connectionSampleType, attributes...)
+
+	connected := 0
+	if health.connected {
+		connected = 1
+	}
+	metrics := []struct {
+		name       string
+		value      interface{}
+		sourceType metric.SourceType
+	}{
+		{"connected", connected, metric.GAUGE},
+		{"connectLatencyMs", durationMs(health.connectLatency), metric.GAUGE},
+		{"queriesAttempted", health.queriesAttempted, metric.GAUGE},
+		{"queriesFailed", health.queriesFailed, metric.GAUGE},
+		{"skippedQueries", health.queriesSkipped, metric.GAUGE},
+		{"deadlineSkippedQueries", health.queriesLate, metric.GAUGE},
+		{"collectionDurationMs", durationMs(health.duration), metric.GAUGE},
+	}
+	for _, m := range metrics {
+		if err := ms.SetMetric(m.name, m.value, m.sourceType); err != nil {
+			return err
+		}
+	}
+
+	if health.err == nil {
+		return nil
+	}
+	if err := ms.SetMetric("errorClass", health.errorClass, metric.ATTRIBUTE); err != nil {
+		return err
+	}
+	return ms.SetMetric("error", redact(health.err.Error()), metric.ATTRIBUTE)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected string
+	}{
+		{nil, ""},
+		{errors.New("nrjmx exited with error: exit status 1 (java.lang.SecurityException: Authentication failed! Invalid username or password)"), errorClassAuth},
+		{errors.New("connecting to Jolokia agent: unexpected HTTP status 401 Unauthorized"), errorClassAuth},
+		{errors.New("timeout while waiting for query: java.lang:type=Memory"), errorClassTimeout},
+		{errors.New("dial tcp 127.0.0.1:9999: i/o timeout"), errorClassTimeout},
+		{errors.New("dial tcp 127.0.0.1:9999: connect: connection refused"), errorClassRefused},
+		{errors.New("java.rmi.ConnectException: Connection refused to host: 10.0.0.1"), errorClassRefused},
+		{errors.New("javax.net.ssl.SSLHandshakeException: PKIX path building failed"), errorClassTLS},
+		{errors.New("x509: certificate signed by unknown authority"), errorClassTLS},
+		{errors.New("dial tcp: lookup jvm.invalid: no such host"), errorClassDNS},
+		{errors.New("invalid return value for query"), errorClassOther},
+	}
+	for _, tc := range testCases {
+		if class := classifyError(tc.err); class != tc.expected {
+			t.Errorf("Expected class %q for %v, got %q", tc.expected, tc.err, class)
+		}
+	}
+}
+
+func TestHealthClient(t *testing.T) {
+	queries := 0
+	client := newHealthClient(&fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		queries++
+		if queries == 1 {
+			return nil, errors.New("timeout while waiting for query: " + name)
+		}
+		return map[string]interface{}{}, nil
+	}}, true)
+
+	if err := client.open(); err != nil {
+		t.Fatal(err)
+	}
+	if h := client.health(); !h.connected || h.connectLatency != 0 {
+		t.Errorf("Expected a lazy client to be connected once opened, until its first query, got %+v", h)
+	}
+	_, _ = client.query("java.lang:type=Memory", 1000)
+	if h := client.health(); h.connected {
+		t.Error("Expected a lazy client whose first query failed not to be connected")
+	}
+	_, _ = client.query("java.lang:type=Threading", 1000)
+
+	h := client.health()
+	if !h.connected || h.connectLatency == 0 || h.queriesAttempted != 2 || h.queriesFailed != 1 || h.errorClass != errorClassTimeout {
+		t.Errorf("Unexpected health %+v", h)
+	}
+
+	// A run whose queries are all skipped keeps the last known state
+	client.reset()
+	client.querySkipped()
+	if h := client.health(); !h.connected || h.queriesAttempted != 0 || h.queriesSkipped != 1 {
+		t.Errorf("Expected the connection state to be kept, got %+v", h)
+	}
+}
+
+func TestCollectTargetsHealth(t *testing.T) {
+	server := fakeJolokia(t, nil, nil)
+	defer server.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + listener.Addr().String() + "/jolokia"
+	_ = listener.Close()
+
+	defer withArgs(argumentList{Timeout: 1000, Concurrency: 2, MetricLimit: 1})()
+	i, _ := integration.New("jmxtest", "0.1.0")
+	targets := []*jmxTarget{
+		{Name: "up", JmxBackend: "jolokia", JolokiaURL: server.URL, CollectionFiles: "../test/infra-good.yml"},
+		{Name: "down", JmxBackend: "jolokia", JolokiaURL: refused, CollectionFiles: "../test/infra-good.yml", Labels: map[string]string{"env": "test"}},
+		{Name: "misconfigured", JmxBackend: "jolokia"},
+	}
+	if err := collectTargets(targets, i, nil); err == nil {
+		t.Error("Expected the connection error to be returned")
+	}
+
+	entities := checkMetricLimit(i.Entities)
+	samples := make(map[string]map[string]interface{})
+	for _, e := range entities {
+		if e.Metadata.Namespace != jvmEntityType {
+			continue
+		}
+		if len(e.Metrics) != 1 || e.Metrics[0].Metrics["event_type"] != connectionSampleType {
+			t.Fatalf("Expected a single %s on %s", connectionSampleType, e.Metadata.Name)
+		}
+		samples[e.Metadata.Name] = e.Metrics[0].Metrics
+	}
+	if len(samples) != 3 {
+		t.Fatalf("Expected a connection sample for every target despite the metric limit, got %v", samples)
+	}
+
+	up := samples["up"]
+	// Gauges are stored as float64
+	if up["connected"] != 1.0 || up["queriesFailed"] != 0.0 || up["queriesAttempted"] == 0.0 || up["errorClass"] != nil {
+		t.Errorf("Unexpected sample for the reachable target %v", up)
+	}
+	down := samples["down"]
+	if down["connected"] != 0.0 || down["errorClass"] != errorClassRefused || down["queriesAttempted"] != 0.0 || down["label.env"] != "test" {
+		t.Errorf("Unexpected sample for the unreachable target %v", down)
+	}
+	if class := samples["misconfigured"]["errorClass"]; class != errorClassConfig {
+		t.Errorf("Expected a config error class, got %v", class)
+	}
+}
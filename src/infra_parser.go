@@ -1,12 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 
 	"github.com/newrelic/infra-integrations-sdk/data/metric"
-	"github.com/newrelic/infra-integrations-sdk/log"
-	"gopkg.in/yaml.v2"
 )
 
 type infraJmxParser struct {
@@ -15,15 +14,13 @@ type infraJmxParser struct {
 func (p infraJmxParser) parse(f []byte) ([]*domainDefinition, error) {
 	collectionDefinition, err := parseYaml(f)
 	if err != nil {
-		log.Error("Failed to parse configuration file %s: %s", f, err)
 		return nil, err
 	}
 
 	// Validate the definition and create a domainDefinition object
 	domainDefinition, err := parseCollectionDefinition(collectionDefinition)
 	if err != nil {
-		log.Error("Failed to parse domainDefinition definition %s: %s", f, err)
-		return nil, err
+		return nil, locateErrors(f, err)
 	}
 
 	return domainDefinition, nil
@@ -47,6 +44,7 @@ type collectionDefinition struct {
 	Collect []struct {
 		Domain    string           `yaml:"domain"`
 		EventType string           `yaml:"event_type"`
+		Interval  string           `yaml:"interval"`
 		Beans     []beanDefinition `yaml:"beans"`
 	}
 }
@@ -56,7 +54,51 @@ type collectionDefinition struct {
 type beanDefinition struct {
 	Query      string        `yaml:"query"`
 	Exclude    interface{}   `yaml:"exclude_regex"`
-	Attributes []interface{} `yaml:"attributes"`
+	Attributes attributeList `yaml:"attributes"`
+	Interval   string        `yaml:"interval"`
+	Priority   int           `yaml:"priority"`
+}
+
+// attributeList is the attributes of a bean, each either an attribute name
+// or a map with the keys of attributeKeys
+type attributeList []interface{}
+
+// attributeKeys are the keys of an attribute given as a map
+type attributeKeys struct {
+	Attr       string `yaml:"attr"`
+	AttrRegex  string `yaml:"attr_regex"`
+	MetricType string `yaml:"metric_type"`
+	MetricName string `yaml:"metric_name"`
+}
+
+// attributeEntry decodes an entry of an attributeList, checking the keys of
+// maps against attributeKeys
+type attributeEntry struct {
+	value interface{}
+}
+
+func (l *attributeList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var entries []attributeEntry
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+	*l = make(attributeList, len(entries))
+	for n, entry := range entries {
+		(*l)[n] = entry.value
+	}
+	return nil
+}
+
+func (e *attributeEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&e.value); err != nil {
+		return err
+	}
+	if _, ok := e.value.(map[interface{}]interface{}); !ok {
+		return nil
+	}
+	// The map is kept as is, and decoded again only to check its keys
+	var keys attributeKeys
+	return unmarshal(&keys)
 }
 
 var (
@@ -70,11 +112,10 @@ var (
 )
 
 // parseYaml reads a yaml file and parses it into a collectionDefinition.
-// It validates syntax only and not content
+// It validates syntax and keys only and not content
 func parseYaml(f []byte) (*collectionDefinition, error) {
 	var c collectionDefinition
-	if err := yaml.Unmarshal(f, &c); err != nil {
-		log.Error("failed to parse collection: %s", err)
+	if err := decodeStrict(f, &c); err != nil {
 		return nil, err
 	}
 
@@ -85,11 +126,17 @@ func parseYaml(f []byte) (*collectionDefinition, error) {
 // an array of domains containing the validated configuration
 func parseCollectionDefinition(c *collectionDefinition) ([]*domainDefinition, error) {
 
-	var err error
-
 	// For each domain in the collection
 	var collections []*domainDefinition
 	for _, domain := range c.Collect {
+		if domain.Domain == "" {
+			return nil, errors.New("every entry of collect needs a domain")
+		}
+
+		domainInterval, err := parseInterval(domain.Interval)
+		if err != nil {
+			return nil, atValue(domain.Interval, "domain %s: %s", domain.Domain, err)
+		}
 
 		// For each bean in the domain
 		var beans []*beanRequest
@@ -101,6 +148,10 @@ func parseCollectionDefinition(c *collectionDefinition) ([]*domainDefinition, er
 			if err != nil {
 				return nil, err
 			}
+			// Beans without their own interval take the domain's
+			if bean.Interval == "" {
+				newBean.interval = domainInterval
+			}
 
 			beans = append(beans, newBean)
 		}
@@ -127,6 +178,11 @@ func parseBean(bean *beanDefinition) (*beanRequest, error) {
 		return nil, err
 	}
 
+	interval, err := parseInterval(bean.Interval)
+	if err != nil {
+		return nil, atValue(bean.Interval, "bean %s: %s", bean.Query, err)
+	}
+
 	// Parse the exclude patterns
 	var excludePatterns []*regexp.Regexp
 	if bean.Exclude != nil {
@@ -135,7 +191,7 @@ func parseBean(bean *beanDefinition) (*beanRequest, error) {
 		case string:
 			r, err := regexp.Compile(b)
 			if err != nil {
-				return nil, fmt.Errorf("invalid regex pattern %s", b)
+				return nil, atValue(b, "invalid exclude_regex pattern %s: %s", b, err)
 			}
 			excludePatterns = append(excludePatterns, r)
 		// If exclude_regex is an array of strings
@@ -143,11 +199,13 @@ func parseBean(bean *beanDefinition) (*beanRequest, error) {
 			for _, excludeString := range b {
 				switch e := excludeString.(type) {
 				case string:
-					// Panic if can't compile the regex pattern
-					r := regexp.MustCompile(e)
+					r, err := regexp.Compile(e)
+					if err != nil {
+						return nil, atValue(e, "invalid exclude_regex pattern %s: %s", e, err)
+					}
 					excludePatterns = append(excludePatterns, r)
 				default:
-					return nil, fmt.Errorf("invalid exclude pattern '%v'", e)
+					return nil, atValue(fmt.Sprint(e), "invalid exclude pattern '%v'", e)
 				}
 			}
 		default:
@@ -156,7 +214,7 @@ func parseBean(bean *beanDefinition) (*beanRequest, error) {
 		}
 	}
 
-	return &beanRequest{beanQuery: bean.Query, exclude: excludePatterns, attributes: attributes}, nil
+	return &beanRequest{beanQuery: bean.Query, exclude: excludePatterns, attributes: attributes, interval: interval, priority: bean.Priority}, nil
 }
 
 func parseAttributes(rawAttributes []interface{}) ([]*attributeRequest, error) {
@@ -202,14 +260,33 @@ func parseAttributeFromString(a string) (*attributeRequest, error) {
 		return nil, fmt.Errorf("failed to create regex pattern from attribute name %s", a)
 	}
 
-	return &attributeRequest{attrRegexp: attrRegexp, metricType: -1}, nil
+	return &attributeRequest{attrRegexp: attrRegexp, attrName: a, metricType: -1}, nil
+}
+
+// stringKey returns the value of key in an attribute map, and whether it
+// is set. Values that are not strings are an error
+func stringKey(a map[interface{}]interface{}, key string) (string, bool, error) {
+	value := a[key]
+	if value == nil {
+		return "", false, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", true, fmt.Errorf("%s must be a string, got '%v'", key, value)
+	}
+	return s, true, nil
 }
 
 func parseAttributeFromMap(a map[interface{}]interface{}) (*attributeRequest, error) {
-	attrName, namePresent := a["attr"]
-	attrRegexpString, regexPresent := a["attr_regex"]
+	attrName, namePresent, err := stringKey(a, "attr")
+	if err != nil {
+		return nil, err
+	}
+	attrRegexpString, regexPresent, err := stringKey(a, "attr_regex")
+	if err != nil {
+		return nil, err
+	}
 	var attrRegexp *regexp.Regexp
-	var err error
 
 	// Must specify exactly one attribute selector
 	if namePresent == regexPresent {
@@ -217,14 +294,14 @@ func parseAttributeFromMap(a map[interface{}]interface{}) (*attributeRequest, er
 	}
 
 	if regexPresent {
-		attrRegexp, err = createAttributeRegex(attrRegexpString.(string), false)
+		attrRegexp, err = createAttributeRegex(attrRegexpString, false)
 		if err != nil {
-			return nil, fmt.Errorf("failed to compile attribute regex pattern %s", attrRegexpString)
+			return nil, atValue(attrRegexpString, "failed to compile attribute regex pattern %s: %s", attrRegexpString, err)
 		}
 	} else {
-		attrRegexp, err = createAttributeRegex(attrName.(string), true)
+		attrRegexp, err = createAttributeRegex(attrName, true)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create regex pattern from attribute name %s", attrName.(string))
+			return nil, fmt.Errorf("failed to create regex pattern from attribute name %s", attrName)
 		}
 	}
 
@@ -238,26 +315,33 @@ func parseAttributeFromMap(a map[interface{}]interface{}) (*attributeRequest, er
 		attrRegexp: attrRegexp,
 		metricType: metricType,
 	}
+	if namePresent {
+		newAttribute.attrName = attrName
+	}
 
 	// Parse the metric name
-	metricName, _ := a["metric_name"]
-	if metricName != nil {
-		newAttribute.metricName = metricName.(string)
+	metricName, _, err := stringKey(a, "metric_name")
+	if err != nil {
+		return nil, err
 	}
+	newAttribute.metricName = metricName
 
 	return newAttribute, nil
 
 }
 
 func getMetricType(a map[interface{}]interface{}) (metric.SourceType, error) {
-	metricTypeString, ok := a["metric_type"]
+	metricTypeString, ok, err := stringKey(a, "metric_type")
+	if err != nil {
+		return 0, err
+	}
 	var metricType metric.SourceType
 	if !ok {
 		metricType = -1 // Since metric type can't be nil, using -1 as a placeholder
 	} else {
-		mt, ok := metricTypes[metricTypeString.(string)]
+		mt, ok := metricTypes[metricTypeString]
 		if !ok {
-			return 0, fmt.Errorf("invalid metric type %s", metricTypeString.(string))
+			return 0, atValue(metricTypeString, "invalid metric type %s, use gauge, delta, attribute or rate", metricTypeString)
 		}
 		metricType = mt
 	}
@@ -55,8 +55,8 @@ func TestParseAttributeFromString(t *testing.T) {
 		output        *attributeRequest
 		expectedError bool
 	}{
-		{"Testattribute", &attributeRequest{attrRegexp: regexp.MustCompile("attr=Testattribute$")}, false},
-		{`weird.string([)]`, &attributeRequest{attrRegexp: regexp.MustCompile(`attr=weird\.string\(\[\)\]$`)}, false},
+		{"Testattribute", &attributeRequest{attrRegexp: regexp.MustCompile("attr=Testattribute$"), attrName: "Testattribute", metricType: -1}, false},
+		{`weird.string([)]`, &attributeRequest{attrRegexp: regexp.MustCompile(`attr=weird\.string\(\[\)\]$`), attrName: `weird.string([)]`, metricType: -1}, false},
 	}
 
 	for _, tc := range testCases {
@@ -75,17 +75,17 @@ func TestParseAttributeFromMap(t *testing.T) {
 	}{
 		{
 			map[interface{}]interface{}{"attr": "testattr", "metric_type": "gauge", "metric_name": "testmetricname"},
-			&attributeRequest{attrRegexp: regexp.MustCompile("attr=testattr$"), metricName: "testmetricname", metricType: metric.GAUGE},
+			&attributeRequest{attrRegexp: regexp.MustCompile("attr=testattr$"), attrName: "testattr", metricName: "testmetricname", metricType: metric.GAUGE},
 			false,
 		},
 		{
 			map[interface{}]interface{}{"attr": "testattr", "metric_name": "testmetricname"},
-			&attributeRequest{attrRegexp: regexp.MustCompile("attr=testattr$"), metricName: "testmetricname", metricType: -1},
+			&attributeRequest{attrRegexp: regexp.MustCompile("attr=testattr$"), attrName: "testattr", metricName: "testmetricname", metricType: -1},
 			false,
 		},
 		{
 			map[interface{}]interface{}{"attr": "testattr"},
-			&attributeRequest{attrRegexp: regexp.MustCompile("attr=testattr$"), metricType: -1},
+			&attributeRequest{attrRegexp: regexp.MustCompile("attr=testattr$"), attrName: "testattr", metricType: -1},
 			false,
 		},
 		{
@@ -183,6 +183,7 @@ func TestParseBean(t *testing.T) {
 				attributes: []*attributeRequest{
 					{
 						attrRegexp: regexp.MustCompile("attr=testattr$"),
+						attrName:   "testattr",
 						metricType: -1,
 					},
 				},
@@ -208,6 +209,7 @@ func TestParseBean(t *testing.T) {
 				attributes: []*attributeRequest{
 					{
 						attrRegexp: regexp.MustCompile("attr=testattr$"),
+						attrName:   "testattr",
 						metricType: metric.GAUGE,
 					},
 				},
@@ -232,6 +234,35 @@ func TestParseBean(t *testing.T) {
 	}
 }
 
+func TestAttributeNames(t *testing.T) {
+	file := []byte(`collect:
+  - domain: java.lang
+    beans:
+      - query: type=Memory
+        attributes:
+          - HeapMemoryUsage.Used
+          - HeapMemoryUsage.Committed
+          - attr: ObjectPendingFinalizationCount
+            metric_type: gauge
+      - query: type=Threading
+        attributes:
+          - ThreadCount
+          - attr_regex: Peak.*
+      - query: type=Runtime
+`)
+	domains, err := infraJmxParser{}.parse(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{{"HeapMemoryUsage.Used", "HeapMemoryUsage", "HeapMemoryUsage.Committed", "ObjectPendingFinalizationCount"}, nil, nil}
+	for n, bean := range domains[0].beans {
+		if names := bean.attributeNames(); !reflect.DeepEqual(expected[n], names) {
+			t.Errorf("Expected attributes %v for %s, got %v", expected[n], bean.beanQuery, names)
+		}
+	}
+}
+
 func TestParseCollectionDefinition(t *testing.T) {
 	expectedDomains := []*domainDefinition{
 		{
@@ -246,6 +277,7 @@ func TestParseCollectionDefinition(t *testing.T) {
 					attributes: []*attributeRequest{
 						{
 							attrRegexp: regexp.MustCompile(`attr=test\.test$`),
+							attrName:   "test.test",
 							metricName: "t.test",
 							metricType: metric.RATE,
 						},
@@ -296,9 +328,9 @@ func TestParseCollectionDefinition(t *testing.T) {
 func TestParseCollectionDefinition_Fail(t *testing.T) {
 
 	file, err := ioutil.ReadFile("../test/infra-bad2.yml")
-	c, err := parseYaml(file)
-	_, err = parseCollectionDefinition(c)
-	if err == nil {
-		t.Error("Expected error")
+	_, err = parseYaml(file)
+	expected := `line 2, column 7: unknown key "doman", did you mean "domain"?; line 8, column 19: unknown key "atr", did you mean "attr"?`
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %s, got %v", expected, err)
 	}
 }
@@ -1,13 +1,10 @@
 package main
 
 import (
-	"os"
 	"regexp"
 	"strings"
 
 	"github.com/newrelic/infra-integrations-sdk/data/metric"
-	"github.com/newrelic/infra-integrations-sdk/log"
-	"gopkg.in/yaml.v2"
 )
 
 type javaAgentJmxParser struct {
@@ -20,7 +17,6 @@ func init() {
 func (p javaAgentJmxParser) parse(f []byte) ([]*domainDefinition, error) {
 	javaAgentConfig, err := p.parseJavaAgentYaml(f)
 	if err != nil {
-		log.Error("Failed to parse collection definition file %s: %s", f, err)
 		return nil, err
 	}
 
@@ -43,8 +39,7 @@ func (p javaAgentJmxParser) parse(f []byte) ([]*domainDefinition, error) {
 	// Validate the definition and create a collection object
 	newCollection, err := p.normalizeJmxDefinition(javaAgentConfig)
 	if err != nil {
-		log.Error("Failed to parse collection definition %s: %s", f, err)
-		os.Exit(1)
+		return nil, locateErrors(f, err)
 	}
 
 	return newCollection, nil
@@ -121,8 +116,7 @@ type metricDefinition struct {
 
 func (p javaAgentJmxParser) parseJavaAgentYaml(f []byte) (*javaAgentJmxConfig, error) {
 	var m javaAgentJmxConfig
-	if err := yaml.Unmarshal(f, &m); err != nil {
-		log.Error("failed to parse collection: %s", err)
+	if err := decodeStrict(f, &m); err != nil {
 		return nil, err
 	}
 	return &m, nil
@@ -133,7 +127,10 @@ func (p javaAgentJmxParser) normalizeJmxDefinition(m *javaAgentJmxConfig) ([]*do
 	var domains []*domainDefinition
 
 	for _, jmxObject := range m.JMX {
-		var domainAndQuery = strings.Split(jmxObject.ObjectName, ":")
+		var domainAndQuery = strings.SplitN(jmxObject.ObjectName, ":", 2)
+		if len(domainAndQuery) != 2 {
+			return nil, atValue(jmxObject.ObjectName, "object_name %s is not a domain:query ObjectName", jmxObject.ObjectName)
+		}
 		var outbeans []*beanRequest
 		for _, thisMetric := range jmxObject.Metrics {
 			var inAttrs = strings.Split(thisMetric.Attributes, ",")
@@ -144,7 +141,7 @@ func (p javaAgentJmxParser) normalizeJmxDefinition(m *javaAgentJmxConfig) ([]*do
 				if err != nil {
 					continue
 				}
-				outAttrs = append(outAttrs, &attributeRequest{attrRegexp: regex, metricType: p.convertMetricType(thisMetric.Type), metricName: p.getMetricName(thisAttr, jmxObject.RootMetricName, domainAndQuery[1])})
+				outAttrs = append(outAttrs, &attributeRequest{attrRegexp: regex, attrName: thisAttr, metricType: p.convertMetricType(thisMetric.Type), metricName: p.getMetricName(thisAttr, jmxObject.RootMetricName, domainAndQuery[1])})
 			}
 			outbeans = append(outbeans, &beanRequest{beanQuery: domainAndQuery[1], attributes: outAttrs})
 		}
@@ -250,8 +247,10 @@ func (p javaAgentJmxParser) getMetricName(attrName string, rootMetricName string
 		var queryStrings = strings.Split(query, ",")
 		queryMap := make(map[string]string)
 		for _, thisQuery := range queryStrings {
-			var querySplit = strings.Split(thisQuery, "=")
-			queryMap[querySplit[0]] = querySplit[1]
+			var querySplit = strings.SplitN(thisQuery, "=", 2)
+			if len(querySplit) == 2 {
+				queryMap[querySplit[0]] = querySplit[1]
+			}
 		}
 		var matchedObjs = objNameRegex.FindAllString(rootMetricName, -1)
 		for _, thisObj := range matchedObjs {
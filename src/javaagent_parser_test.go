@@ -118,6 +118,7 @@ func TestJavaAgentParserNormalizeJmxDefinition(t *testing.T) {
 					attributes: []*attributeRequest{
 						{
 							attrRegexp: regexp.MustCompile("attr=AllocateCount$"),
+							attrName:   "AllocateCount",
 							metricName: "AllocateCount",
 							metricType: 0,
 						},
@@ -134,11 +135,13 @@ func TestJavaAgentParserNormalizeJmxDefinition(t *testing.T) {
 					attributes: []*attributeRequest{
 						{
 							attrRegexp: regexp.MustCompile("attr=ConcurrentRequestCount$"),
+							attrName:   "ConcurrentRequestCount",
 							metricName: "ConcurrentRequestCount",
 							metricType: 0,
 						},
 						{
 							attrRegexp: regexp.MustCompile("attr=LookupTime$"),
+							attrName:   "LookupTime",
 							metricName: "LookupTime",
 							metricType: 0,
 						},
@@ -155,11 +158,13 @@ func TestJavaAgentParserNormalizeJmxDefinition(t *testing.T) {
 					attributes: []*attributeRequest{
 						{
 							attrRegexp: regexp.MustCompile("attr=ClientRequestCount$"),
+							attrName:   "ClientRequestCount",
 							metricName: "ClientRequestCount",
 							metricType: 0,
 						},
 						{
 							attrRegexp: regexp.MustCompile("attr=DependencyIDBasedInvalidationsFromDisk$"),
+							attrName:   "DependencyIDBasedInvalidationsFromDisk",
 							metricName: "DependencyIDBasedInvalidationsFromDisk",
 							metricType: 0,
 						},
@@ -0,0 +1,823 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"unicode/utf16"
+)
+
+// Constants from the Java Object Serialization Stream Protocol
+const (
+	javaStreamMagic   = 0xaced
+	javaStreamVersion = 5
+
+	tcNull           = 0x70
+	tcReference      = 0x71
+	tcClassDesc      = 0x72
+	tcObject         = 0x73
+	tcString         = 0x74
+	tcArray          = 0x75
+	tcClass          = 0x76
+	tcBlockData      = 0x77
+	tcEndBlockData   = 0x78
+	tcReset          = 0x79
+	tcBlockDataLong  = 0x7a
+	tcException      = 0x7b
+	tcLongString     = 0x7c
+	tcProxyClassDesc = 0x7d
+	tcEnum           = 0x7e
+
+	javaBaseWireHandle = 0x7e0000
+
+	// maxJavaDataLength caps the length of the blocks, strings and arrays
+	// read from a server, so a corrupt or hostile stream can't exhaust memory
+	maxJavaDataLength = 16 << 20
+
+	scWriteMethod    = 0x01
+	scSerializable   = 0x02
+	scExternalizable = 0x04
+	scBlockData      = 0x08
+)
+
+// javaClass is a decoded class descriptor
+type javaClass struct {
+	name   string
+	suid   int64
+	flags  byte
+	fields []javaField
+	super  *javaClass
+	// proxyInterfaces is only set for dynamic proxy classes
+	proxyInterfaces []string
+}
+
+// javaField is a serializable field of a class descriptor. className
+// is only set for object and array fields
+type javaField struct {
+	typeCode  byte
+	name      string
+	className string
+}
+
+// javaObject is a decoded instance of a serializable class. Fields of
+// every class in the hierarchy are merged into fields, and the data written
+// by custom writeObject methods is kept in annotations, keyed by the name of
+// the class that wrote it
+type javaObject struct {
+	class       *javaClass
+	fields      map[string]interface{}
+	annotations map[string][]interface{}
+}
+
+// javaArray is a decoded array of primitives or objects
+type javaArray struct {
+	class  *javaClass
+	values []interface{}
+}
+
+// javaEnum is a decoded enum constant
+type javaEnum struct {
+	class    *javaClass
+	constant string
+}
+
+// javaException is a Throwable written to the stream in place of the
+// expected contents, either by TC_EXCEPTION or by an exceptional RMI return
+type javaException struct {
+	throwable interface{}
+}
+
+func (e *javaException) Error() string {
+	obj, ok := e.throwable.(*javaObject)
+	if !ok {
+		return "unknown java exception"
+	}
+	if message, ok := obj.fields["detailMessage"].(string); ok {
+		return fmt.Sprintf("%s: %s", obj.class.name, message)
+	}
+	return obj.class.name
+}
+
+// isA reports whether the thrown object is of the given class or one of
+// its subclasses
+func (e *javaException) isA(name string) bool {
+	obj, ok := e.throwable.(*javaObject)
+	return ok && obj.class.isA(name)
+}
+
+// hierarchy returns the class and its superclasses, topmost superclass first
+func (c *javaClass) hierarchy() []*javaClass {
+	var classes []*javaClass
+	for class := c; class != nil; class = class.super {
+		classes = append([]*javaClass{class}, classes...)
+	}
+	return classes
+}
+
+// isA reports whether the class or any of its superclasses has the given name
+func (c *javaClass) isA(name string) bool {
+	for class := c; class != nil; class = class.super {
+		if class.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// javaReader decodes a Java serialization stream
+type javaReader struct {
+	r       io.Reader
+	handles []interface{}
+}
+
+func newJavaReader(r io.Reader) (*javaReader, error) {
+	jr := &javaReader{r: r}
+
+	var header struct {
+		Magic   uint16
+		Version uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != javaStreamMagic || header.Version != javaStreamVersion {
+		return nil, fmt.Errorf("invalid java serialization header %x%x", header.Magic, header.Version)
+	}
+
+	return jr, nil
+}
+
+func (jr *javaReader) readByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(jr.r, b[:])
+	return b[0], err
+}
+
+func (jr *javaReader) readPrimitive(v interface{}) error {
+	return binary.Read(jr.r, binary.BigEndian, v)
+}
+
+func (jr *javaReader) readUTF() (string, error) {
+	var length uint16
+	if err := jr.readPrimitive(&length); err != nil {
+		return "", err
+	}
+	return jr.readModifiedUTF8(int64(length))
+}
+
+func (jr *javaReader) readModifiedUTF8(length int64) (string, error) {
+	b, err := jr.readBytes(length)
+	if err != nil {
+		return "", err
+	}
+	return decodeModifiedUTF8(b)
+}
+
+// readBytes reads length bytes, growing the buffer as they arrive rather
+// than trusting the length sent by the server
+func (jr *javaReader) readBytes(length int64) ([]byte, error) {
+	if length < 0 || length > maxJavaDataLength {
+		return nil, fmt.Errorf("invalid java serialization length %d", length)
+	}
+	var b bytes.Buffer
+	n, err := io.CopyN(&b, jr.r, length)
+	if err == io.EOF && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	return b.Bytes(), err
+}
+
+func (jr *javaReader) newHandle(v interface{}) {
+	jr.handles = append(jr.handles, v)
+}
+
+// readContent reads the next item of the stream, which is either a block
+// of primitive data, returned as []byte, or an object
+func (jr *javaReader) readContent() (interface{}, error) {
+	tc, err := jr.readByte()
+	if err != nil {
+		return nil, err
+	}
+	return jr.readContentWithCode(tc)
+}
+
+func (jr *javaReader) readContentWithCode(tc byte) (interface{}, error) {
+	switch tc {
+	case tcBlockData:
+		length, err := jr.readByte()
+		if err != nil {
+			return nil, err
+		}
+		return jr.readBlock(int64(length))
+	case tcBlockDataLong:
+		var length int32
+		if err := jr.readPrimitive(&length); err != nil {
+			return nil, err
+		}
+		return jr.readBlock(int64(length))
+	default:
+		return jr.readObjectWithCode(tc)
+	}
+}
+
+func (jr *javaReader) readBlock(length int64) ([]byte, error) {
+	return jr.readBytes(length)
+}
+
+// readObject reads the next object of the stream
+func (jr *javaReader) readObject() (interface{}, error) {
+	tc, err := jr.readByte()
+	if err != nil {
+		return nil, err
+	}
+	return jr.readObjectWithCode(tc)
+}
+
+func (jr *javaReader) readObjectWithCode(tc byte) (interface{}, error) {
+	switch tc {
+	case tcNull:
+		return nil, nil
+	case tcReference:
+		var handle int32
+		if err := jr.readPrimitive(&handle); err != nil {
+			return nil, err
+		}
+		index := int(handle) - javaBaseWireHandle
+		if index < 0 || index >= len(jr.handles) {
+			return nil, fmt.Errorf("invalid java serialization handle %x", handle)
+		}
+		return jr.handles[index], nil
+	case tcString:
+		s, err := jr.readUTF()
+		if err != nil {
+			return nil, err
+		}
+		jr.newHandle(s)
+		return s, nil
+	case tcLongString:
+		var length int64
+		if err := jr.readPrimitive(&length); err != nil {
+			return nil, err
+		}
+		s, err := jr.readModifiedUTF8(length)
+		if err != nil {
+			return nil, err
+		}
+		jr.newHandle(s)
+		return s, nil
+	case tcClassDesc, tcProxyClassDesc:
+		return jr.readClassDescWithCode(tc)
+	case tcClass:
+		class, err := jr.readClassDesc()
+		if err != nil {
+			return nil, err
+		}
+		jr.newHandle(class)
+		return class, nil
+	case tcObject:
+		return jr.readNewObject()
+	case tcArray:
+		return jr.readNewArray()
+	case tcEnum:
+		class, err := jr.readClassDesc()
+		if err != nil {
+			return nil, err
+		}
+		enum := &javaEnum{class: class}
+		jr.newHandle(enum)
+		constant, err := jr.readObject()
+		if err != nil {
+			return nil, err
+		}
+		if enum.constant, _ = constant.(string); enum.constant == "" {
+			return nil, errors.New("invalid enum constant name")
+		}
+		return enum, nil
+	case tcReset:
+		jr.handles = nil
+		return jr.readObject()
+	case tcException:
+		jr.handles = nil
+		throwable, err := jr.readObject()
+		if err != nil {
+			return nil, err
+		}
+		jr.handles = nil
+		return nil, &javaException{throwable: throwable}
+	default:
+		return nil, fmt.Errorf("unexpected java serialization type code %#x", tc)
+	}
+}
+
+func (jr *javaReader) readClassDesc() (*javaClass, error) {
+	tc, err := jr.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tc {
+	case tcNull:
+		return nil, nil
+	case tcReference:
+		v, err := jr.readObjectWithCode(tc)
+		if err != nil {
+			return nil, err
+		}
+		class, ok := v.(*javaClass)
+		if !ok {
+			return nil, errors.New("handle does not reference a class descriptor")
+		}
+		return class, nil
+	case tcClassDesc, tcProxyClassDesc:
+		return jr.readClassDescWithCode(tc)
+	default:
+		return nil, fmt.Errorf("unexpected type code %#x for class descriptor", tc)
+	}
+}
+
+func (jr *javaReader) readClassDescWithCode(tc byte) (*javaClass, error) {
+	class := &javaClass{}
+
+	if tc == tcProxyClassDesc {
+		jr.newHandle(class)
+		var count int32
+		if err := jr.readPrimitive(&count); err != nil {
+			return nil, err
+		}
+		for i := int32(0); i < count; i++ {
+			iface, err := jr.readUTF()
+			if err != nil {
+				return nil, err
+			}
+			class.proxyInterfaces = append(class.proxyInterfaces, iface)
+		}
+		class.name = "$Proxy"
+		class.flags = scSerializable
+	} else {
+		var err error
+		if class.name, err = jr.readUTF(); err != nil {
+			return nil, err
+		}
+		if err := jr.readPrimitive(&class.suid); err != nil {
+			return nil, err
+		}
+		jr.newHandle(class)
+		if class.flags, err = jr.readByte(); err != nil {
+			return nil, err
+		}
+
+		var count int16
+		if err := jr.readPrimitive(&count); err != nil {
+			return nil, err
+		}
+		for i := int16(0); i < count; i++ {
+			var field javaField
+			if field.typeCode, err = jr.readByte(); err != nil {
+				return nil, err
+			}
+			if field.name, err = jr.readUTF(); err != nil {
+				return nil, err
+			}
+			if field.typeCode == 'L' || field.typeCode == '[' {
+				className, err := jr.readObject()
+				if err != nil {
+					return nil, err
+				}
+				field.className, _ = className.(string)
+			}
+			class.fields = append(class.fields, field)
+		}
+	}
+
+	// Class annotations are only written by custom class loaders, skip them
+	if _, err := jr.readAnnotation(); err != nil {
+		return nil, err
+	}
+
+	super, err := jr.readClassDesc()
+	if err != nil {
+		return nil, err
+	}
+	class.super = super
+
+	return class, nil
+}
+
+// readAnnotation reads contents up to the end of block data marker
+func (jr *javaReader) readAnnotation() ([]interface{}, error) {
+	var contents []interface{}
+	for {
+		tc, err := jr.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if tc == tcEndBlockData {
+			return contents, nil
+		}
+
+		content, err := jr.readContentWithCode(tc)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, content)
+	}
+}
+
+func (jr *javaReader) readNewObject() (*javaObject, error) {
+	class, err := jr.readClassDesc()
+	if err != nil {
+		return nil, err
+	}
+	if class == nil {
+		return nil, errors.New("object without class descriptor")
+	}
+
+	obj := &javaObject{
+		class:       class,
+		fields:      make(map[string]interface{}),
+		annotations: make(map[string][]interface{}),
+	}
+	jr.newHandle(obj)
+
+	for _, c := range class.hierarchy() {
+		if c.flags&scExternalizable != 0 {
+			if c.flags&scBlockData == 0 {
+				return nil, fmt.Errorf("cannot decode externalizable class %s written with protocol version 1", c.name)
+			}
+			if obj.annotations[c.name], err = jr.readAnnotation(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for _, field := range c.fields {
+			if obj.fields[field.name], err = jr.readFieldValue(field.typeCode); err != nil {
+				return nil, err
+			}
+		}
+
+		if c.flags&scWriteMethod != 0 {
+			if obj.annotations[c.name], err = jr.readAnnotation(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return obj, nil
+}
+
+func (jr *javaReader) readNewArray() (*javaArray, error) {
+	class, err := jr.readClassDesc()
+	if err != nil {
+		return nil, err
+	}
+	if class == nil || len(class.name) < 2 || class.name[0] != '[' {
+		return nil, errors.New("array without array class descriptor")
+	}
+
+	array := &javaArray{class: class}
+	jr.newHandle(array)
+
+	var size int32
+	if err := jr.readPrimitive(&size); err != nil {
+		return nil, err
+	}
+	if size < 0 || size > maxJavaDataLength {
+		return nil, fmt.Errorf("invalid array size %d", size)
+	}
+
+	// Values are appended as they are read, as the size may not be honest
+	for i := int32(0); i < size; i++ {
+		value, err := jr.readFieldValue(class.name[1])
+		if err != nil {
+			return nil, err
+		}
+		array.values = append(array.values, value)
+	}
+
+	return array, nil
+}
+
+func (jr *javaReader) readFieldValue(typeCode byte) (interface{}, error) {
+	var err error
+	switch typeCode {
+	case 'B':
+		var v int8
+		err = jr.readPrimitive(&v)
+		return v, err
+	case 'C':
+		var v uint16
+		err = jr.readPrimitive(&v)
+		return v, err
+	case 'D':
+		var v float64
+		err = jr.readPrimitive(&v)
+		return v, err
+	case 'F':
+		var v float32
+		err = jr.readPrimitive(&v)
+		return v, err
+	case 'I':
+		var v int32
+		err = jr.readPrimitive(&v)
+		return v, err
+	case 'J':
+		var v int64
+		err = jr.readPrimitive(&v)
+		return v, err
+	case 'S':
+		var v int16
+		err = jr.readPrimitive(&v)
+		return v, err
+	case 'Z':
+		var v bool
+		err = jr.readPrimitive(&v)
+		return v, err
+	case 'L', '[':
+		return jr.readObject()
+	default:
+		return nil, fmt.Errorf("invalid field type code %q", typeCode)
+	}
+}
+
+// decodeModifiedUTF8 decodes the modified UTF-8 encoding used by
+// DataOutput.writeUTF, which encodes UTF-16 code units individually
+func decodeModifiedUTF8(b []byte) (string, error) {
+	units := make([]uint16, 0, len(b))
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c < 0x80:
+			units = append(units, uint16(c))
+			i++
+		case c&0xe0 == 0xc0 && i+1 < len(b):
+			units = append(units, uint16(c&0x1f)<<6|uint16(b[i+1]&0x3f))
+			i += 2
+		case c&0xf0 == 0xe0 && i+2 < len(b):
+			units = append(units, uint16(c&0x0f)<<12|uint16(b[i+1]&0x3f)<<6|uint16(b[i+2]&0x3f))
+			i += 3
+		default:
+			return "", fmt.Errorf("invalid modified UTF-8 byte %#x", c)
+		}
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// encodeModifiedUTF8 is the inverse of decodeModifiedUTF8
+func encodeModifiedUTF8(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		switch {
+		case u != 0 && u < 0x80:
+			b = append(b, byte(u))
+		case u < 0x800:
+			b = append(b, byte(0xc0|u>>6), byte(0x80|u&0x3f))
+		default:
+			b = append(b, byte(0xe0|u>>12), byte(0x80|(u>>6)&0x3f), byte(0x80|u&0x3f))
+		}
+	}
+	return b
+}
+
+// blockCursor reads primitive data and objects, in order, from the
+// annotation written by a custom writeObject method
+type blockCursor struct {
+	contents []interface{}
+	block    []byte
+}
+
+func newBlockCursor(contents []interface{}) *blockCursor {
+	return &blockCursor{contents: contents}
+}
+
+// next returns the next n bytes of primitive data, joining consecutive
+// block data segments
+func (bc *blockCursor) next(n int) ([]byte, error) {
+	for len(bc.block) < n {
+		if len(bc.contents) == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b, ok := bc.contents[0].([]byte)
+		if !ok {
+			return nil, errors.New("expected primitive data, found an object")
+		}
+		bc.block = append(bc.block, b...)
+		bc.contents = bc.contents[1:]
+	}
+
+	b := bc.block[:n]
+	bc.block = bc.block[n:]
+	return b, nil
+}
+
+func (bc *blockCursor) readByte() (byte, error) {
+	b, err := bc.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (bc *blockCursor) readShort() (int16, error) {
+	b, err := bc.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return int16(binary.BigEndian.Uint16(b)), nil
+}
+
+func (bc *blockCursor) readInt() (int32, error) {
+	b, err := bc.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(b)), nil
+}
+
+func (bc *blockCursor) readLong() (int64, error) {
+	b, err := bc.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b)), nil
+}
+
+func (bc *blockCursor) readUTF() (string, error) {
+	length, err := bc.next(2)
+	if err != nil {
+		return "", err
+	}
+	b, err := bc.next(int(binary.BigEndian.Uint16(length)))
+	if err != nil {
+		return "", err
+	}
+	return decodeModifiedUTF8(b)
+}
+
+// readObject returns the next object. Any unread primitive data before it
+// is an error
+func (bc *blockCursor) readObject() (interface{}, error) {
+	if len(bc.block) != 0 {
+		return nil, errors.New("expected an object, found primitive data")
+	}
+	for len(bc.contents) > 0 {
+		content := bc.contents[0]
+		bc.contents = bc.contents[1:]
+		if b, ok := content.([]byte); ok {
+			if len(b) == 0 {
+				continue
+			}
+			return nil, errors.New("expected an object, found primitive data")
+		}
+		return content, nil
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// objects returns every object left in the cursor, ignoring primitive data
+func (bc *blockCursor) objects() []interface{} {
+	var objects []interface{}
+	for _, content := range bc.contents {
+		if _, ok := content.([]byte); !ok {
+			objects = append(objects, content)
+		}
+	}
+	return objects
+}
+
+// javaWriter encodes a Java serialization stream. It covers the small set
+// of types needed to send JMX requests: strings, string arrays and object
+// names. Primitive data is buffered and written as block data
+type javaWriter struct {
+	out   bytes.Buffer
+	block bytes.Buffer
+}
+
+func newJavaWriter() *javaWriter {
+	w := &javaWriter{}
+	_ = binary.Write(&w.out, binary.BigEndian, []uint16{javaStreamMagic, javaStreamVersion})
+	return w
+}
+
+func (w *javaWriter) writeByte(v byte) {
+	w.block.WriteByte(v)
+}
+
+func (w *javaWriter) writeBool(v bool) {
+	if v {
+		w.writeByte(1)
+	} else {
+		w.writeByte(0)
+	}
+}
+
+func (w *javaWriter) writeShort(v int16) {
+	_ = binary.Write(&w.block, binary.BigEndian, v)
+}
+
+func (w *javaWriter) writeInt(v int32) {
+	_ = binary.Write(&w.block, binary.BigEndian, v)
+}
+
+func (w *javaWriter) writeLong(v int64) {
+	_ = binary.Write(&w.block, binary.BigEndian, v)
+}
+
+func (w *javaWriter) writeUTF(s string) {
+	b := encodeModifiedUTF8(s)
+	w.writeShort(int16(len(b)))
+	w.block.Write(b)
+}
+
+// flush writes any buffered primitive data as block data records
+func (w *javaWriter) flush() {
+	for w.block.Len() > 0 {
+		if w.block.Len() <= math.MaxUint8 {
+			w.out.WriteByte(tcBlockData)
+			w.out.WriteByte(byte(w.block.Len()))
+			w.out.Write(w.block.Next(w.block.Len()))
+		} else {
+			chunk := w.block.Next(1024)
+			w.out.WriteByte(tcBlockDataLong)
+			_ = binary.Write(&w.out, binary.BigEndian, int32(len(chunk)))
+			w.out.Write(chunk)
+		}
+	}
+	w.block.Reset()
+}
+
+func (w *javaWriter) writeRawUTF(s string) {
+	b := encodeModifiedUTF8(s)
+	_ = binary.Write(&w.out, binary.BigEndian, uint16(len(b)))
+	w.out.Write(b)
+}
+
+func (w *javaWriter) writeNull() {
+	w.flush()
+	w.out.WriteByte(tcNull)
+}
+
+func (w *javaWriter) writeString(s string) {
+	w.flush()
+	w.out.WriteByte(tcString)
+	w.writeRawUTF(s)
+}
+
+// writeClassDesc writes a class descriptor and its superclasses. Handles
+// are never reused, so the same class may be described more than once
+func (w *javaWriter) writeClassDesc(class *javaClass) {
+	w.flush()
+	if class == nil {
+		w.out.WriteByte(tcNull)
+		return
+	}
+
+	w.out.WriteByte(tcClassDesc)
+	w.writeRawUTF(class.name)
+	_ = binary.Write(&w.out, binary.BigEndian, class.suid)
+	w.out.WriteByte(class.flags)
+	_ = binary.Write(&w.out, binary.BigEndian, int16(len(class.fields)))
+	for _, field := range class.fields {
+		w.out.WriteByte(field.typeCode)
+		w.writeRawUTF(field.name)
+		if field.typeCode == 'L' || field.typeCode == '[' {
+			w.writeString(field.className)
+		}
+	}
+	w.out.WriteByte(tcEndBlockData)
+	w.writeClassDesc(class.super)
+}
+
+var (
+	stringArrayClass = &javaClass{name: "[Ljava.lang.String;", suid: -5921575005990323385, flags: scSerializable}
+	objectNameClass  = &javaClass{name: "javax.management.ObjectName", suid: 1081892073854801359, flags: scSerializable | scWriteMethod}
+)
+
+func (w *javaWriter) writeStringArray(values []string) {
+	w.flush()
+	w.out.WriteByte(tcArray)
+	w.writeClassDesc(stringArrayClass)
+	_ = binary.Write(&w.out, binary.BigEndian, int32(len(values)))
+	for _, v := range values {
+		w.writeString(v)
+	}
+}
+
+// writeObjectName writes a javax.management.ObjectName, which serializes
+// itself as its canonical name string
+func (w *javaWriter) writeObjectName(name string) {
+	w.flush()
+	w.out.WriteByte(tcObject)
+	w.writeClassDesc(objectNameClass)
+	w.writeString(name)
+	w.out.WriteByte(tcEndBlockData)
+}
+
+// bytes flushes any pending block data and returns the encoded stream
+func (w *javaWriter) bytes() []byte {
+	w.flush()
+	return w.out.Bytes()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// writeTestObject writes a new object of class, followed by the field
+// values and annotations written by data
+func writeTestObject(w *javaWriter, class *javaClass, data func()) {
+	w.flush()
+	w.out.WriteByte(tcObject)
+	w.writeClassDesc(class)
+	data()
+}
+
+// writeRawField writes a primitive field value outside of block data
+func writeRawField(w *javaWriter, v interface{}) {
+	_ = binary.Write(&w.out, binary.BigEndian, v)
+}
+
+// endAnnotation terminates the data written by a custom writeObject method
+func endAnnotation(w *javaWriter) {
+	w.flush()
+	w.out.WriteByte(tcEndBlockData)
+}
+
+func TestModifiedUTF8(t *testing.T) {
+	testCases := []struct {
+		input   string
+		encoded []byte
+	}{
+		{"java.lang", []byte("java.lang")},
+		{"\x00", []byte{0xc0, 0x80}},
+		{"é", []byte{0xc3, 0xa9}},
+		{"€", []byte{0xe2, 0x82, 0xac}},
+		{"😀", []byte{0xed, 0xa0, 0xbd, 0xed, 0xb8, 0x80}},
+	}
+
+	for _, tc := range testCases {
+		encoded := encodeModifiedUTF8(tc.input)
+		if !bytes.Equal(encoded, tc.encoded) {
+			t.Errorf("Expected %x for %q, got %x", tc.encoded, tc.input, encoded)
+		}
+		decoded, err := decodeModifiedUTF8(encoded)
+		if err != nil {
+			t.Error(err)
+		}
+		if decoded != tc.input {
+			t.Errorf("Expected %q, got %q", tc.input, decoded)
+		}
+	}
+}
+
+func TestJavaReaderRoundTrip(t *testing.T) {
+	w := newJavaWriter()
+	w.writeInt(42)
+	w.writeObjectName("java.lang:type=Memory")
+	w.writeStringArray([]string{"HeapMemoryUsage", "Verbose"})
+	w.writeNull()
+
+	jr, err := newJavaReader(bytes.NewReader(w.bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := jr.readContent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(block, []byte{0, 0, 0, 42}) {
+		t.Errorf("Unexpected block data %v", block)
+	}
+
+	name, err := jr.readObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := objectNameString(name); err != nil || s != "java.lang:type=Memory" {
+		t.Errorf("Unexpected object name %q: %v", s, err)
+	}
+
+	array, err := jr.readObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := array.(*javaArray); !ok || !reflect.DeepEqual(a.values, []interface{}{"HeapMemoryUsage", "Verbose"}) {
+		t.Errorf("Unexpected array %+v", array)
+	}
+
+	null, err := jr.readObject()
+	if err != nil || null != nil {
+		t.Errorf("Expected null, got %v: %v", null, err)
+	}
+}
+
+func TestJavaReaderReferences(t *testing.T) {
+	w := newJavaWriter()
+	w.writeString("shared")
+	w.out.WriteByte(tcReference)
+	writeRawField(w, int32(javaBaseWireHandle))
+
+	jr, _ := newJavaReader(bytes.NewReader(w.bytes()))
+	first, _ := jr.readObject()
+	second, err := jr.readObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "shared" || second != "shared" {
+		t.Errorf("Expected back reference to resolve, got %v and %v", first, second)
+	}
+}
+
+func TestJavaReaderInvalidLengths(t *testing.T) {
+	testCases := []struct {
+		tc     byte
+		length interface{}
+	}{
+		{tcBlockDataLong, int32(-1)},
+		{tcBlockDataLong, int32(maxJavaDataLength + 1)},
+		{tcLongString, int64(-1)},
+		{tcLongString, int64(1 << 40)},
+		// Longer than the data that follows
+		{tcBlockDataLong, int32(1024)},
+	}
+	for _, tc := range testCases {
+		w := newJavaWriter()
+		w.out.WriteByte(tc.tc)
+		writeRawField(w, tc.length)
+		w.out.WriteString("data")
+
+		jr, _ := newJavaReader(bytes.NewReader(w.bytes()))
+		if _, err := jr.readContent(); err == nil {
+			t.Errorf("Expected an error for length %v of %#x", tc.length, tc.tc)
+		}
+	}
+}
+
+func TestJavaReaderInvalidHeader(t *testing.T) {
+	if _, err := newJavaReader(bytes.NewReader([]byte{0xca, 0xfe, 0xba, 0xbe})); err == nil {
+		t.Error("Expected error for invalid stream header")
+	}
+}
+
+func TestJavaToGo(t *testing.T) {
+	number := &javaClass{name: "java.lang.Number", flags: scSerializable}
+	integer := &javaClass{name: "java.lang.Integer", flags: scSerializable, fields: []javaField{{typeCode: 'I', name: "value"}}, super: number}
+	boolean := &javaClass{name: "java.lang.Boolean", flags: scSerializable, fields: []javaField{{typeCode: 'Z', name: "value"}}}
+	treeMap := &javaClass{name: "java.util.TreeMap", flags: scSerializable | scWriteMethod, fields: []javaField{{typeCode: 'L', name: "comparator", className: "Ljava/util/Comparator;"}}}
+	composite := &javaClass{
+		name:  "javax.management.openmbean.CompositeDataSupport",
+		flags: scSerializable,
+		fields: []javaField{
+			{typeCode: 'L', name: "compositeType", className: "Ljavax/management/openmbean/CompositeType;"},
+			{typeCode: 'L', name: "contents", className: "Ljava/util/SortedMap;"},
+		},
+	}
+
+	w := newJavaWriter()
+	writeTestObject(w, composite, func() {
+		w.writeNull()
+		writeTestObject(w, treeMap, func() {
+			w.writeNull()
+			w.writeInt(2)
+			w.writeString("used")
+			writeTestObject(w, integer, func() { writeRawField(w, int32(7)) })
+			w.writeString("valid")
+			writeTestObject(w, boolean, func() { writeRawField(w, true) })
+			endAnnotation(w)
+		})
+	})
+
+	jr, _ := newJavaReader(bytes.NewReader(w.bytes()))
+	v, err := jr.readObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"used": 7.0, "valid": true}
+	if out := javaToGo(v); !reflect.DeepEqual(out, expected) {
+		t.Errorf("Expected %v, got %v", expected, out)
+	}
+}
@@ -1,30 +1,64 @@
 package main
 
 import (
-	"io/ioutil"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	sdkArgs "github.com/newrelic/infra-integrations-sdk/args"
 	"github.com/newrelic/infra-integrations-sdk/integration"
-	"github.com/newrelic/infra-integrations-sdk/jmx"
 	"github.com/newrelic/infra-integrations-sdk/log"
+	"github.com/newrelic/infra-integrations-sdk/persist"
 )
 
 type argumentList struct {
 	sdkArgs.DefaultArgumentList
-	JmxHost            string `default:"localhost" help:"The host running JMX"`
-	JmxPort            string `default:"9999" help:"The port JMX is running on"`
-	JmxUser            string `default:"admin" help:"The username for the JMX connection"`
-	JmxPass            string `default:"admin" help:"The password for the JMX connection"`
-	JmxRemote          bool   `default:"false" help:"When activated uses the JMX remote url connection format"`
-	KeyStore           string `default:"" help:"The location for the keystore containing JMX Client's SSL certificate"`
-	KeyStorePassword   string `default:"" help:"Password for the SSL Key Store"`
-	TrustStore         string `default:"" help:"The location for the keystore containing JMX Server's SSL certificate"`
-	TrustStorePassword string `default:"" help:"Password for the SSL Trust Store"`
-	CollectionFiles    string `default:"" help:"A comma separated list of full paths to metrics configuration files"`
-	Timeout            int    `default:"10000" help:"Timeout for JMX queries"`
-	MetricLimit        int    `default:"200" help:"Number of metrics that can be collected per entity. If this limit is exceeded the entity will not be reported. A limit of 0 implies no limit."`
+	JmxURL              string `default:"" help:"A JMXServiceURL such as service:jmx:rmi:///jndi/rmi://host:port/jmxrmi, service:jmx:remote+http://host:port or service:jmx:jmxmp://host:port. Replaces jmx_host, jmx_port and jmx_remote"`
+	JmxHost             string `default:"localhost" help:"The host running JMX"`
+	JmxPort             string `default:"9999" help:"The port JMX is running on"`
+	JmxUser             string `default:"admin" help:"The username for the JMX connection"`
+	JmxPass             string `default:"admin" help:"The password for the JMX connection. Also accepts a file:, env:, exec: or jmxremote: secret reference"`
+	JmxRemote           bool   `default:"false" help:"When activated uses the JMX remote url connection format"`
+	JmxBackend          string `default:"nrjmx" help:"The backend used to query JMX. One of nrjmx, jolokia or native"`
+	JolokiaURL          string `default:"" help:"The URL of the Jolokia agent endpoint, used by the jolokia backend"`
+	KeyStore            string `default:"" help:"The location for the keystore containing JMX Client's SSL certificate"`
+	KeyStorePassword    string `default:"" help:"Password for the SSL Key Store. Also accepts a file:, env:, exec: or jmxremote: secret reference"`
+	TrustStore          string `default:"" help:"The location for the keystore containing JMX Server's SSL certificate"`
+	TrustStorePassword  string `default:"" help:"Password for the SSL Trust Store. Also accepts a file:, env:, exec: or jmxremote: secret reference"`
+	TLSCaFile           string `default:"" help:"PEM file with the CA certificates that sign the JMX Server's SSL certificate. Replaces the Java keystore arguments"`
+	TLSCertFile         string `default:"" help:"PEM file with the JMX Client's SSL certificate. Requires tls_key_file and tls_ca_file"`
+	TLSKeyFile          string `default:"" help:"PEM file with the private key of the JMX Client's SSL certificate"`
+	CollectionFiles     string `default:"" help:"A comma separated list of full paths to metrics configuration files"`
+	Targets             string `default:"" help:"A JSON list of JVMs to collect from, or the path to a YAML or JSON file with that list. Settings missing from a target are taken from the other arguments"`
+	TargetsFile         string `default:"" help:"A JSON or YAML file, or a directory of them, listing groups of host:port targets with their labels and collection files. Read on every run, and watched for changes in daemon mode"`
+	DiscoverLocal       bool   `default:"false" help:"Collect from every local JVM started with -Dcom.sun.management.jmxremote.port, besides the targets list"`
+	ProcRoot            string `default:"/proc" help:"Mount point of the proc filesystem scanned by discover_local"`
+	DiscoverKubernetes  bool   `default:"false" help:"Collect from every running pod annotated with newrelic.com/jmx-port, besides the targets list"`
+	Kubeconfig          string `default:"" help:"Path of the kubeconfig file used by discover_kubernetes. The in-cluster service account is used when empty"`
+	KubernetesNamespace string `default:"" help:"Only discover pods of this namespace. All namespaces are searched when empty"`
+	KubernetesNode      string `default:"" help:"Only discover pods scheduled on this node, such as the node running the integration"`
+	CollectionDir       string `default:"/etc/newrelic-infra/integrations.d" help:"Directory of the collection files that the newrelic.com/jmx-collection pod annotation can name"`
+	DiscoverCredentials bool   `default:"false" help:"Pass jmx_pass, key_store_password and trust_store_password to the pods and containers found by discover_kubernetes and discover_docker, whose annotations and labels could point at any listener"`
+	DiscoverDocker      bool   `default:"false" help:"Collect from every running container labelled with com.newrelic.jmx.port, besides the targets list"`
+	DockerSocket        string `default:"/var/run/docker.sock" help:"Path of the Docker Engine API socket used by discover_docker"`
+	Timeout             int    `default:"10000" help:"Timeout for JMX queries"`
+	NameCacheTTL        int    `default:"0" help:"Seconds the names of the beans matched by each query are cached by the jolokia and native backends, so that the JVM doesn't search them on every run. 0 disables the cache"`
+	QueryBatchSize      int    `default:"1" help:"Number of bean queries sent to nrjmx or Jolokia in a single round trip. 1 sends them one at a time"`
+	QueryAttempts       int    `default:"3" help:"Number of times a query is tried when it fails with a timeout or a lost connection. The connection is reopened before every retry"`
+	RetryBackoff        int    `default:"1000" help:"Milliseconds to wait before the first retry of a query. The wait doubles on every following retry"`
+	BreakerThreshold    int    `default:"3" help:"Number of runs in a row a bean query can fail before it is skipped for breaker_cooldown seconds. 0 never skips failing queries"`
+	BreakerCooldown     int    `default:"300" help:"Seconds a bean query is skipped after failing breaker_threshold runs in a row"`
+	CollectionDeadline  int    `default:"0" help:"Milliseconds after the first query of a target when its remaining queries are skipped, highest priority beans being queried first. 0 disables the deadline"`
+	Concurrency         int    `default:"4" help:"Maximum number of targets collected at the same time"`
+	Daemon              bool   `default:"false" help:"Keep running and collect every daemon_interval seconds, keeping the JMX connections open. One payload is written per collection"`
+	DaemonInterval      int    `default:"15" help:"Seconds between collections in daemon mode"`
+	Diagnose            bool   `default:"false" help:"Check the connection to every target step by step and print a report instead of collecting metrics"`
+	Validate            bool   `default:"false" help:"Check the collection files given as arguments, or collection_files, print their errors and exit with status 1 if there is any, instead of collecting metrics"`
+	MetricLimit         int    `default:"200" help:"Number of metrics that can be collected per entity. If this limit is exceeded the entity will not be reported. A limit of 0 implies no limit."`
 }
 
 const (
@@ -34,95 +68,287 @@ const (
 
 var (
 	args argumentList
-
-	// Alias these functions for easy mocking
-	jmxOpen  = jmx.Open
-	jmxClose = jmx.Close
-	jmxQuery = jmx.Query
 )
 
 func main() {
+	// The SDK logs through the redacting logger too. Its verbosity is only
+	// known once the arguments are parsed
+	redacting := newRedactingLogger(false)
+	logger = redacting
+
+	// The store is shared with the SDK, which keeps the previous values of
+	// rate and delta metrics in it
+	store, err := persist.NewFileStore(persist.DefaultPath(integrationName), logger, persist.DefaultTTL)
+	if err != nil {
+		logger.Errorf("Failed to open the integration store: %s", err)
+		os.Exit(1)
+	}
+	collectionStore = store
 
 	// Create a new integration
-	jmxIntegration, err := integration.New(integrationName, integrationVersion, integration.Args(&args))
+	jmxIntegration, err := integration.New(integrationName, integrationVersion, integration.Args(&args), integration.Storer(store), integration.Logger(logger))
 	if err != nil {
 		os.Exit(1)
 	}
 	log.SetupLogging(args.Verbose)
+	redacting.verbose = args.Verbose
 
-	//<<<<<<< HEAD
-	//	// Ensure a collection file is specified
-	//	if args.CollectionFiles == "" {
-	//		log.Error("Must specify at least one configuration file")
-	//		os.Exit(1)
-	//	}
-	//
-	//	// Open a JMX connection
-	//	if err := jmxOpen(args.JmxHost, args.JmxPort, args.JmxUser, args.JmxPass); err != nil {
-	//=======
-	options := make([]jmx.Option, 0)
-	if args.JmxRemote {
-		options = append(options, jmx.WithRemoteProtocol())
-	}
-	if args.KeyStore != "" && args.KeyStorePassword != "" && args.TrustStore != "" && args.TrustStorePassword != "" {
-		ssl := jmx.WithSSL(args.KeyStore, args.KeyStorePassword, args.TrustStore, args.TrustStorePassword)
-		options = append(options, ssl)
-	}
-	if err := jmxOpen(args.JmxHost, args.JmxPort, args.JmxUser, args.JmxPass, options...); err != nil {
-		//>>>>>>> upstream/master
-		log.Error(
-			"Failed to open JMX connection (host: %s, port: %s, user: %s, pass: %s, keyStore: %s, keyStorePassword: %s, trustStore: %s, trustStorePassword: %s, remote: %t): %s",
-			args.JmxHost, args.JmxPort, args.JmxUser, args.JmxPass, args.KeyStore, args.KeyStorePassword, args.TrustStore, args.TrustStorePassword, args.JmxRemote, err,
-		)
-		os.Exit(1)
+	if args.Validate {
+		files := flag.Args()
+		if len(files) == 0 && args.CollectionFiles != "" {
+			files = strings.Split(args.CollectionFiles, ",")
+		}
+		if !validateFiles(os.Stdout, files) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	for _, f := range strings.Split(args.CollectionFiles, ",") {
-		file, err := ioutil.ReadFile(f)
-		if err != nil {
-			log.Error("Error reading JMX configuration file: %s error: %+v", f, err)
-			continue
+	if args.Daemon {
+		if args.Pretty {
+			logger.Errorf("%s", errDaemonPretty)
+			os.Exit(1)
 		}
+		runDaemon(jmxIntegration)
+		return
+	}
 
-		p, err := getParser(file)
-		if err != nil {
-			log.Error("Error getting JMX parser for file: %s error: %+v", f, err)
-			continue
+	targets, err := getTargets()
+	if args.Diagnose {
+		if !diagnose(os.Stdout, targets, err) {
+			os.Exit(1)
 		}
+		return
+	}
+	if err != nil {
+		logger.Errorf("Failed to read JMX targets: %s", err)
+		// The connection sample still reports the single configured JVM as down
+		if usesTargetsFromArgs() {
+			t := &jmxTarget{}
+			t.inheritArgs()
+			if err := recordHealth(t, &connectionHealth{err: err, errorClass: errorClassConfig}, jmxIntegration); err == nil {
+				publish(jmxIntegration)
+			}
+		}
+		os.Exit(1)
+	}
+
+	collectErr := collectTargets(targets, jmxIntegration, nil)
+
+	jmxIntegration.Entities = checkMetricLimit(jmxIntegration.Entities)
+	publish(jmxIntegration)
+
+	if collectErr != nil && len(targets) == 1 {
+		os.Exit(1)
+	}
+}
+
+// publish writes the payload, exiting on failure
+func publish(i *integration.Integration) {
+	if err := i.Publish(); err != nil {
+		logger.Errorf("Failed to publish integration: %s", err.Error())
+		os.Exit(1)
+	}
+}
+
+// collectTargets collects every target, running up to args.Concurrency
+// of them at the same time, and records the connection sample of each.
+// Connections are kept open in pool between calls, or opened and closed
+// by this call when pool is nil. It returns the last connection error, if any
+func collectTargets(targets []*jmxTarget, i *integration.Integration, pool *connectionPool) error {
+	concurrency := args.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var lastErr error
+	slots := make(chan struct{}, concurrency)
+	for _, target := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(target *jmxTarget) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			start := time.Now()
+			collect := collectOnce
+			if pool != nil {
+				collect = pool.collect
+			}
+			if target.configErr != nil {
+				collect = configFailure
+			}
+			health, err := collect(target, i)
+			health.duration = time.Since(start)
+			if err := recordHealth(target, health, i); err != nil {
+				logger.Errorf("Failed to record the connection sample of %s: %s", target, err)
+			}
+			if err != nil {
+				logger.Errorf(
+					"Failed to open JMX connection (host: %s, port: %s, user: %s, keyStore: %s, trustStore: %s, remote: %t, backend: %s): %s",
+					target.JmxHost, target.JmxPort, target.JmxUser, target.KeyStore, target.TrustStore, target.remote(), target.JmxBackend, err,
+				)
+				lock.Lock()
+				lastErr = err
+				lock.Unlock()
+			}
+		}(target)
+	}
+	wg.Wait()
+
+	return lastErr
+}
+
+// configFailure reports a target whose settings failed to resolve as down
+// with a config error, without connecting to it
+func configFailure(target *jmxTarget, i *integration.Integration) (*connectionHealth, error) {
+	return &connectionHealth{err: target.configErr, errorClass: errorClassConfig}, target.configErr
+}
+
+// collectOnce connects to a target, collects it and disconnects
+func collectOnce(target *jmxTarget, i *integration.Integration) (*connectionHealth, error) {
+	client, err := newJMXClient(target)
+	if err != nil {
+		return &connectionHealth{err: err, errorClass: errorClassConfig}, err
+	}
+	hc := newHealthClient(client, backendName(target) == "nrjmx")
+	err = collectTarget(target, hc, i)
+	return hc.health(), err
+}
 
-		d, err := p.parse(file)
+// collectTarget opens the client, queries every bean of the target's
+// collection files and closes the client. Only a failure to open the
+// connection is returned, query errors are logged
+func collectTarget(target *jmxTarget, client jmxClient, i *integration.Integration) error {
+	defer client.close()
+	if err := client.open(); err != nil {
+		return err
+	}
+
+	collectFiles(target, client, i)
+	return nil
+}
+
+// collectFiles queries every bean of the target's collection files with an
+// open client
+func collectFiles(target *jmxTarget, client jmxClient, i *integration.Integration) {
+	// The beans of all files are queried together, so that priorities
+	// apply across files
+	var collection []*domainDefinition
+	for _, f := range strings.Split(target.CollectionFiles, ",") {
+		d, err := parseCollectionFile(f)
 		if err != nil {
-			log.Error("Error parsing JMX file: %s error: %+v", f, err)
+			for _, problem := range fileProblems(f, err) {
+				logger.Errorf("Error parsing JMX file: %s", problem)
+			}
 			continue
 		}
 
-		err = queryJMX(d, jmxIntegration)
+		collection = append(collection, d...)
+	}
+
+	if err := queryJMX(collection, client, target, i); err != nil {
+		logger.Errorf("Failed to process domainDefinition for %s: %s", target, err)
+	}
+}
+
+// newJMXClient returns an unopened client for the backend selected for the
+// target, wrapped to retry failed queries as set by args.QueryAttempts
+func newJMXClient(target *jmxTarget) (jmxClient, error) {
+	client, err := newBackendClient(target)
+	if err != nil || args.QueryAttempts <= 1 {
+		return client, err
+	}
+	return newRetryClient(client, args.QueryAttempts, time.Duration(args.RetryBackoff)*time.Millisecond), nil
+}
+
+// newBackendClient returns an unopened client for the backend selected for the target
+func newBackendClient(target *jmxTarget) (jmxClient, error) {
+	switch target.JmxBackend {
+	case "", "nrjmx":
+		if args.NameCacheTTL > 0 {
+			return nil, errNrjmxNameCache
+		}
+		client := newNrjmxClient(nrjmxConfig{
+			url:                target.serviceURL,
+			hostname:           target.JmxHost,
+			port:               target.JmxPort,
+			username:           target.JmxUser,
+			password:           target.JmxPass,
+			keyStore:           target.KeyStore,
+			keyStorePassword:   target.KeyStorePassword,
+			trustStore:         target.TrustStore,
+			trustStorePassword: target.TrustStorePassword,
+			remote:             target.remote(),
+			tls:                target.tls,
+		})
+		// The native client lists the beans of the responses too large for
+		// nrjmx, when it can reach the target
+		if lister, err := newNativeClient(target); err == nil {
+			client.lister = lister
+		}
+		return client, nil
+	case "jolokia":
+		if target.serviceURL != nil {
+			return nil, errors.New("the jolokia backend does not support jmx_url, use jolokia_url")
+		}
+		if target.keyStoreSSL() {
+			return nil, errors.New("the jolokia backend does not support Java keystores, use tls_ca_file, tls_cert_file and tls_key_file")
+		}
+		client, err := newJolokiaClient(target.JolokiaURL, target.JmxUser, target.JmxPass, args.Timeout, target.tlsConfig())
 		if err != nil {
-			log.Error("Failed to process domainDefinition: %s", err)
+			return nil, err
 		}
+		client.catalog = newNameCatalog(target)
+		return client, nil
+	case "native":
+		return newNativeClient(target)
+	default:
+		return nil, fmt.Errorf("unknown jmx_backend %s", target.JmxBackend)
 	}
+}
 
-	jmxClose()
-	jmxIntegration.Entities = checkMetricLimit(jmxIntegration.Entities)
-	if err := jmxIntegration.Publish(); err != nil {
-		log.Error("Failed to publish integration: %s", err.Error())
-		os.Exit(1)
+// newNativeClient returns an unopened native client for the target, or an
+// error if the target uses options the native backend doesn't support
+func newNativeClient(target *jmxTarget) (*rmiClient, error) {
+	if err := validateRMIOptions(target.remote(), target.KeyStore, target.TrustStore); err != nil {
+		return nil, err
+	}
+	bindingName := jmxRMIBindingName
+	if u := target.serviceURL; u != nil {
+		if u.protocol != "rmi" {
+			return nil, fmt.Errorf("the native backend only supports service:jmx:rmi URLs, use the nrjmx backend for %s", u)
+		}
+		bindingName = u.bindingName
 	}
+	client := newRMIClient(target.JmxHost, target.JmxPort, bindingName, target.JmxUser, target.JmxPass, args.Timeout, target.tlsConfig())
+	client.catalog = newNameCatalog(target)
+	return client, nil
 }
 
 // checkMetricLimit looks through all of the metric sets for every entity and aggregates the number
-// of metrics. If that total is greate than args.MetricLimit a warning is logged
+// of metrics. If that total is greate than args.MetricLimit a warning is logged.
+// The jvm entities holding the connection samples are always kept
 func checkMetricLimit(entities []*integration.Entity) []*integration.Entity {
 	validEntities := make([]*integration.Entity, 0, len(entities))
 
 	for _, entity := range entities {
+		if entity.Metadata != nil && entity.Metadata.Namespace == jvmEntityType {
+			validEntities = append(validEntities, entity)
+			continue
+		}
+
 		metricCount := 0
 		for _, metricSet := range entity.Metrics {
 			metricCount += len(metricSet.Metrics)
 		}
 
 		if args.MetricLimit != 0 && metricCount > args.MetricLimit {
-			log.Warn("Domain '%s' has %d metrics, the current limit is %d. This Domain will not be reported", entity.Metadata.Name, metricCount, args.MetricLimit)
+			logger.Warnf("Domain '%s' has %d metrics, the current limit is %d. This Domain will not be reported", entity.Metadata.Name, metricCount, args.MetricLimit)
 			continue
 		}
 
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/newrelic/infra-integrations-sdk/data/metric"
 	"github.com/newrelic/infra-integrations-sdk/integration"
 )
 
+// withArgs replaces the arguments of the integration for a test, and
+// returns a function that restores the previous ones
+func withArgs(a argumentList) func() {
+	saved := args
+	args = a
+	return func() {
+		args = saved
+	}
+}
+
 func Test_checkMetricList(t *testing.T) {
 	// Ensure we hit the
 	args.MetricLimit = 2
@@ -47,3 +58,48 @@ func Test_checkMetricList(t *testing.T) {
 		t.Errorf("Expected entity '%+v' got '%+v'", e1, out[0])
 	}
 }
+
+func TestCollectTarget(t *testing.T) {
+	i, _ := integration.New("jmxtest", "0.1.0")
+	target := &jmxTarget{JmxHost: "localhost", CollectionFiles: "../test/infra-good.yml"}
+
+	queries := 0
+	client := &fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		queries++
+		return map[string]interface{}{}, nil
+	}}
+	if err := collectTarget(target, client, i); err != nil {
+		t.Fatal(err)
+	}
+	if client.opens != 1 || client.closes != 1 || queries == 0 {
+		t.Errorf("Expected client to be opened, queried and closed: %+v, %d queries", client, queries)
+	}
+
+	failing := &fakeClient{openErr: errors.New("connection refused")}
+	if err := collectTarget(target, failing, i); err == nil || failing.closes != 1 {
+		t.Errorf("Expected open error to be returned and the client closed, got %v, %d closes", err, failing.closes)
+	}
+}
+
+func TestNewJMXClientURL(t *testing.T) {
+	defer withArgs(argumentList{})()
+
+	u, err := parseJMXServiceURL("service:jmx:rmi:///jndi/rmi://jvm.localnet:9999/custom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newJMXClient(&jmxTarget{JmxBackend: "native", JmxHost: u.host, JmxPort: u.port, serviceURL: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := client.(*rmiClient); c.host != "jvm.localnet" || c.bindingName != "custom" {
+		t.Errorf("Unexpected native client %+v", c)
+	}
+
+	u, _ = parseJMXServiceURL("service:jmx:jmxmp://jvm.localnet:7091")
+	for _, backend := range []string{"native", "jolokia"} {
+		if _, err := newJMXClient(&jmxTarget{JmxBackend: backend, JolokiaURL: "http://jvm.localnet:8778/jolokia", serviceURL: u}); err == nil {
+			t.Errorf("Expected the %s backend to reject %s", backend, u)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jolokiaErrorPrefix starts the values that Jolokia returns in place of the
+// attributes it failed to read, when ignoreErrors is set
+const jolokiaErrorPrefix = "ERROR: "
+
+// jolokiaClient queries MBeans through the HTTP/JSON bridge of a Jolokia
+// agent instead of the nrjmx subprocess. Results are returned in the same
+// flattened "domain:bean,attr=Name" form that nrjmx produces, so they can be
+// handed straight to handleResponse
+type jolokiaClient struct {
+	url      string
+	user     string
+	password string
+	// connectTimeout bounds the version request made by open, in milliseconds
+	connectTimeout int
+	http           *http.Client
+	// catalog caches the beans matched by each query, when enabled
+	catalog *nameCatalog
+}
+
+// jolokiaRequest is a single operation in a Jolokia bulk request
+type jolokiaRequest struct {
+	Type      string                 `json:"type"`
+	MBean     string                 `json:"mbean,omitempty"`
+	Attribute []string               `json:"attribute,omitempty"`
+	Config    map[string]interface{} `json:"config,omitempty"`
+}
+
+// jolokiaResponse is a single result in a Jolokia bulk response
+type jolokiaResponse struct {
+	Request jolokiaRequest  `json:"request"`
+	Value   json.RawMessage `json:"value"`
+	Status  int             `json:"status"`
+	Error   string          `json:"error"`
+}
+
+// newJolokiaClient returns a client for the agent at url. tlsConfig
+// replaces the system roots for https URLs when not nil
+func newJolokiaClient(url, user, password string, connectTimeout int, tlsConfig *tls.Config) (*jolokiaClient, error) {
+	if url == "" {
+		return nil, fmt.Errorf("jolokia_url must be set when using the jolokia backend")
+	}
+
+	return &jolokiaClient{
+		url:            url,
+		user:           user,
+		password:       password,
+		connectTimeout: connectTimeout,
+		http:           &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}},
+	}, nil
+}
+
+// open checks that the agent is reachable and accepts our credentials by
+// requesting its version. Jolokia is stateless, so there is nothing to keep
+func (c *jolokiaClient) open() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.connectTimeout)*time.Millisecond)
+	defer cancel()
+
+	responses, err := c.post(ctx, []jolokiaRequest{{Type: "version"}})
+	if err != nil {
+		return annotate(err, "connecting to Jolokia agent")
+	}
+	if len(responses) != 1 || responses[0].Status != http.StatusOK {
+		return fmt.Errorf("unexpected Jolokia version response: %+v", responses)
+	}
+
+	return nil
+}
+
+func (c *jolokiaClient) close() {}
+
+// query resolves objectPattern with a Jolokia search, reads every matching
+// bean in a single bulk request and flattens the attribute values. The whole
+// round trip must complete within timeout milliseconds
+func (c *jolokiaClient) query(objectPattern string, timeout int) (map[string]interface{}, error) {
+	return c.queryAttributes(objectPattern, nil, timeout)
+}
+
+// queryAttributes is query, reading only attrNames of every matching bean
+func (c *jolokiaClient) queryAttributes(objectPattern string, attrNames []string, timeout int) (map[string]interface{}, error) {
+	results, errs := c.queryBatch([]string{objectPattern}, [][]string{attrNames}, timeout)
+	return results[0], errs[0]
+}
+
+func (c *jolokiaClient) batching() bool {
+	return true
+}
+
+// queryBatch runs the searches of all the objectPatterns in one bulk request,
+// then reads all the matching beans in another, so that a batch costs two
+// round trips, or one when the catalog has the names of all of them. Both
+// must complete within timeout milliseconds
+func (c *jolokiaClient) queryBatch(objectPatterns []string, attrNames [][]string, timeout int) ([]map[string]interface{}, []error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	results := make([]map[string]interface{}, len(objectPatterns))
+	errs := make([]error, len(objectPatterns))
+	// fail sets err for every query that hasn't failed yet
+	fail := func(err error, format string) ([]map[string]interface{}, []error) {
+		for n, objectPattern := range objectPatterns {
+			if errs[n] == nil {
+				results[n], errs[n] = nil, annotate(err, format, objectPattern)
+			}
+		}
+		return results, errs
+	}
+
+	// Only the queries missing from the catalog are searched
+	names := make([][]string, len(objectPatterns))
+	cached := make([]bool, len(objectPatterns))
+	var searches []jolokiaRequest
+	var searched []int
+	for n, objectPattern := range objectPatterns {
+		if names[n], cached[n] = c.catalog.lookup(objectPattern); !cached[n] {
+			searches = append(searches, jolokiaRequest{Type: "search", MBean: objectPattern})
+			searched = append(searched, n)
+		}
+	}
+	if len(searches) != 0 {
+		responses, err := c.post(ctx, searches)
+		if err != nil {
+			return fail(err, "searching beans for query %s")
+		}
+		if len(responses) != len(searches) {
+			return fail(fmt.Errorf("expected %d search responses, got %d", len(searches), len(responses)), "searching beans for query %s")
+		}
+		for k, response := range responses {
+			n := searched[k]
+			if names[n], errs[n] = searchNames(response, objectPatterns[n]); errs[n] == nil {
+				c.catalog.remember(objectPatterns[n], names[n])
+			}
+		}
+	}
+
+	// reads holds the read of every bean found, and owners the index of the
+	// query that found it
+	var reads []jolokiaRequest
+	var owners []int
+	for n := range objectPatterns {
+		if errs[n] != nil {
+			continue
+		}
+		results[n] = make(map[string]interface{})
+		for _, name := range names[n] {
+			reads = append(reads, jolokiaRequest{
+				Type:      "read",
+				MBean:     name,
+				Attribute: attrNames[n],
+				Config:    map[string]interface{}{"ignoreErrors": true},
+			})
+			owners = append(owners, n)
+		}
+	}
+	if len(reads) == 0 {
+		return results, errs
+	}
+
+	responses, err := c.post(ctx, reads)
+	if err != nil {
+		return fail(err, "reading beans for query %s")
+	}
+	if len(responses) != len(reads) {
+		return fail(fmt.Errorf("expected %d read responses, got %d", len(reads), len(responses)), "reading beans for query %s")
+	}
+
+	// stale holds the queries with a cached bean that is gone, which are
+	// searched and read again
+	var stale []int
+	for k, response := range responses {
+		n := owners[k]
+		if errs[n] != nil || results[n] == nil {
+			continue
+		}
+		if cached[n] && response.Status == http.StatusNotFound {
+			c.catalog.forget(objectPatterns[n])
+			results[n] = nil
+			stale = append(stale, n)
+			continue
+		}
+		if err := addReadValue(results[n], response, reads[k].Attribute); err != nil {
+			results[n], errs[n] = nil, err
+		}
+	}
+
+	if len(stale) != 0 {
+		patterns := make([]string, len(stale))
+		names := make([][]string, len(stale))
+		for k, n := range stale {
+			patterns[k], names[k] = objectPatterns[n], attrNames[n]
+		}
+		retried, retryErrs := c.queryBatch(patterns, names, timeout)
+		for k, n := range stale {
+			results[n], errs[n] = retried[k], retryErrs[k]
+		}
+	}
+
+	return results, errs
+}
+
+// searchNames returns the names of the beans found by the search of
+// objectPattern
+func searchNames(response jolokiaResponse, objectPattern string) ([]string, error) {
+	if response.Status != http.StatusOK {
+		return nil, fmt.Errorf("search for query %s failed with status %d: %s", objectPattern, response.Status, response.Error)
+	}
+
+	var names []string
+	if err := json.Unmarshal(response.Value, &names); err != nil {
+		return nil, fmt.Errorf("invalid search value for query %s: %s", objectPattern, err)
+	}
+
+	return names, nil
+}
+
+// addReadValue flattens the attributes of a bean read into result. With
+// ignoreErrors, the requested attributes that the bean doesn't have come
+// back as error messages, which are left out
+func addReadValue(result map[string]interface{}, response jolokiaResponse, requested []string) error {
+	if response.Status != http.StatusOK {
+		// The bean may have been unregistered between the search and the read
+		logger.Warnf("Jolokia failed to read bean %s: %s", response.Request.MBean, response.Error)
+		return nil
+	}
+
+	var attributes map[string]interface{}
+	if err := json.Unmarshal(response.Value, &attributes); err != nil {
+		return fmt.Errorf("invalid read value for bean %s: %s", response.Request.MBean, err)
+	}
+
+	missing := func(attrName string, attrValue interface{}) bool {
+		message, ok := attrValue.(string)
+		if !ok || !strings.HasPrefix(message, jolokiaErrorPrefix) {
+			return false
+		}
+		for _, name := range requested {
+			if name == attrName {
+				return true
+			}
+		}
+		return false
+	}
+	for attrName, attrValue := range attributes {
+		if missing(attrName, attrValue) {
+			logger.Debugf("Skipping attribute %s of bean %s: %s", attrName, response.Request.MBean, attrValue)
+			continue
+		}
+		flattenAttributeValue(result, response.Request.MBean, attrName, attrValue)
+	}
+	return nil
+}
+
+// post sends a bulk request to the agent and decodes the bulk response
+func (c *jolokiaClient) post(ctx context.Context, requests []jolokiaRequest) ([]jolokiaResponse, error) {
+	body, err := json.Marshal(requests)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if c.user != "" && c.password != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	// Transport errors and timeouts may not happen again, but an agent that
+	// rejects the credentials keeps rejecting them
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, retriable(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, retriable(fmt.Errorf("unexpected HTTP status %s", resp.Status))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, retriable(err)
+	}
+
+	var responses []jolokiaResponse
+	if err := json.Unmarshal(respBody, &responses); err != nil {
+		return nil, fmt.Errorf("invalid Jolokia response: %s", err)
+	}
+
+	return responses, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/kr/pretty"
+)
+
+// fakeJolokia serves a Jolokia bulk endpoint backed by a static map of
+// search pattern to bean names and of bean name to attribute values
+func fakeJolokia(t *testing.T, searches map[string][]string, beans map[string]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(fakeJolokiaHandler(t, searches, beans))
+}
+
+func fakeJolokiaHandler(t *testing.T, searches map[string][]string, beans map[string]map[string]interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var requests []jolokiaRequest
+		if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
+			t.Errorf("Unexpected request body: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var responses []map[string]interface{}
+		for _, req := range requests {
+			response := map[string]interface{}{"request": req, "status": 200}
+			switch req.Type {
+			case "search":
+				names, ok := searches[req.MBean]
+				if !ok {
+					names = []string{}
+				}
+				response["value"] = names
+			case "version":
+				response["value"] = map[string]interface{}{"agent": "1.6.0", "protocol": "7.2"}
+			case "read":
+				attrs, ok := beans[req.MBean]
+				if !ok {
+					response["status"] = 404
+					response["error"] = "javax.management.InstanceNotFoundException"
+				}
+				if len(req.Attribute) != 0 {
+					requested := make(map[string]interface{})
+					for _, attr := range req.Attribute {
+						value, ok := attrs[attr]
+						if !ok {
+							value = "ERROR: javax.management.AttributeNotFoundException : No such attribute: " + attr
+						}
+						requested[attr] = value
+					}
+					response["value"] = requested
+					break
+				}
+				response["value"] = attrs
+			}
+			responses = append(responses, response)
+		}
+
+		_ = json.NewEncoder(w).Encode(responses)
+	})
+}
+
+func TestJolokiaQuery(t *testing.T) {
+	searches := map[string][]string{
+		"java.lang:type=GarbageCollector,*": {"java.lang:name=Copy,type=GarbageCollector", "java.lang:name=Gone,type=GarbageCollector"},
+	}
+	server := fakeJolokia(t, searches, map[string]map[string]interface{}{
+		"java.lang:name=Copy,type=GarbageCollector": {
+			"CollectionCount": 12,
+			"Valid":           true,
+			"MemoryPoolNames": []string{"Eden Space"},
+			"LastGcInfo": map[string]interface{}{
+				"duration": 3,
+				"id":       nil,
+			},
+		},
+		"java.lang:type=Memory": {
+			"HeapMemoryUsage": map[string]interface{}{"used": 100},
+		},
+	})
+	defer server.Close()
+
+	c, err := newJolokiaClient(server.URL, "admin", "admin", 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.query("java.lang:type=GarbageCollector,*", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"java.lang:name=Copy,type=GarbageCollector,attr=CollectionCount":     12.0,
+		"java.lang:name=Copy,type=GarbageCollector,attr=Valid":               true,
+		"java.lang:name=Copy,type=GarbageCollector,attr=LastGcInfo.Duration": 3.0,
+	}
+	if !reflect.DeepEqual(expected, result) {
+		fmt.Println(pretty.Diff(expected, result))
+		t.Error("Failed to produce expected result")
+	}
+}
+
+func TestJolokiaQueryAttributes(t *testing.T) {
+	searches := map[string][]string{
+		"java.lang:type=Memory":                              {"java.lang:type=Memory"},
+		"kafka.consumer:type=consumer-fetch-manager-metrics": {"kafka.consumer:type=consumer-fetch-manager-metrics"},
+	}
+	server := fakeJolokia(t, searches, map[string]map[string]interface{}{
+		"java.lang:type=Memory": {
+			"HeapMemoryUsage":    map[string]interface{}{"used": 100},
+			"NonHeapMemoryUsage": map[string]interface{}{"used": 50},
+			"Verbose":            false,
+		},
+		"kafka.consumer:type=consumer-fetch-manager-metrics": {
+			"records.lag.max": 7,
+		},
+	})
+	defer server.Close()
+
+	c, _ := newJolokiaClient(server.URL, "", "", 1000, nil)
+	result, err := c.queryAttributes("java.lang:type=Memory", []string{"HeapMemoryUsage.Used", "HeapMemoryUsage"}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"java.lang:type=Memory,attr=HeapMemoryUsage.Used": 100.0}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	// The prefixes of a dotted attribute name that the bean doesn't have
+	// are answered with errors, which are left out
+	result, err = c.queryAttributes("kafka.consumer:type=consumer-fetch-manager-metrics", []string{"records.lag.max", "records.lag", "records"}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]interface{}{"kafka.consumer:type=consumer-fetch-manager-metrics,attr=records.lag.max": 7.0}; !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestJolokiaQueryHTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	c, _ := newJolokiaClient(server.URL, "admin", "wrong", 1000, nil)
+	if err := c.open(); err == nil {
+		t.Error("Expected error for unauthorized request")
+	}
+	if _, err := c.query("java.lang:type=Memory", 1000); err == nil {
+		t.Error("Expected error for unauthorized request")
+	}
+}
+
+func TestNewJolokiaClientNoURL(t *testing.T) {
+	if _, err := newJolokiaClient("", "", "", 1000, nil); err == nil {
+		t.Error("Expected error when jolokia_url is unset")
+	}
+}
+
+func TestJolokiaClientTLS(t *testing.T) {
+	server := httptest.NewTLSServer(fakeJolokiaHandler(t, nil, nil))
+	defer server.Close()
+
+	trusted := &pemTLS{caCerts: []*x509.Certificate{server.Certificate()}}
+	c, _ := newJolokiaClient(server.URL, "", "", 1000, trusted.config())
+	if err := c.open(); err != nil {
+		t.Errorf("Expected the CA file to verify the agent: %s", err)
+	}
+
+	c, _ = newJolokiaClient(server.URL, "", "", 1000, nil)
+	if err := c.open(); err == nil {
+		t.Error("Expected the agent certificate to be rejected by the system roots")
+	}
+}
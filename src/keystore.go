@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	jksMagic          = 0xfeedfeed
+	jksVersion        = 2
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+	// jksDigestWhitener is mixed into the integrity digest of every JKS file
+	jksDigestWhitener = "Mighty Aphrodite"
+	jksCertType       = "X.509"
+)
+
+// errNotJKS is returned when checking the password of a keystore that is not
+// in the JKS format, such as PKCS12
+var errNotJKS = errors.New("not a JKS keystore")
+
+// jksKeyProtectorOID identifies the proprietary JKS private key encryption,
+// implemented by sun.security.provider.KeyProtector
+var jksKeyProtectorOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// tempKeyStores are Java keystores written from PEM files for nrjmx. They
+// live in a private temporary directory that must be removed with remove
+type tempKeyStores struct {
+	dir        string
+	keyStore   string
+	trustStore string
+	password   string
+}
+
+// writeTempKeyStores converts the PEM certificates to a JKS truststore and
+// keystore protected by a random password. The keystore is empty when no
+// client certificate is configured
+func writeTempKeyStores(p *pemTLS) (*tempKeyStores, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	password := hex.EncodeToString(secret)
+	registerSecret(password)
+
+	trustStore := newJKSWriter()
+	for i, cert := range p.caCerts {
+		trustStore.addTrustedCert(fmt.Sprintf("ca-%d", i), cert.Raw)
+	}
+	keyStore := newJKSWriter()
+	if p.cert != nil {
+		key, err := x509.MarshalPKCS8PrivateKey(p.cert.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("encoding tls_key_file: %s", err)
+		}
+		if err := keyStore.addPrivateKey("client", key, p.cert.Certificate, password); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "nri-jmx-tls")
+	if err != nil {
+		return nil, err
+	}
+	k := &tempKeyStores{
+		dir:        dir,
+		keyStore:   filepath.Join(dir, "keystore.jks"),
+		trustStore: filepath.Join(dir, "truststore.jks"),
+		password:   password,
+	}
+	if err := ioutil.WriteFile(k.trustStore, trustStore.bytes(password), 0600); err != nil {
+		k.remove()
+		return nil, err
+	}
+	if err := ioutil.WriteFile(k.keyStore, keyStore.bytes(password), 0600); err != nil {
+		k.remove()
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// remove deletes the keystores and their directory
+func (k *tempKeyStores) remove() {
+	_ = os.RemoveAll(k.dir)
+}
+
+// jksWriter builds a keystore in the JKS format read by every JVM since
+// Java 1.2, and by the PKCS12 keystore type in compatibility mode
+type jksWriter struct {
+	entries   bytes.Buffer
+	count     uint32
+	timestamp int64
+}
+
+func newJKSWriter() *jksWriter {
+	return &jksWriter{timestamp: time.Now().UnixNano() / int64(time.Millisecond)}
+}
+
+func (j *jksWriter) writeUTF(s string) {
+	b := encodeModifiedUTF8(s)
+	_ = binary.Write(&j.entries, binary.BigEndian, uint16(len(b)))
+	j.entries.Write(b)
+}
+
+func (j *jksWriter) writeCert(der []byte) {
+	j.writeUTF(jksCertType)
+	_ = binary.Write(&j.entries, binary.BigEndian, uint32(len(der)))
+	j.entries.Write(der)
+}
+
+func (j *jksWriter) addTrustedCert(alias string, der []byte) {
+	_ = binary.Write(&j.entries, binary.BigEndian, uint32(jksTrustedCertTag))
+	j.writeUTF(alias)
+	_ = binary.Write(&j.entries, binary.BigEndian, j.timestamp)
+	j.writeCert(der)
+	j.count++
+}
+
+// addPrivateKey adds a PKCS8 encoded key and its certificate chain. The key
+// is protected with the keystore password, as Java key managers expect
+func (j *jksWriter) addPrivateKey(alias string, pkcs8 []byte, chain [][]byte, password string) error {
+	protected, err := jksProtectKey(pkcs8, password)
+	if err != nil {
+		return err
+	}
+	encoded, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: jksKeyProtectorOID, Parameters: asn1.NullRawValue},
+		EncryptedData: protected,
+	})
+	if err != nil {
+		return err
+	}
+
+	_ = binary.Write(&j.entries, binary.BigEndian, uint32(jksPrivateKeyTag))
+	j.writeUTF(alias)
+	_ = binary.Write(&j.entries, binary.BigEndian, j.timestamp)
+	_ = binary.Write(&j.entries, binary.BigEndian, uint32(len(encoded)))
+	j.entries.Write(encoded)
+	_ = binary.Write(&j.entries, binary.BigEndian, uint32(len(chain)))
+	for _, der := range chain {
+		j.writeCert(der)
+	}
+	j.count++
+
+	return nil
+}
+
+// bytes returns the keystore followed by its integrity digest
+func (j *jksWriter) bytes(password string) []byte {
+	var out bytes.Buffer
+	_ = binary.Write(&out, binary.BigEndian, uint32(jksMagic))
+	_ = binary.Write(&out, binary.BigEndian, uint32(jksVersion))
+	_ = binary.Write(&out, binary.BigEndian, j.count)
+	out.Write(j.entries.Bytes())
+
+	out.Write(jksDigest(password, out.Bytes()))
+	return out.Bytes()
+}
+
+// jksPassword encodes a password the way JKS hashes it: two big-endian
+// bytes per UTF-16 code unit
+func jksPassword(password string) []byte {
+	var b []byte
+	for _, r := range password {
+		if r > 0xffff {
+			hi, lo := 0xd800+((r-0x10000)>>10), 0xdc00+((r-0x10000)&0x3ff)
+			b = append(b, byte(hi>>8), byte(hi), byte(lo>>8), byte(lo))
+			continue
+		}
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return b
+}
+
+func jksDigest(password string, data []byte) []byte {
+	h := sha1.New()
+	h.Write(jksPassword(password))
+	h.Write([]byte(jksDigestWhitener))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// checkJKSPassword verifies a password against the integrity digest that
+// ends a JKS file. Other keystore formats return errNotJKS
+func checkJKSPassword(content []byte, password string) error {
+	if len(content) < 4+sha1.Size || binary.BigEndian.Uint32(content) != jksMagic {
+		return errNotJKS
+	}
+	body, digest := content[:len(content)-sha1.Size], content[len(content)-sha1.Size:]
+	if !bytes.Equal(jksDigest(password, body), digest) {
+		return errors.New("keystore was tampered with, or password was incorrect")
+	}
+	return nil
+}
+
+// jksProtectKey encrypts a key with the JKS key protector: the key is XORed
+// with a SHA-1 based keystream seeded by a random salt, and followed by a
+// SHA-1 checksum of the password and the plain key
+func jksProtectKey(plain []byte, password string) ([]byte, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	pass := jksPassword(password)
+
+	protected := append([]byte{}, salt...)
+	digest := salt
+	for i := 0; i < len(plain); i += sha1.Size {
+		h := sha1.New()
+		h.Write(pass)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(plain); j++ {
+			protected = append(protected, plain[i+j]^digest[j])
+		}
+	}
+
+	h := sha1.New()
+	h.Write(pass)
+	h.Write(plain)
+	return h.Sum(protected), nil
+}
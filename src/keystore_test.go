@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// readTestJKS checks the integrity digest of a JKS file and returns its
+// entries by alias: certificates for trusted entries, and the decrypted
+// PKCS8 key for private key entries
+func readTestJKS(t *testing.T, content []byte, password string) map[string][]byte {
+	data, digest := content[:len(content)-sha1.Size], content[len(content)-sha1.Size:]
+	if !bytes.Equal(jksDigest(password, data), digest) {
+		t.Fatal("Invalid keystore digest")
+	}
+
+	r := bytes.NewReader(data)
+	var header struct{ Magic, Version, Count uint32 }
+	_ = binary.Read(r, binary.BigEndian, &header)
+	if header.Magic != jksMagic || header.Version != jksVersion {
+		t.Fatalf("Invalid keystore header %+v", header)
+	}
+
+	readUTF := func() string {
+		var length uint16
+		_ = binary.Read(r, binary.BigEndian, &length)
+		b := make([]byte, length)
+		_, _ = r.Read(b)
+		return string(b)
+	}
+	readBytes := func() []byte {
+		var length uint32
+		_ = binary.Read(r, binary.BigEndian, &length)
+		b := make([]byte, length)
+		_, _ = r.Read(b)
+		return b
+	}
+
+	entries := make(map[string][]byte)
+	for i := uint32(0); i < header.Count; i++ {
+		var tag uint32
+		var timestamp int64
+		_ = binary.Read(r, binary.BigEndian, &tag)
+		alias := readUTF()
+		_ = binary.Read(r, binary.BigEndian, &timestamp)
+
+		switch tag {
+		case jksTrustedCertTag:
+			if certType := readUTF(); certType != jksCertType {
+				t.Fatalf("Unexpected certificate type %s", certType)
+			}
+			entries[alias] = readBytes()
+		case jksPrivateKeyTag:
+			var info encryptedPrivateKeyInfo
+			if _, err := asn1.Unmarshal(readBytes(), &info); err != nil {
+				t.Fatal(err)
+			}
+			if !info.Algorithm.Algorithm.Equal(jksKeyProtectorOID) {
+				t.Fatalf("Unexpected key algorithm %s", info.Algorithm.Algorithm)
+			}
+			entries[alias] = unprotectTestKey(t, info.EncryptedData, password)
+
+			var chainLength uint32
+			_ = binary.Read(r, binary.BigEndian, &chainLength)
+			for j := uint32(0); j < chainLength; j++ {
+				readUTF()
+				readBytes()
+			}
+		default:
+			t.Fatalf("Unexpected entry tag %d", tag)
+		}
+	}
+
+	return entries
+}
+
+// unprotectTestKey reverses jksProtectKey the way sun.security.provider.KeyProtector.recover does
+func unprotectTestKey(t *testing.T, protected []byte, password string) []byte {
+	salt := protected[:sha1.Size]
+	encrypted := protected[sha1.Size : len(protected)-sha1.Size]
+	checksum := protected[len(protected)-sha1.Size:]
+
+	plain := make([]byte, len(encrypted))
+	digest := salt
+	for i := 0; i < len(encrypted); i += sha1.Size {
+		h := sha1.New()
+		h.Write(jksPassword(password))
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(encrypted); j++ {
+			plain[i+j] = encrypted[i+j] ^ digest[j]
+		}
+	}
+
+	h := sha1.New()
+	h.Write(jksPassword(password))
+	h.Write(plain)
+	if !bytes.Equal(h.Sum(nil), checksum) {
+		t.Fatal("Invalid key checksum")
+	}
+	return plain
+}
+
+func TestWriteTempKeyStores(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nri-jmx-pem")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	p, err := loadPEMTLS(writeTestPEM(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := writeTempKeyStores(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(k.dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected a private directory, got %v %v", info, err)
+	}
+
+	trustStore, _ := ioutil.ReadFile(k.trustStore)
+	if entries := readTestJKS(t, trustStore, k.password); !bytes.Equal(entries["ca-0"], p.caCerts[0].Raw) {
+		t.Error("Expected the CA certificate in the truststore")
+	}
+
+	keyStore, _ := ioutil.ReadFile(k.keyStore)
+	key := readTestJKS(t, keyStore, k.password)["client"]
+	if expected, _ := x509.MarshalPKCS8PrivateKey(p.cert.PrivateKey); !bytes.Equal(key, expected) {
+		t.Error("Expected the client key in the keystore")
+	}
+	if redact(k.password) != redactedMask {
+		t.Error("Expected the keystore password to be redacted")
+	}
+
+	k.remove()
+	if _, err := os.Stat(k.dir); !os.IsNotExist(err) {
+		t.Errorf("Expected the keystores to be removed, got %v", err)
+	}
+}
+
+func TestJKSPassword(t *testing.T) {
+	if b := jksPassword("aé\U0001F600"); !bytes.Equal(b, []byte{0, 'a', 0, 0xe9, 0xd8, 0x3d, 0xde, 0x00}) {
+		t.Errorf("Unexpected UTF-16 encoding %x", b)
+	}
+}
+
+func TestCheckJKSPassword(t *testing.T) {
+	j := newJKSWriter()
+	j.addTrustedCert("ca", []byte("not a real certificate"))
+	content := j.bytes("changeit")
+
+	if err := checkJKSPassword(content, "changeit"); err != nil {
+		t.Errorf("Expected the password to match, got %s", err)
+	}
+	if err := checkJKSPassword(content, "wrong"); err == nil || err == errNotJKS {
+		t.Errorf("Expected a password mismatch, got %v", err)
+	}
+	if err := checkJKSPassword([]byte("0\x82\x01\x00 PKCS12 keystore bytes"), "changeit"); err != errNotJKS {
+		t.Errorf("Expected errNotJKS for a PKCS12 file, got %v", err)
+	}
+}
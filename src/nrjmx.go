@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNrjmxCommand = "/usr/bin/nrjmx"
+	// nrjmxLineBuffer is the largest response nrjmx may write for a single
+	// query. Larger responses are split into one query per bean
+	nrjmxLineBuffer = 4 * 1024 * 1024
+	// nrjmxSplitChunk is the number of bean queries sent at once when a
+	// response is split
+	nrjmxSplitChunk = 100
+)
+
+var (
+	// errNrjmxNotRunning is returned when querying a client whose nrjmx
+	// process was never started or has already exited
+	errNrjmxNotRunning = errors.New("nrjmx is not running")
+	// errResponseTooLarge is returned by the reader when a response doesn't
+	// fit in the line buffer
+	errResponseTooLarge = errors.New("response too large")
+)
+
+// beanLister lists the beans matched by a query, so that a query whose
+// response is too large for nrjmx can be split into one query per bean
+type beanLister interface {
+	open() error
+	listNames(objectPattern string, timeout int) ([]string, error)
+	close()
+}
+
+// jmxClient is a connection to a single JVM. Each backend provides its own
+// implementation, and every target owns its own client
+type jmxClient interface {
+	// open establishes the connection
+	open() error
+	// query returns the flattened attributes of the beans matching
+	// objectPattern, waiting up to timeout milliseconds
+	query(objectPattern string, timeout int) (map[string]interface{}, error)
+	// close releases the connection. It is safe to call more than once
+	close()
+}
+
+// nrjmxConfig holds the connection settings passed to nrjmx
+type nrjmxConfig struct {
+	// url is passed instead of hostname, port and remote when set
+	url                *jmxServiceURL
+	hostname           string
+	port               string
+	username           string
+	password           string
+	keyStore           string
+	keyStorePassword   string
+	trustStore         string
+	trustStorePassword string
+	remote             bool
+	// tls holds PEM certificates that are converted to temporary keystores
+	// every time nrjmx starts
+	tls *pemTLS
+}
+
+func (cfg *nrjmxConfig) isSSL() bool {
+	return cfg.keyStore != "" && cfg.keyStorePassword != "" && cfg.trustStore != "" && cfg.trustStorePassword != ""
+}
+
+// command returns the nrjmx command line. NR_JMX_TOOL overrides the path of
+// the tool, as it does in the SDK
+func (cfg *nrjmxConfig) command() []string {
+	var c []string
+	if tool := os.Getenv("NR_JMX_TOOL"); tool != "" {
+		c = strings.Split(tool, " ")
+	} else {
+		c = []string{defaultNrjmxCommand}
+	}
+
+	if cfg.url != nil {
+		c = append(c, "--connURL", cfg.url.raw)
+	} else {
+		c = append(c, "--hostname", cfg.hostname, "--port", cfg.port)
+	}
+	if cfg.username != "" && cfg.password != "" {
+		c = append(c, "--username", cfg.username, "--password", cfg.password)
+	}
+	if cfg.remote && cfg.url == nil {
+		c = append(c, "--remote")
+	}
+	if cfg.isSSL() {
+		c = append(c, "--keyStore", cfg.keyStore, "--keyStorePassword", cfg.keyStorePassword, "--trustStore", cfg.trustStore, "--trustStorePassword", cfg.trustStorePassword)
+	}
+
+	return c
+}
+
+// nrjmxClient is a jmxClient backed by its own nrjmx subprocess. Unlike the
+// SDK jmx package, all the process state lives in the client, so several
+// clients can run side by side
+type nrjmxClient struct {
+	config nrjmxConfig
+
+	lock    sync.Mutex
+	cmd     *exec.Cmd
+	cancel  context.CancelFunc
+	stdin   io.WriteCloser
+	scanner *bufio.Scanner
+	stderr  bytes.Buffer
+	// exited is closed once the process has been waited for, and exitErr
+	// holds the reason it exited
+	exited  chan struct{}
+	exitErr error
+
+	// maxLine is the size of the line buffer, replaced in tests
+	maxLine int
+	// lister lists the beans of the queries whose response is too large. It
+	// is nil when the target can't be reached without nrjmx
+	lister     beanLister
+	listerOpen bool
+}
+
+func newNrjmxClient(config nrjmxConfig) *nrjmxClient {
+	return &nrjmxClient{config: config, maxLine: nrjmxLineBuffer}
+}
+
+// open starts the nrjmx process. Connection errors are only reported by
+// nrjmx when it exits, so they surface on the first query
+func (c *nrjmxClient) open() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cmd != nil {
+		return errors.New("nrjmx is already running for this client")
+	}
+
+	config := c.config
+	var keyStores *tempKeyStores
+	if config.tls != nil {
+		var err error
+		if keyStores, err = writeTempKeyStores(config.tls); err != nil {
+			return fmt.Errorf("converting PEM files to keystores: %s", err)
+		}
+		config.keyStore, config.trustStore = keyStores.keyStore, keyStores.trustStore
+		config.keyStorePassword, config.trustStorePassword = keyStores.password, keyStores.password
+	}
+
+	cliCommand := config.command()
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, cliCommand[0], cliCommand[1:]...)
+
+	fail := func(err error) error {
+		cancel()
+		if keyStores != nil {
+			keyStores.remove()
+		}
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fail(err)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fail(err)
+	}
+	c.stderr.Reset()
+	cmd.Stderr = &c.stderr
+
+	if err := cmd.Start(); err != nil {
+		return fail(err)
+	}
+
+	c.cmd = cmd
+	c.cancel = cancel
+	c.stdin = stdin
+	c.scanner = bufio.NewScanner(stdout)
+	c.scanner.Buffer([]byte{}, c.maxLine)
+	c.exited = make(chan struct{})
+	c.exitErr = nil
+
+	go c.wait(cmd, keyStores, c.exited)
+
+	return nil
+}
+
+// wait reaps the process and removes its temporary keystores, if any
+func (c *nrjmxClient) wait(cmd *exec.Cmd, keyStores *tempKeyStores, exited chan struct{}) {
+	err := cmd.Wait()
+	if keyStores != nil {
+		keyStores.remove()
+	}
+
+	c.lock.Lock()
+	if err != nil {
+		c.exitErr = fmt.Errorf("nrjmx exited with error: %s [state: %s] (%s)", err, cmd.ProcessState, strings.TrimSpace(c.stderr.String()))
+	} else {
+		c.exitErr = errNrjmxNotRunning
+	}
+	if c.cmd == cmd {
+		c.cmd = nil
+	}
+	c.lock.Unlock()
+
+	close(exited)
+}
+
+// query writes objectPattern to nrjmx and waits for its one-line JSON
+// response. On timeout the process is stopped, as a late response would
+// otherwise be read as the answer to the next query
+func (c *nrjmxClient) query(objectPattern string, timeout int) (map[string]interface{}, error) {
+	results, errs := c.queryBatch([]string{objectPattern}, nil, timeout)
+	return results[0], errs[0]
+}
+
+func (c *nrjmxClient) batching() bool {
+	return true
+}
+
+// queryBatch writes all the objectPatterns to nrjmx at once and reads their
+// responses in order, as nrjmx answers every line it reads with one line.
+// Each response must arrive within timeout milliseconds of the previous one.
+// When a response fails, the queries after it fail too. nrjmx always reads
+// every attribute, so attrNames is ignored
+func (c *nrjmxClient) queryBatch(objectPatterns []string, attrNames [][]string, timeout int) ([]map[string]interface{}, []error) {
+	return c.pipeline(objectPatterns, timeout, true)
+}
+
+// pipeline is queryBatch. When split is set, a response too large for the
+// line buffer is split into one query per bean
+func (c *nrjmxClient) pipeline(objectPatterns []string, timeout int, split bool) ([]map[string]interface{}, []error) {
+	results := make([]map[string]interface{}, len(objectPatterns))
+	errs := make([]error, len(objectPatterns))
+	failFrom := func(n int, err error) ([]map[string]interface{}, []error) {
+		errs[n] = err
+		for m := n + 1; m < len(objectPatterns); m++ {
+			errs[m] = notAnswered(objectPatterns[m], err)
+		}
+		return results, errs
+	}
+
+	c.lock.Lock()
+	if c.cmd == nil {
+		err := c.exitErr
+		c.lock.Unlock()
+		if err == nil {
+			err = errNrjmxNotRunning
+		}
+		return failFrom(0, exitError(err))
+	}
+	stdin, scanner, exited := c.stdin, c.scanner, c.exited
+	c.lock.Unlock()
+
+	// Both channels are buffered so that the goroutines never block once
+	// we stop waiting for them
+	lines := make(chan []byte, len(objectPatterns))
+	readErrors := make(chan error, 2)
+	go func() {
+		var b bytes.Buffer
+		for _, objectPattern := range objectPatterns {
+			fmt.Fprintf(&b, "%s\n", objectPattern)
+		}
+		if _, err := stdin.Write(b.Bytes()); err != nil {
+			readErrors <- retriable(fmt.Errorf("writing query string: %s", err))
+		}
+	}()
+	go func() {
+		for range objectPatterns {
+			if !scanner.Scan() {
+				if err := scanner.Err(); err == bufio.ErrTooLong {
+					readErrors <- errResponseTooLarge
+				} else if err != nil {
+					readErrors <- fmt.Errorf("error reading output from nrjmx: %s", err)
+				} else {
+					readErrors <- retriable(errors.New("got an EOF while reading nrjmx output"))
+				}
+				return
+			}
+			// The scanner reuses its buffer on the next line
+			lines <- append([]byte{}, scanner.Bytes()...)
+		}
+	}()
+
+	for n, objectPattern := range objectPatterns {
+		// Responses already read are used even if nrjmx has exited since
+		var line []byte
+		received := true
+		select {
+		case line = <-lines:
+		default:
+			received = false
+		}
+		if !received {
+			select {
+			case line = <-lines:
+			case err := <-readErrors:
+				if err == errResponseTooLarge {
+					// The rest of the response is still in the output of
+					// nrjmx, which has to be restarted
+					c.stop()
+					if restartErr := c.open(); restartErr != nil {
+						return failFrom(n, restartErr)
+					}
+					if split {
+						results[n], errs[n] = c.querySplit(objectPattern, timeout)
+					} else {
+						errs[n] = fmt.Errorf("the response to %s is larger than %d bytes", objectPattern, c.maxLine)
+					}
+					if n+1 < len(objectPatterns) {
+						rest, restErrs := c.pipeline(objectPatterns[n+1:], timeout, split)
+						copy(results[n+1:], rest)
+						copy(errs[n+1:], restErrs)
+					}
+					return results, errs
+				}
+				// Prefer the exit reason, which includes the nrjmx error output
+				select {
+				case <-exited:
+					c.lock.Lock()
+					err = exitError(c.exitErr)
+					c.lock.Unlock()
+				case <-time.After(100 * time.Millisecond):
+				}
+				return failFrom(n, err)
+			case <-exited:
+				c.lock.Lock()
+				err := exitError(c.exitErr)
+				c.lock.Unlock()
+				return failFrom(n, err)
+			case <-time.After(time.Duration(timeout) * time.Millisecond):
+				c.stop()
+				return failFrom(n, retriable(fmt.Errorf("timeout while waiting for query: %s", objectPattern)))
+			}
+		}
+
+		var result map[string]interface{}
+		if err := json.Unmarshal(line, &result); err != nil {
+			errs[n] = fmt.Errorf("invalid return value for query: %s, %s", objectPattern, err)
+			continue
+		}
+		results[n] = result
+	}
+
+	return results, errs
+}
+
+// querySplit runs a query whose response is too large for the line buffer
+// as one query per bean, with the names listed by the lister, and merges
+// their responses
+func (c *nrjmxClient) querySplit(objectPattern string, timeout int) (map[string]interface{}, error) {
+	if c.lister == nil {
+		return nil, fmt.Errorf("the response to %s is larger than %d bytes, and its beans can't be listed without nrjmx to query them one at a time: use narrower queries", objectPattern, c.maxLine)
+	}
+
+	c.lock.Lock()
+	if !c.listerOpen {
+		if err := c.lister.open(); err != nil {
+			c.lock.Unlock()
+			return nil, annotate(err, "listing the beans of %s, whose response is larger than %d bytes", objectPattern, c.maxLine)
+		}
+		c.listerOpen = true
+	}
+	c.lock.Unlock()
+
+	names, err := c.lister.listNames(objectPattern, timeout)
+	if err != nil {
+		return nil, annotate(err, "listing the beans of %s, whose response is larger than %d bytes", objectPattern, c.maxLine)
+	}
+	logger.Infof("The response to %s is larger than %d bytes, querying its %d beans one at a time", objectPattern, c.maxLine, len(names))
+
+	result := make(map[string]interface{})
+	for start := 0; start < len(names); start += nrjmxSplitChunk {
+		chunk := names[start:]
+		if len(chunk) > nrjmxSplitChunk {
+			chunk = chunk[:nrjmxSplitChunk]
+		}
+		// A single bean can't be split further
+		responses, errs := c.pipeline(chunk, timeout, false)
+		for n, response := range responses {
+			if errs[n] != nil {
+				return nil, annotate(errs[n], "querying the beans of %s one at a time", objectPattern)
+			}
+			for key, value := range response {
+				result[key] = value
+			}
+		}
+	}
+	return result, nil
+}
+
+// exitError classifies the reason nrjmx exited. A new process can get past a
+// lost connection, but not past rejected credentials
+func exitError(err error) error {
+	if err == nil || isAuthFailure(err.Error()) {
+		return err
+	}
+	return retriable(err)
+}
+
+// close ends the nrjmx process, and the connection of the lister if it was
+// opened
+func (c *nrjmxClient) close() {
+	c.stop()
+
+	c.lock.Lock()
+	listerOpen := c.listerOpen
+	c.listerOpen = false
+	c.lock.Unlock()
+	if listerOpen {
+		c.lister.close()
+	}
+}
+
+// stop ends the nrjmx process by closing its standard input and cancelling
+// it, then waits for it to exit
+func (c *nrjmxClient) stop() {
+	c.lock.Lock()
+	if c.cmd == nil {
+		c.lock.Unlock()
+		return
+	}
+	c.cancel()
+	_ = c.stdin.Close()
+	exited := c.exited
+	c.lock.Unlock()
+
+	<-exited
+}
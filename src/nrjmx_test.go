@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestNrjmxHelperProcess is not a real test. It stands in for the nrjmx
+// tool when the test binary is started by fakeNrjmx
+func TestNrjmxHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	hostname, keyStore := "", ""
+	for i, arg := range os.Args {
+		if arg == "--hostname" && i+1 < len(os.Args) {
+			hostname = os.Args[i+1]
+		}
+		if arg == "--keyStore" && i+1 < len(os.Args) {
+			keyStore = os.Args[i+1]
+		}
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		query := scanner.Text()
+		switch {
+		case strings.HasPrefix(query, "slow:"):
+			time.Sleep(time.Second)
+		case strings.HasPrefix(query, "fail:"):
+			fmt.Fprintln(os.Stderr, "SEVERE: connection refused")
+			os.Exit(1)
+		case strings.HasPrefix(query, "huge:"):
+			// Answer with a response larger than the test line buffer
+			hostname = strings.Repeat("x", 2048)
+		case strings.HasPrefix(query, "keystore:"):
+			// Answer with the keystore path, after checking that it exists
+			if _, err := os.Stat(keyStore); err == nil {
+				hostname = keyStore
+			}
+		}
+		fmt.Printf(`{"%s,attr=Host": "%s"}`+"\n", query, hostname)
+	}
+	os.Exit(0)
+}
+
+// fakeNrjmx points NR_JMX_TOOL to the helper process and returns a
+// function that restores the environment
+func fakeNrjmx() func() {
+	tool := os.Getenv("NR_JMX_TOOL")
+	_ = os.Setenv("NR_JMX_TOOL", os.Args[0]+" -test.run=TestNrjmxHelperProcess --")
+	_ = os.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	return func() {
+		_ = os.Setenv("NR_JMX_TOOL", tool)
+		_ = os.Unsetenv("GO_WANT_HELPER_PROCESS")
+	}
+}
+
+func TestNrjmxClientConcurrent(t *testing.T) {
+	defer fakeNrjmx()()
+
+	var wg sync.WaitGroup
+	for _, host := range []string{"jvm-a", "jvm-b", "jvm-c"} {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+
+			c := newNrjmxClient(nrjmxConfig{hostname: host, port: "9999"})
+			if err := c.open(); err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.close()
+
+			for i := 0; i < 3; i++ {
+				result, err := c.query("java.lang:type=Memory", 5000)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				expected := map[string]interface{}{"java.lang:type=Memory,attr=Host": host}
+				if !reflect.DeepEqual(expected, result) {
+					t.Errorf("Expected %v, got %v", expected, result)
+				}
+			}
+		}(host)
+	}
+	wg.Wait()
+}
+
+func TestNrjmxClientTimeout(t *testing.T) {
+	defer fakeNrjmx()()
+
+	c := newNrjmxClient(nrjmxConfig{hostname: "localhost", port: "9999"})
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	if _, err := c.query("slow:type=Memory", 100); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+	if _, err := c.query("java.lang:type=Memory", 1000); err == nil {
+		t.Error("Expected error when querying after a timeout")
+	}
+}
+
+func TestNrjmxClientExitError(t *testing.T) {
+	defer fakeNrjmx()()
+
+	c := newNrjmxClient(nrjmxConfig{hostname: "localhost", port: "9999"})
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	_, err := c.query("fail:type=Memory", 5000)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Expected exit error with nrjmx output, got %v", err)
+	}
+}
+
+func TestNrjmxCommand(t *testing.T) {
+	tool := os.Getenv("NR_JMX_TOOL")
+	_ = os.Unsetenv("NR_JMX_TOOL")
+	defer func() {
+		_ = os.Setenv("NR_JMX_TOOL", tool)
+	}()
+
+	config := nrjmxConfig{
+		hostname:           "localhost",
+		port:               "9999",
+		username:           "admin",
+		password:           "secret",
+		keyStore:           "/ks",
+		keyStorePassword:   "kspass",
+		trustStore:         "/ts",
+		trustStorePassword: "tspass",
+		remote:             true,
+	}
+	expected := []string{
+		defaultNrjmxCommand, "--hostname", "localhost", "--port", "9999", "--username", "admin", "--password", "secret", "--remote",
+		"--keyStore", "/ks", "--keyStorePassword", "kspass", "--trustStore", "/ts", "--trustStorePassword", "tspass",
+	}
+	if command := config.command(); !reflect.DeepEqual(expected, command) {
+		t.Errorf("Expected %v, got %v", expected, command)
+	}
+}
+
+func TestNrjmxCommandURL(t *testing.T) {
+	tool := os.Getenv("NR_JMX_TOOL")
+	_ = os.Unsetenv("NR_JMX_TOOL")
+	defer func() {
+		_ = os.Setenv("NR_JMX_TOOL", tool)
+	}()
+
+	u, err := parseJMXServiceURL("service:jmx:remote+http://wildfly.localnet:9990")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := nrjmxConfig{url: u, hostname: u.host, port: u.port, remote: true}
+	expected := []string{defaultNrjmxCommand, "--connURL", "service:jmx:remote+http://wildfly.localnet:9990"}
+	if command := config.command(); !reflect.DeepEqual(expected, command) {
+		t.Errorf("Expected %v, got %v", expected, command)
+	}
+}
+
+func TestNrjmxClientPEM(t *testing.T) {
+	defer fakeNrjmx()()
+
+	dir, _ := ioutil.TempDir("", "nri-jmx-pem")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	p, err := loadPEMTLS(writeTestPEM(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newNrjmxClient(nrjmxConfig{hostname: "localhost", port: "9999", tls: p})
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.query("keystore:type=Memory", 5000)
+	c.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyStore, _ := result["keystore:type=Memory,attr=Host"].(string)
+	if !strings.HasSuffix(keyStore, "keystore.jks") {
+		t.Fatalf("Expected nrjmx to get a temporary keystore, got %v", result)
+	}
+	if _, err := os.Stat(filepath.Dir(keyStore)); !os.IsNotExist(err) {
+		t.Errorf("Expected the keystores to be removed after close, got %v", err)
+	}
+}
+
+// fakeLister lists the beans of a query from a fixed map
+type fakeLister struct {
+	names  map[string][]string
+	opened int
+	closed int
+}
+
+func (l *fakeLister) open() error {
+	l.opened++
+	return nil
+}
+
+func (l *fakeLister) listNames(objectPattern string, timeout int) ([]string, error) {
+	names, ok := l.names[objectPattern]
+	if !ok {
+		return nil, fmt.Errorf("no beans for %s", objectPattern)
+	}
+	return names, nil
+}
+
+func (l *fakeLister) close() {
+	l.closed++
+}
+
+func TestNrjmxClientSplit(t *testing.T) {
+	defer fakeNrjmx()()
+
+	lister := &fakeLister{names: map[string][]string{
+		"huge:kafka.log:*": {"kafka.log:name=a", "kafka.log:name=b"},
+		"huge:kafka.net:*": {"huge:kafka.net:name=a"},
+	}}
+	c := newNrjmxClient(nrjmxConfig{hostname: "localhost", port: "9999"})
+	c.maxLine = 1024
+	c.lister = lister
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := []string{"huge:kafka.log:*", "java.lang:type=Memory", "huge:kafka.net:*", "java.lang:type=Threading"}
+	results, errs := c.queryBatch(patterns, nil, 5000)
+
+	expected := map[string]interface{}{
+		"kafka.log:name=a,attr=Host": "localhost",
+		"kafka.log:name=b,attr=Host": "localhost",
+	}
+	if errs[0] != nil || !reflect.DeepEqual(expected, results[0]) {
+		t.Errorf("Expected the split response %v, got %v, %v", expected, results[0], errs[0])
+	}
+	for _, n := range []int{1, 3} {
+		if errs[n] != nil || len(results[n]) != 1 {
+			t.Errorf("Expected %s to be answered after the split, got %v, %v", patterns[n], results[n], errs[n])
+		}
+	}
+	// A single bean whose response is too large can't be split further
+	if errs[2] == nil || !strings.Contains(errs[2].Error(), "larger than 1024 bytes") {
+		t.Errorf("Expected a bean too large to fail, got %v", errs[2])
+	}
+
+	c.close()
+	if lister.opened != 1 || lister.closed != 1 {
+		t.Errorf("Expected the lister to be opened and closed once, got %d and %d", lister.opened, lister.closed)
+	}
+}
+
+func TestNrjmxClientSplitWithoutLister(t *testing.T) {
+	defer fakeNrjmx()()
+
+	c := newNrjmxClient(nrjmxConfig{hostname: "localhost", port: "9999"})
+	c.maxLine = 1024
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	if _, err := c.query("huge:kafka.log:*", 5000); err == nil || !strings.Contains(err.Error(), "narrower queries") {
+		t.Errorf("Expected an error advising narrower queries, got %v", err)
+	}
+	if _, err := c.query("java.lang:type=Memory", 5000); err != nil {
+		t.Errorf("Expected nrjmx to be restarted, got %v", err)
+	}
+}
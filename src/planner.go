@@ -0,0 +1,231 @@
+package main
+
+import (
+	"strings"
+)
+
+// plannedQuery is a query sent to the client on behalf of all the bean
+// queries it answers
+type plannedQuery struct {
+	objectPattern string
+	// attrNames are the attributes read for all the bean queries, nil to
+	// read every attribute
+	attrNames []string
+	consumers []beanQuery
+}
+
+// objectNamePattern is a parsed ObjectName or ObjectName pattern
+type objectNamePattern struct {
+	domain     string
+	properties map[string]string
+	// listPattern is set when the key properties end with a "*", matching
+	// beans with more properties than the listed ones
+	listPattern bool
+}
+
+// parseObjectName splits an ObjectName into its domain and key properties.
+// It returns false for names it can't compare safely, such as those with
+// wildcards in the domain
+func parseObjectName(name string) (*objectNamePattern, bool) {
+	parts := strings.SplitN(name, ":", 2)
+	if len(parts) != 2 || strings.ContainsAny(parts[0], "*?") {
+		return nil, false
+	}
+
+	pattern := &objectNamePattern{domain: parts[0], properties: make(map[string]string)}
+	for _, property := range splitProperties(parts[1]) {
+		if property == "*" {
+			pattern.listPattern = true
+			continue
+		}
+		keyValue := strings.SplitN(property, "=", 2)
+		if len(keyValue) != 2 || keyValue[0] == "" {
+			return nil, false
+		}
+		pattern.properties[keyValue[0]] = keyValue[1]
+	}
+	return pattern, true
+}
+
+// splitProperties splits the key properties of an ObjectName on the commas
+// that are not inside a quoted value
+func splitProperties(properties string) []string {
+	var split []string
+	start, quoted := 0, false
+	for i := 0; i < len(properties); i++ {
+		switch properties[i] {
+		case '\\':
+			// Skip the escaped character of a quoted value
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				split = append(split, properties[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(split, properties[start:])
+}
+
+// subsumes reports whether every bean matched by inner is also matched by p
+func (p *objectNamePattern) subsumes(inner *objectNamePattern) bool {
+	if p.domain != inner.domain {
+		return false
+	}
+	if !p.listPattern && (inner.listPattern || len(inner.properties) != len(p.properties)) {
+		return false
+	}
+	for key, value := range p.properties {
+		innerValue, ok := inner.properties[key]
+		if !ok {
+			return false
+		}
+		if strings.ContainsAny(innerValue, "*?") {
+			// A value pattern is only covered by the same pattern or by "*"
+			if value != "*" && value != innerValue {
+				return false
+			}
+		} else if !globMatch(value, innerValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// globMatch matches value against an ObjectName value pattern, where "*"
+// matches any sequence of characters and "?" any single character
+func globMatch(pattern, value string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(value); i >= 0; i-- {
+				if globMatch(pattern[1:], value[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(value) == 0 {
+				return false
+			}
+		default:
+			if len(value) == 0 || pattern[0] != value[0] {
+				return false
+			}
+		}
+		pattern, value = pattern[1:], value[1:]
+	}
+	return len(value) == 0
+}
+
+// planQueries groups the bean queries that a single query can answer:
+// identical domain:query strings, possibly from different collection files,
+// and queries whose beans are all matched by another query's pattern. The
+// planned queries are ordered by their first bean query
+func planQueries(queries []beanQuery) []*plannedQuery {
+	var patterns []string
+	parsed := make(map[string]*objectNamePattern)
+	for _, q := range queries {
+		pattern := q.String()
+		if _, ok := parsed[pattern]; ok {
+			continue
+		}
+		parsed[pattern], _ = parseObjectName(pattern)
+		patterns = append(patterns, pattern)
+	}
+
+	// parent is a pattern that matches all the beans of another. Of two
+	// patterns that match the same beans, the first one is kept
+	parent := make(map[string]string)
+	for n, pattern := range patterns {
+		inner := parsed[pattern]
+		if inner == nil {
+			continue
+		}
+		for m, other := range patterns {
+			outer := parsed[other]
+			if m == n || outer == nil || !outer.subsumes(inner) {
+				continue
+			}
+			if !inner.subsumes(outer) || m < n {
+				parent[pattern] = other
+				break
+			}
+		}
+	}
+	root := func(pattern string) string {
+		for range patterns {
+			next, ok := parent[pattern]
+			if !ok {
+				break
+			}
+			pattern = next
+		}
+		return pattern
+	}
+
+	var plan []*plannedQuery
+	planned := make(map[string]*plannedQuery)
+	for _, q := range queries {
+		pattern := root(q.String())
+		p, ok := planned[pattern]
+		if !ok {
+			p = &plannedQuery{objectPattern: pattern}
+			planned[pattern] = p
+			plan = append(plan, p)
+		}
+		if pattern != q.String() {
+			logger.Debugf("Request %s is answered by the query %s", q, pattern)
+		}
+		p.consumers = append(p.consumers, q)
+	}
+
+	for _, p := range plan {
+		p.attrNames = mergeAttributeNames(p.consumers)
+	}
+	return plan
+}
+
+// mergeAttributeNames returns the attributes read by all the bean queries,
+// or nil if one of them reads every attribute
+func mergeAttributeNames(queries []beanQuery) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, q := range queries {
+		requested := q.request.attributeNames()
+		if requested == nil {
+			return nil
+		}
+		for _, name := range requested {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// consumerResponse returns the part of the response of a planned query that
+// answers q. It is a copy, as handleResponse removes the excluded beans
+func (p *plannedQuery) consumerResponse(q beanQuery, response map[string]interface{}) queryResponse {
+	result := make(queryResponse, len(response))
+	pattern, filter := parseObjectName(q.String())
+	filter = filter && q.String() != p.objectPattern
+	for key, value := range response {
+		if filter {
+			end := strings.LastIndex(key, ",attr=")
+			if end == -1 {
+				continue
+			}
+			bean, ok := parseObjectName(key[:end])
+			if !ok || !pattern.subsumes(bean) {
+				continue
+			}
+		}
+		result[key] = value
+	}
+	return result
+}
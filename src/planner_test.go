@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+func TestObjectNameSubsumes(t *testing.T) {
+	testCases := []struct {
+		outer    string
+		inner    string
+		subsumes bool
+	}{
+		{"java.lang:type=Memory", "java.lang:type=Memory", true},
+		{"java.lang:type=GarbageCollector,*", "java.lang:type=GarbageCollector,name=Copy", true},
+		{"java.lang:*", "java.lang:type=GarbageCollector,name=*", true},
+		{"java.lang:type=GarbageCollector,name=*", "java.lang:name=Copy,type=GarbageCollector", true},
+		{"java.lang:type=GarbageCollector,name=*", "java.lang:type=GarbageCollector,name=P*", true},
+		{"java.lang:type=GarbageCollector,name=P*", "java.lang:type=GarbageCollector,name=*", false},
+		{"java.lang:type=GarbageCollector,name=PS ?", "java.lang:type=GarbageCollector,name=PS 1", true},
+		{"java.lang:type=GarbageCollector,name=*", "java.lang:type=GarbageCollector,*", false},
+		{"java.lang:type=GarbageCollector", "java.lang:type=GarbageCollector,name=Copy", false},
+		{"java.lang:type=Memory", "java.nio:type=Memory", false},
+		{"Catalina:type=GlobalRequestProcessor,*", `Catalina:type=GlobalRequestProcessor,name="http-nio-8080,1"`, true},
+		{`Catalina:type=Manager,context="/app*",*`, `Catalina:type=Manager,context="/app1",host=localhost`, true},
+		{"com.zaxxer.hikari:type=Pool (*)", "com.zaxxer.hikari:type=Pool (main)", true},
+	}
+
+	for _, tc := range testCases {
+		outer, ok := parseObjectName(tc.outer)
+		if !ok {
+			t.Fatalf("Failed to parse %s", tc.outer)
+		}
+		inner, ok := parseObjectName(tc.inner)
+		if !ok {
+			t.Fatalf("Failed to parse %s", tc.inner)
+		}
+		if subsumes := outer.subsumes(inner); subsumes != tc.subsumes {
+			t.Errorf("Expected %s subsumes %s to be %t", tc.outer, tc.inner, tc.subsumes)
+		}
+	}
+
+	if _, ok := parseObjectName("java.*:type=Memory"); ok {
+		t.Error("Expected a domain pattern not to be compared")
+	}
+}
+
+func TestPlanQueries(t *testing.T) {
+	memory := &domainDefinition{domain: "java.lang", eventType: "JavaLangSample", beans: []*beanRequest{
+		{beanQuery: "type=Memory", attributes: []*attributeRequest{{attrName: "HeapMemoryUsage.Used"}}},
+		{beanQuery: "type=GarbageCollector,name=Copy"},
+	}}
+	custom := &domainDefinition{domain: "java.lang", eventType: "CustomSample", beans: []*beanRequest{
+		{beanQuery: "type=Memory", attributes: []*attributeRequest{{attrName: "NonHeapMemoryUsage.Used"}}},
+		{beanQuery: "type=GarbageCollector,*"},
+		{beanQuery: "type=Threading"},
+	}}
+
+	plan := planQueries(orderedQueries([]*domainDefinition{memory, custom}))
+
+	expected := []struct {
+		objectPattern string
+		attrNames     []string
+		consumers     int
+	}{
+		{"java.lang:type=Memory", []string{"HeapMemoryUsage.Used", "HeapMemoryUsage", "NonHeapMemoryUsage.Used", "NonHeapMemoryUsage"}, 2},
+		{"java.lang:type=GarbageCollector,*", nil, 2},
+		{"java.lang:type=Threading", nil, 1},
+	}
+	if len(plan) != len(expected) {
+		t.Fatalf("Expected %d planned queries, got %d", len(expected), len(plan))
+	}
+	for n, p := range plan {
+		if p.objectPattern != expected[n].objectPattern || !reflect.DeepEqual(p.attrNames, expected[n].attrNames) || len(p.consumers) != expected[n].consumers {
+			t.Errorf("Expected %+v, got %s with %v and %d requests", expected[n], p.objectPattern, p.attrNames, len(p.consumers))
+		}
+	}
+}
+
+func TestQueryJMXSharesQueries(t *testing.T) {
+	defer withArgs(argumentList{})()
+	used := func(name string) *attributeRequest {
+		return &attributeRequest{attrRegexp: regexp.MustCompile("attr=" + regexp.QuoteMeta(name) + "$"), attrName: name, metricType: metric.GAUGE}
+	}
+	collection := []*domainDefinition{
+		{domain: "java.lang", eventType: "JavaLangSample", beans: []*beanRequest{
+			{beanQuery: "type=Memory", attributes: []*attributeRequest{used("HeapMemoryUsage.Used")}},
+			{beanQuery: "type=GarbageCollector,name=Copy", attributes: []*attributeRequest{used("CollectionCount")}},
+		}},
+		{domain: "java.lang", eventType: "JavaLangSample", beans: []*beanRequest{
+			{beanQuery: "type=Memory", attributes: []*attributeRequest{used("HeapMemoryUsage.Used"), used("NonHeapMemoryUsage.Used")}},
+		}},
+		{domain: "java.lang", eventType: "GCSample", beans: []*beanRequest{
+			{beanQuery: "type=GarbageCollector,*", attributes: []*attributeRequest{used("CollectionTime")}},
+		}},
+	}
+
+	queried := make(map[string]int)
+	client := &fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		queried[name]++
+		return map[string]interface{}{
+			"java.lang:type=Memory,attr=HeapMemoryUsage.Used":                     100.0,
+			"java.lang:type=Memory,attr=NonHeapMemoryUsage.Used":                  50.0,
+			"java.lang:name=Copy,type=GarbageCollector,attr=CollectionCount":      2.0,
+			"java.lang:name=Copy,type=GarbageCollector,attr=CollectionTime":       20.0,
+			"java.lang:name=MarkSweep,type=GarbageCollector,attr=CollectionCount": 1.0,
+			"java.lang:name=MarkSweep,type=GarbageCollector,attr=CollectionTime":  10.0,
+		}, nil
+	}}
+
+	i, _ := integration.New("jmxtest", "0.1.0")
+	if err := queryJMX(collection, client, &jmxTarget{}, i); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := map[string]int{"java.lang:type=Memory": 1, "java.lang:type=GarbageCollector,*": 1}; !reflect.DeepEqual(expected, queried) {
+		t.Errorf("Expected each query to run once, got %v", queried)
+	}
+
+	samples := make(map[string]map[string]interface{})
+	for _, ms := range i.Entities[0].Metrics {
+		samples[ms.Metrics["event_type"].(string)+" "+ms.Metrics["bean"].(string)] = ms.Metrics
+	}
+	if len(samples) != 4 || len(i.Entities[0].Metrics) != 4 {
+		t.Errorf("Expected 4 samples, got %v", samples)
+	}
+	memory := samples["JavaLangSample type=Memory"]
+	if memory["HeapMemoryUsage.Used"] != 100.0 || memory["NonHeapMemoryUsage.Used"] != 50.0 {
+		t.Errorf("Expected the Memory samples of both files to be merged, got %v", memory)
+	}
+	if collector := samples["JavaLangSample name=Copy,type=GarbageCollector"]; collector["CollectionCount"] != 2.0 {
+		t.Errorf("Expected the Copy collector sample, got %v", collector)
+	}
+	if _, ok := samples["JavaLangSample name=MarkSweep,type=GarbageCollector"]; ok {
+		t.Error("Expected the beans not matching name=Copy to be filtered out")
+	}
+	if gc := samples["GCSample name=MarkSweep,type=GarbageCollector"]; gc["CollectionTime"] != 10.0 {
+		t.Errorf("Expected the MarkSweep collector sample, got %v", gc)
+	}
+}
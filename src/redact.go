@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	stdlog "log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/newrelic/infra-integrations-sdk/log"
+)
+
+const (
+	// redactedMask replaces every secret in log output
+	redactedMask = "********"
+	// minSecretLength is the length under which a secret is only masked as
+	// a whole word, as it would otherwise also be masked in unrelated words
+	minSecretLength = 4
+	// defaultJmxPass is the default of jmx_pass, which is also a common user
+	// and bean name, so it is only masked as a whole word
+	defaultJmxPass = "admin"
+)
+
+// logger is used by all logging in the integration. It masks the secrets
+// registered with registerSecret wherever they appear in a message,
+// including in formatted errors and nrjmx output
+var logger log.Logger = newRedactingLogger(false)
+
+// secret is a value to mask. wholeWord is set for the values that are only
+// masked where they aren't part of a longer word
+type secret struct {
+	value     string
+	wholeWord bool
+}
+
+// redactor holds the secret values to mask, longest first so that a secret
+// containing another one is masked whole
+type redactor struct {
+	lock    sync.RWMutex
+	secrets []secret
+}
+
+var redactions redactor
+
+// registerSecret adds a value to mask in all log output. The default
+// password and values shorter than minSecretLength are masked as whole
+// words, so that admin is kept in administrator
+func registerSecret(value string) {
+	if value == "" {
+		return
+	}
+
+	redactions.lock.Lock()
+	defer redactions.lock.Unlock()
+	for _, s := range redactions.secrets {
+		if s.value == value {
+			return
+		}
+	}
+	wholeWord := len(value) < minSecretLength || value == defaultJmxPass
+	redactions.secrets = append(redactions.secrets, secret{value: value, wholeWord: wholeWord})
+	sort.Slice(redactions.secrets, func(i, j int) bool {
+		return len(redactions.secrets[i].value) > len(redactions.secrets[j].value)
+	})
+}
+
+// redact masks every registered secret in s
+func redact(s string) string {
+	redactions.lock.RLock()
+	defer redactions.lock.RUnlock()
+	for _, secret := range redactions.secrets {
+		if secret.wholeWord {
+			s = replaceWord(s, secret.value)
+		} else {
+			s = strings.Replace(s, secret.value, redactedMask, -1)
+		}
+	}
+	return s
+}
+
+// replaceWord masks the occurrences of value in s that aren't part of a
+// longer word, such as admin in administrator
+func replaceWord(s, value string) string {
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(s); {
+		n := strings.Index(s[i:], value)
+		if n < 0 {
+			break
+		}
+		start, end := i+n, i+n+len(value)
+		if (start == 0 || !isWordByte(s[start-1]) || !isWordByte(value[0])) &&
+			(end == len(s) || !isWordByte(s[end]) || !isWordByte(value[len(value)-1])) {
+			b.WriteString(s[last:start])
+			b.WriteString(redactedMask)
+			last, i = end, end
+			continue
+		}
+		i = start + 1
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// redactingLogger is a log.Logger that writes to standard error in the
+// format of the SDK global logger, after masking secrets
+type redactingLogger struct {
+	logger  *stdlog.Logger
+	verbose bool
+}
+
+func newRedactingLogger(verbose bool) *redactingLogger {
+	return &redactingLogger{
+		logger:  stdlog.New(os.Stderr, "", 0),
+		verbose: verbose,
+	}
+}
+
+func (l *redactingLogger) Debugf(format string, args ...interface{}) {
+	if l.verbose {
+		l.print("DEBUG", format, args...)
+	}
+}
+
+func (l *redactingLogger) Infof(format string, args ...interface{}) {
+	l.print("INFO", format, args...)
+}
+
+func (l *redactingLogger) Warnf(format string, args ...interface{}) {
+	l.print("WARN", format, args...)
+}
+
+func (l *redactingLogger) Errorf(format string, args ...interface{}) {
+	l.print("ERR", format, args...)
+}
+
+func (l *redactingLogger) print(level, format string, args ...interface{}) {
+	l.logger.Print(redact(fmt.Sprintf("["+level+"] "+format, args...)))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	stdlog "log"
+	"testing"
+)
+
+func TestRedactingLogger(t *testing.T) {
+	// Other tests register secrets as a side effect of getTargets
+	saved := redactions.secrets
+	redactions.secrets = nil
+	defer func() {
+		redactions.secrets = saved
+	}()
+
+	registerSecret("s3cret")
+	registerSecret("s3cret-ks")
+	registerSecret("")
+	registerSecret("abc")
+	registerSecret("admin")
+
+	var out bytes.Buffer
+	l := &redactingLogger{logger: stdlog.New(&out, "", 0)}
+
+	err := annotate(exitError(stderrError("Authentication failed for password s3cret")), "creating JMX connection")
+	l.Errorf("Failed to open JMX connection (pass: %s, keyStorePassword: %s): %s", "s3cret", "s3cret-ks", err)
+	l.Debugf("not verbose")
+
+	expected := "[ERR] Failed to open JMX connection (pass: ********, keyStorePassword: ********): creating JMX connection: Authentication failed for password ********\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"user admin, bean type=abc", "user ********, bean type=********"},
+		{"administrator of abcd", "administrator of abcd"},
+		{"admin/abc:admin", "********/********:********"},
+		{"pass=s3cret0", "pass=********0"},
+	}
+	for _, tc := range testCases {
+		if redacted := redact(tc.input); redacted != tc.expected {
+			t.Errorf("Expected %q, got %q", tc.expected, redacted)
+		}
+	}
+}
+
+type stderrError string
+
+func (e stderrError) Error() string {
+	return string(e)
+}
+
+func TestGetTargetsRegistersSecrets(t *testing.T) {
+	defer withArgs(argumentList{JmxHost: "localhost", JmxPort: "9999", JmxUser: "monitor", JmxPass: "exec:echo from-helper"})()
+
+	if _, err := getTargets(); err != nil {
+		t.Fatal(err)
+	}
+	if redacted := redact("password from-helper"); redacted != "password ********" {
+		t.Errorf("Expected the resolved secret to be registered, got %s", redacted)
+	}
+}
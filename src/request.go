@@ -3,11 +3,12 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/newrelic/infra-integrations-sdk/data/metric"
 	"github.com/newrelic/infra-integrations-sdk/integration"
-	"github.com/newrelic/infra-integrations-sdk/log"
 )
 
 // queryResponse is a struct that contains the
@@ -24,33 +25,150 @@ type beanAttrValuePair struct {
 	value    interface{}
 }
 
-func queryJMX(collection []*domainDefinition, i *integration.Integration) error {
+// beanQuery is a bean request along with the domain it belongs to
+type beanQuery struct {
+	domain  *domainDefinition
+	request *beanRequest
+}
+
+// String returns the domain:query string sent to the client
+func (q beanQuery) String() string {
+	return fmt.Sprintf("%s:%s", q.domain.domain, q.request.beanQuery)
+}
+
+// orderedQueries returns the bean requests of a collection, highest
+// priority first. Requests of the same priority keep the file order
+func orderedQueries(collection []*domainDefinition) []beanQuery {
+	var queries []beanQuery
 	for _, domain := range collection {
-		var errors []error
 		for _, request := range domain.beans {
-			requestString := fmt.Sprintf("%s:%s", domain.domain, request.beanQuery)
-			result, err := jmxQuery(requestString, args.Timeout)
-			if err != nil {
-				log.Error("Failed to retrieve metrics for request %s: %s", requestString, err)
-				return err
+			queries = append(queries, beanQuery{domain: domain, request: request})
+		}
+	}
+	sort.SliceStable(queries, func(a, b int) bool {
+		return queries[a].request.priority > queries[b].request.priority
+	})
+	return queries
+}
+
+// queryJMX runs the bean queries of the collection files, highest priority
+// first. A failed query is logged and skipped so it does not cost the
+// metrics of the other beans.
+// Beans with an interval are skipped until it has elapsed since their last
+// successful collection, and queries that keep failing are skipped for a
+// cooldown. The remaining queries are sent args.QueryBatchSize at a time to
+// the clients that can batch them, and the batches that have not started
+// when args.CollectionDeadline expires are skipped. Requests answered by
+// the same query, even from different collection files, share it. The last
+// query error is returned
+func queryJMX(collection []*domainDefinition, client jmxClient, target *jmxTarget, i *integration.Integration) error {
+	var deadline time.Time
+	if args.CollectionDeadline > 0 {
+		deadline = time.Now().Add(time.Duration(args.CollectionDeadline) * time.Millisecond)
+	}
+	counter, _ := client.(skipCounter)
+	target.metricSets = make(map[string]*metric.Set)
+	if d, ok := client.(deadlineClient); ok {
+		d.setDeadline(deadline)
+		defer d.setDeadline(time.Time{})
+	}
+
+	var due []beanQuery
+	for _, q := range orderedQueries(collection) {
+		requestString := q.String()
+		now := time.Now()
+		if !isDue(collectionKey(target, requestString), q.request.interval, now) {
+			logger.Debugf("Skipping request %s, collected less than %s ago", requestString, q.request.interval)
+			continue
+		}
+		if open, until := breakerOpen(breakerKey(target, requestString), now); open {
+			logger.Warnf("Skipping request %s until %s after repeated failures", requestString, until.Format(time.RFC3339))
+			if counter != nil {
+				counter.querySkipped()
 			}
-			if err := handleResponse(domain.eventType, request, result, i); err != nil {
-				errors = append(errors, err)
+			continue
+		}
+		due = append(due, q)
+	}
+
+	var queryErr error
+	var pastDeadline []string
+	errors := make(map[*domainDefinition][]error)
+	plan := planQueries(due)
+	size := batchSize(client)
+	for start := 0; start < len(plan); start += size {
+		batch := plan[start:]
+		if len(batch) > size {
+			batch = batch[:size]
+		}
+
+		now := time.Now()
+		if !deadline.IsZero() && now.After(deadline) {
+			for _, p := range plan[start:] {
+				for _, q := range p.consumers {
+					pastDeadline = append(pastDeadline, q.String())
+					if counter != nil {
+						counter.queryPastDeadline()
+					}
+				}
 			}
+			break
 		}
 
-		if len(errors) != 0 {
-			log.Error("Failed to parse some responses for domain %s: %v", domain.domain, errors)
+		objectPatterns := make([]string, len(batch))
+		attrNames := make([][]string, len(batch))
+		for n, p := range batch {
+			objectPatterns[n] = p.objectPattern
+			attrNames[n] = p.attrNames
+		}
+		results, errs := queryAll(client, objectPatterns, attrNames, args.Timeout)
+
+		for n, p := range batch {
+			if err := errs[n]; err != nil {
+				logger.Errorf("Failed to retrieve metrics for request %s: %s", p.objectPattern, err)
+				queryErr = err
+			}
+
+			// The same request may come from several collection files, but
+			// it is only one query for the breaker. A query that was never
+			// answered, because an earlier one of its batch failed, is not
+			// counted against it
+			recorded := make(map[string]bool)
+			for _, q := range p.consumers {
+				requestString := q.String()
+				breaker := breakerKey(target, requestString)
+				if errs[n] != nil {
+					if !recorded[requestString] && !isNotAnswered(errs[n]) {
+						recordQueryFailure(breaker, requestString, now)
+					}
+					recorded[requestString] = true
+					continue
+				}
+				recordQuerySuccess(breaker)
+				markCollected(collectionKey(target, requestString), q.request.interval, now)
+				if err := handleResponse(q.domain.eventType, q.request, p.consumerResponse(q, results[n]), target, i); err != nil {
+					errors[q.domain] = append(errors[q.domain], err)
+				}
+			}
 		}
 	}
 
-	return nil
+	for _, domain := range collection {
+		if len(errors[domain]) != 0 {
+			logger.Errorf("Failed to parse some responses for domain %s: %v", domain.domain, errors[domain])
+		}
+	}
+	if len(pastDeadline) != 0 {
+		logger.Warnf("Collection deadline of %dms reached for %s, skipped %d requests: %s", args.CollectionDeadline, target, len(pastDeadline), strings.Join(pastDeadline, ", "))
+	}
+
+	return queryErr
 }
 
 // handleResponse takes a response, filters out the excluded beans,
 // sorts the responses by domain, and passes each domain off to
 // insertDomainMetrics to populate the metric list
-func handleResponse(eventType string, request *beanRequest, response queryResponse, i *integration.Integration) error {
+func handleResponse(eventType string, request *beanRequest, response queryResponse, target *jmxTarget, i *integration.Integration) error {
 
 	// Delete excluded mbeans
 	for key := range response {
@@ -75,7 +193,7 @@ func handleResponse(eventType string, request *beanRequest, response queryRespon
 
 	// For each domain, create an entity and a metric set
 	for domain, beanAttrVals := range domainsMap {
-		err := insertDomainMetrics(eventType, domain, beanAttrVals, request, i)
+		err := insertDomainMetrics(eventType, domain, beanAttrVals, request, target, i)
 		if err != nil {
 			return err
 		}
@@ -87,10 +205,10 @@ func handleResponse(eventType string, request *beanRequest, response queryRespon
 // insertDomainMetrics akes a domain and a list of attr:value pairs,
 // creates an entity and metric set for the domain, and populates the
 // metric set for each attribute to be collected
-func insertDomainMetrics(eventType string, domain string, beanAttrVals []*beanAttrValuePair, request *beanRequest, i *integration.Integration) error {
+func insertDomainMetrics(eventType string, domain string, beanAttrVals []*beanAttrValuePair, request *beanRequest, target *jmxTarget, i *integration.Integration) error {
 
 	// Create an entity for the domain
-	e, err := i.Entity(domain, "domain")
+	e, err := i.Entity(target.entityName(domain), "domain")
 	if err != nil {
 		return err
 	}
@@ -109,7 +227,7 @@ func insertDomainMetrics(eventType string, domain string, beanAttrVals []*beanAt
 				}
 
 				// Get the metric set from the map or create it
-				metricSet, err := getOrCreateMetricSet(entityMetricSets, e, request, beanName, eventType)
+				metricSet, err := getOrCreateMetricSet(entityMetricSets, e, request, beanName, eventType, target)
 				if err != nil {
 					return err
 				}
@@ -131,19 +249,27 @@ func insertDomainMetrics(eventType string, domain string, beanAttrVals []*beanAt
 // getOrCreateMetricSet takes a map of bean names to metric sets and either
 // returns a metric set from the map if it exists, or creates the metric set
 // and adds it to the map
-func getOrCreateMetricSet(entityMetricSets map[string]*metric.Set, e *integration.Entity, request *beanRequest, beanNameMatch string, eventType string) (*metric.Set, error) {
+func getOrCreateMetricSet(entityMetricSets map[string]*metric.Set, e *integration.Entity, request *beanRequest, beanNameMatch string, eventType string, target *jmxTarget) (*metric.Set, error) {
 
 	// If the metric set exists, return it
 	if ms, ok := entityMetricSets[beanNameMatch]; ok {
 		return ms, nil
 	}
 
+	// Another request of the run may have collected the same bean as the
+	// same event type, in which case its metrics are merged into that set
+	key := e.Metadata.Name + "\x00" + eventType + "\x00" + beanNameMatch
+	if ms, ok := target.metricSets[key]; ok {
+		entityMetricSets[beanNameMatch] = ms
+		return ms, nil
+	}
+
 	// Attributes in all metric sets
 	attributes := []metric.Attribute{
 		{Key: "query", Value: request.beanQuery},
 		{Key: "entityName", Value: "domain:" + e.Metadata.Name},
 		{Key: "displayName", Value: e.Metadata.Name},
-		{Key: "host", Value: args.JmxHost},
+		{Key: "host", Value: target.JmxHost},
 		{Key: "bean", Value: beanNameMatch},
 	}
 
@@ -156,9 +282,18 @@ func getOrCreateMetricSet(entityMetricSets map[string]*metric.Set, e *integratio
 		attributes = append(attributes, metric.Attribute{Key: "key:" + key, Value: val})
 	}
 
+	// Add the labels of the target
+	for key, val := range target.Labels {
+		attributes = append(attributes, metric.Attribute{Key: "label." + key, Value: val})
+	}
+
 	// Create the metric set and put it in the map
 	metricSet := e.NewMetricSet(eventType, attributes...)
 	entityMetricSets[beanNameMatch] = metricSet
+	if target.metricSets == nil {
+		target.metricSets = make(map[string]*metric.Set)
+	}
+	target.metricSets[key] = metricSet
 
 	return metricSet, nil
 }
@@ -185,6 +320,13 @@ func insertMetric(key string, val interface{}, attribute *attributeRequest, metr
 		return err
 	}
 
+	// When requests that share a metric set collect the same metric, the
+	// first value is kept, as setting a rate or delta twice would break it
+	if _, ok := metricSet.Metrics[metricName]; ok {
+		logger.Debugf("Skipping metric %s from %s, already collected by another request", metricName, key)
+		return nil
+	}
+
 	// Generate a metric type if unset
 	var metricType metric.SourceType
 	if attribute.metricType == -1 {
@@ -256,7 +398,7 @@ func splitBeanName(bean string) (string, string, error) {
 // The resulting event type will be used if no custom event type has been defined.
 func generateEventType(domain string) (string, error) {
 	if strings.Contains(domain, "*") {
-		log.Error(
+		logger.Errorf(
 			"Cannot generate an event type for the wildcarded domain %s."+
 				"For wildcarded domains, define a custom event type with event_type"+
 				"in the collection configuration file.", domain,
@@ -273,6 +415,25 @@ func generateEventType(domain string) (string, error) {
 	return eventType, nil
 }
 
+// flattenAttributeValue adds an attribute read by the Go backends to result
+// under the "bean,attr=name" keys of nrjmx, with one key per capitalized
+// field of composite values, such as HeapMemoryUsage.Used. Arrays and nulls
+// are skipped, as nrjmx does not report them either
+func flattenAttributeValue(result map[string]interface{}, beanName, attrName string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for field, fieldValue := range v {
+			if field == "" {
+				continue
+			}
+			fieldName := strings.ToUpper(field[:1]) + field[1:]
+			flattenAttributeValue(result, beanName, attrName+"."+fieldName, fieldValue)
+		}
+	case float64, string, bool:
+		result[fmt.Sprintf("%s,attr=%s", beanName, attrName)] = v
+	}
+}
+
 // inferMetricType attempts to guess the metric type based
 // on its ability to convert to a number
 func inferMetricType(s interface{}) metric.SourceType {
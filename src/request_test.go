@@ -5,22 +5,45 @@ import (
 	"io/ioutil"
 	"reflect"
 	"regexp"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kr/pretty"
 	"github.com/newrelic/infra-integrations-sdk/data/metric"
 	"github.com/newrelic/infra-integrations-sdk/integration"
 )
 
+// fakeClient is a jmxClient that answers every query with queryFn
+type fakeClient struct {
+	queryFn func(objectPattern string, timeout int) (map[string]interface{}, error)
+	openErr error
+	opens   int
+	closes  int
+}
+
+func (c *fakeClient) open() error {
+	c.opens++
+	return c.openErr
+}
+
+func (c *fakeClient) query(objectPattern string, timeout int) (map[string]interface{}, error) {
+	return c.queryFn(objectPattern, timeout)
+}
+
+func (c *fakeClient) close() {
+	c.closes++
+}
+
 func TestRunCollection(t *testing.T) {
 
-	jmxQuery = func(name string, timeout int) (map[string]interface{}, error) {
+	client := &fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
 		outmap := map[string]interface{}{
 			"java.lang:test1=test1,test2=test2,attr=testattr": "testresult",
 		}
 
 		return outmap, nil
-	}
+	}}
 
 	collection := []*domainDefinition{
 		{
@@ -55,7 +78,7 @@ func TestRunCollection(t *testing.T) {
 
 	i, _ := integration.New("jmxtest", "0.1.0")
 
-	queryJMX(collection, i)
+	queryJMX(collection, client, &jmxTarget{}, i)
 
 	if !reflect.DeepEqual(expectedMetrics, i.Entities[0].Metrics[0].Metrics) {
 		fmt.Println(pretty.Diff(expectedMetrics, i.Entities[0].Metrics[0].Metrics))
@@ -63,6 +86,122 @@ func TestRunCollection(t *testing.T) {
 	}
 
 }
+func TestQueryJMXSharedEntity(t *testing.T) {
+	collection := []*domainDefinition{
+		{domain: "java.lang", eventType: "JavaLangSample", beans: []*beanRequest{
+			{beanQuery: "type=Memory", attributes: []*attributeRequest{{attrRegexp: regexp.MustCompile("attr=HeapMemoryUsage.Used$"), metricType: metric.GAUGE}}},
+			{beanQuery: "type=Memory", attributes: []*attributeRequest{{attrRegexp: regexp.MustCompile("attr=NonHeapMemoryUsage.Used$"), metricType: metric.GAUGE}}},
+		}},
+	}
+	client := func() jmxClient {
+		return &fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"java.lang:type=Memory,attr=HeapMemoryUsage.Used":    100.0,
+				"java.lang:type=Memory,attr=NonHeapMemoryUsage.Used": 50.0,
+			}, nil
+		}}
+	}
+
+	// Targets whose entities have the same name write to the same entity
+	// concurrently, each merging its requests into its own metric set
+	i, _ := integration.New("jmxtest", "0.1.0")
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = queryJMX(collection, client(), &jmxTarget{}, i)
+		}()
+	}
+	wg.Wait()
+
+	if len(i.Entities) != 1 || len(i.Entities[0].Metrics) != 4 {
+		t.Fatalf("Expected one merged metric set per target on a single entity, got %+v", i.Entities)
+	}
+	for _, ms := range i.Entities[0].Metrics {
+		if ms.Metrics["HeapMemoryUsage.Used"] != 100.0 || ms.Metrics["NonHeapMemoryUsage.Used"] != 50.0 {
+			t.Errorf("Expected the requests of a target to be merged, got %v", ms.Metrics)
+		}
+	}
+}
+
+func TestOrderedQueries(t *testing.T) {
+	file := []byte(`collect:
+  - domain: com.zaxxer.hikari
+    event_type: HikariSample
+    beans:
+      - query: type=Pool (*)
+      - query: type=PoolConfig (*)
+        priority: -1
+  - domain: java.lang
+    beans:
+      - query: type=Memory
+        priority: 10
+      - query: type=Threading
+`)
+	domains, err := infraJmxParser{}.parse(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var queried []string
+	for _, q := range orderedQueries(domains) {
+		queried = append(queried, q.domain.domain+":"+q.request.beanQuery)
+	}
+	expected := []string{
+		"java.lang:type=Memory",
+		"com.zaxxer.hikari:type=Pool (*)",
+		"java.lang:type=Threading",
+		"com.zaxxer.hikari:type=PoolConfig (*)",
+	}
+	if !reflect.DeepEqual(expected, queried) {
+		t.Errorf("Expected queries in order %v, got %v", expected, queried)
+	}
+}
+
+func TestQueryJMXDeadline(t *testing.T) {
+	defer withArgs(argumentList{CollectionDeadline: 50})()
+
+	collection := []*domainDefinition{
+		{
+			domain:    "com.zaxxer.hikari",
+			eventType: "HikariSample",
+			beans: []*beanRequest{
+				{beanQuery: "type=Pool,*"},
+				{beanQuery: "type=PoolConfig,*"},
+			},
+		},
+		{
+			domain:    "java.lang",
+			eventType: "JavaLangSample",
+			beans: []*beanRequest{
+				{beanQuery: "type=Memory", priority: 10},
+				{beanQuery: "type=GarbageCollector,name=*", priority: 10},
+			},
+		},
+	}
+
+	var queried []string
+	client := newHealthClient(&fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		queried = append(queried, name)
+		time.Sleep(40 * time.Millisecond)
+		return map[string]interface{}{}, nil
+	}}, false)
+
+	i, _ := integration.New("jmxtest", "0.1.0")
+	if err := queryJMX(collection, client, &jmxTarget{}, i); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"java.lang:type=Memory", "java.lang:type=GarbageCollector,name=*"}
+	if !reflect.DeepEqual(expected, queried) {
+		t.Errorf("Expected the high priority beans to be queried before the deadline, got %v", queried)
+	}
+	if h := client.health(); h.queriesLate != 2 || h.queriesAttempted != 2 {
+		t.Errorf("Expected 2 queries to be skipped by the deadline, got %+v", h)
+	}
+}
+
 func TestGenerateEventType(t *testing.T) {
 	testCases := []struct {
 		input       string
@@ -205,8 +344,7 @@ func TestInsertMetric(t *testing.T) {
 
 func TestInsertDomainMetrics(t *testing.T) {
 	i, _ := integration.New("jmx", "0.1.0")
-	args = argumentList{}
-	args.JmxHost = "localhost"
+	target := &jmxTarget{JmxHost: "localhost"}
 	domain := "java.lang"
 	beanAttrVals := []*beanAttrValuePair{
 		{
@@ -234,7 +372,7 @@ func TestInsertDomainMetrics(t *testing.T) {
 
 	eventType := "TestEventTypeSample"
 
-	insertDomainMetrics(eventType, domain, beanAttrVals, request, i)
+	insertDomainMetrics(eventType, domain, beanAttrVals, request, target, i)
 
 	expectedMetrics := map[string]interface{}{
 		"event_type":  "TestEventTypeSample",
@@ -269,7 +407,7 @@ func TestHandleResponse(t *testing.T) {
 	}
 	i, _ := integration.New("jmx", "0.1.0")
 
-	err := handleResponse(eventType, request, response, i)
+	err := handleResponse(eventType, request, response, &jmxTarget{}, i)
 	if err != nil {
 		t.Error(err)
 	}
@@ -304,7 +442,7 @@ func TestDefaultMetricType(t *testing.T) {
 	}
 	i, _ := integration.New("jmx", "0.1.0")
 
-	err = handleResponse(eventType, request, response, i)
+	err = handleResponse(eventType, request, response, &jmxTarget{}, i)
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// authFailureMarkers are fragments of the errors JMX servers return for
+// rejected credentials. Retrying those can only lock the account out
+var authFailureMarkers = []string{
+	"SecurityException",
+	"Authentication failed",
+	"Invalid username or password",
+	"Credentials required",
+	"401 Unauthorized",
+}
+
+// retriableError marks a failure that a new connection may not hit again,
+// such as a timeout or a connection closed in the middle of a query
+type retriableError struct {
+	err error
+}
+
+func (e *retriableError) Error() string {
+	return e.err.Error()
+}
+
+// retriable marks err as retriable
+func retriable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retriableError{err: err}
+}
+
+// isRetriable reports whether err was marked as retriable
+func isRetriable(err error) bool {
+	_, ok := err.(*retriableError)
+	return ok
+}
+
+// annotate prefixes err with a formatted message, keeping it retriable if it was
+func annotate(err error, format string, a ...interface{}) error {
+	annotated := fmt.Errorf("%s: %s", fmt.Sprintf(format, a...), err)
+	if isRetriable(err) {
+		return retriable(annotated)
+	}
+	return annotated
+}
+
+// isAuthFailure reports whether an error message looks like rejected credentials
+func isAuthFailure(message string) bool {
+	for _, marker := range authFailureMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryClient wraps a jmxClient and retries queries that fail with a
+// retriable error. Before each retry it waits, doubling the wait every
+// time, and reopens the wrapped client with its original settings
+type retryClient struct {
+	client   jmxClient
+	attempts int
+	backoff  time.Duration
+	// sleep is replaced in tests
+	sleep func(time.Duration)
+	// deadline is the collection deadline of the current run, zero when
+	// there is none. No retry is started that would end after it
+	deadline time.Time
+}
+
+// deadlineClient is implemented by clients that stop retrying queries at
+// the collection deadline
+type deadlineClient interface {
+	setDeadline(deadline time.Time)
+}
+
+func newRetryClient(client jmxClient, attempts int, backoff time.Duration) *retryClient {
+	return &retryClient{
+		client:   client,
+		attempts: attempts,
+		backoff:  backoff,
+		sleep:    time.Sleep,
+	}
+}
+
+func (c *retryClient) setDeadline(deadline time.Time) {
+	c.deadline = deadline
+}
+
+// pastDeadline reports whether a retry after waiting delay, and taking up
+// to timeout milliseconds, could end after the collection deadline
+func (c *retryClient) pastDeadline(delay time.Duration, timeout int) bool {
+	return !c.deadline.IsZero() && time.Now().Add(delay+time.Duration(timeout)*time.Millisecond).After(c.deadline)
+}
+
+func (c *retryClient) open() error {
+	return c.client.open()
+}
+
+func (c *retryClient) query(objectPattern string, timeout int) (map[string]interface{}, error) {
+	return c.queryAttributes(objectPattern, nil, timeout)
+}
+
+func (c *retryClient) queryAttributes(objectPattern string, attrNames []string, timeout int) (map[string]interface{}, error) {
+	delay := c.backoff
+	for attempt := 1; ; attempt++ {
+		result, err := queryScoped(c.client, objectPattern, attrNames, timeout)
+		if err == nil || !isRetriable(err) || attempt >= c.attempts {
+			return result, err
+		}
+		if c.pastDeadline(delay, timeout) {
+			logger.Warnf("Query %s failed on attempt %d of %d, not retrying past the collection deadline: %s", objectPattern, attempt, c.attempts, err)
+			return result, err
+		}
+
+		logger.Warnf("Query %s failed on attempt %d of %d, reconnecting in %s: %s", objectPattern, attempt, c.attempts, delay, err)
+		c.sleep(delay)
+		delay *= 2
+
+		c.client.close()
+		if err := c.client.open(); err != nil {
+			// The next attempt fails fast on the closed client and retries again
+			logger.Warnf("Failed to reopen JMX connection: %s", err)
+		}
+	}
+}
+
+func (c *retryClient) batching() bool {
+	return canBatch(c.client)
+}
+
+// queryBatch retries, as a smaller batch, the queries of a batch that failed
+// with a retriable error
+func (c *retryClient) queryBatch(objectPatterns []string, attrNames [][]string, timeout int) ([]map[string]interface{}, []error) {
+	results, errs := queryAll(c.client, objectPatterns, attrNames, timeout)
+	delay := c.backoff
+	for attempt := 1; attempt < c.attempts; attempt++ {
+		var retries []int
+		var patterns []string
+		var names [][]string
+		for n, err := range errs {
+			if isRetriable(err) {
+				retries = append(retries, n)
+				patterns = append(patterns, objectPatterns[n])
+				names = append(names, attrNames[n])
+			}
+		}
+		if len(retries) == 0 {
+			break
+		}
+		if c.pastDeadline(delay, timeout) {
+			logger.Warnf("%d queries failed on attempt %d of %d, not retrying past the collection deadline: %s", len(retries), attempt, c.attempts, errs[retries[0]])
+			break
+		}
+
+		logger.Warnf("%d queries failed on attempt %d of %d, reconnecting in %s: %s", len(retries), attempt, c.attempts, delay, errs[retries[0]])
+		c.sleep(delay)
+		delay *= 2
+
+		c.client.close()
+		if err := c.client.open(); err != nil {
+			logger.Warnf("Failed to reopen JMX connection: %s", err)
+		}
+
+		retried, retryErrs := queryAll(c.client, patterns, names, timeout)
+		for k, n := range retries {
+			results[n], errs[n] = retried[k], retryErrs[k]
+		}
+	}
+	return results, errs
+}
+
+func (c *retryClient) close() {
+	c.client.close()
+}
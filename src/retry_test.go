@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+// failingClient returns a fakeClient whose first failures queries fail with err
+func failingClient(failures int, err error) *fakeClient {
+	calls := 0
+	return &fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		calls++
+		if calls <= failures {
+			return nil, err
+		}
+		return map[string]interface{}{name + ",attr=Value": 1.0}, nil
+	}}
+}
+
+func TestRetryClientReconnects(t *testing.T) {
+	client := failingClient(2, retriable(errors.New("timeout while waiting for query")))
+	var delays []time.Duration
+	c := newRetryClient(client, 3, 100*time.Millisecond)
+	c.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	result, err := c.query("java.lang:type=Memory", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["java.lang:type=Memory,attr=Value"] != 1.0 {
+		t.Errorf("Unexpected result %v", result)
+	}
+	if client.opens != 2 || client.closes != 2 {
+		t.Errorf("Expected the client to be reopened twice, got %d opens and %d closes", client.opens, client.closes)
+	}
+	if expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}; !reflect.DeepEqual(expected, delays) {
+		t.Errorf("Expected backoff %v, got %v", expected, delays)
+	}
+}
+
+func TestRetryClientGivesUp(t *testing.T) {
+	client := failingClient(5, retriable(errors.New("got an EOF while reading nrjmx output")))
+	c := newRetryClient(client, 3, 0)
+	c.sleep = func(time.Duration) {}
+
+	if _, err := c.query("java.lang:type=Memory", 1000); err == nil || !strings.Contains(err.Error(), "EOF") {
+		t.Errorf("Expected the last error after 3 attempts, got %v", err)
+	}
+	if client.opens != 2 {
+		t.Errorf("Expected 2 reconnects, got %d", client.opens)
+	}
+}
+
+func TestRetryClientPermanentError(t *testing.T) {
+	client := failingClient(1, errors.New("java.lang.SecurityException: Authentication failed"))
+	c := newRetryClient(client, 3, 0)
+	c.sleep = func(time.Duration) { t.Error("Permanent errors must not be retried") }
+
+	if _, err := c.query("java.lang:type=Memory", 1000); err == nil {
+		t.Error("Expected an error")
+	}
+	if client.opens != 0 {
+		t.Errorf("Expected no reconnect, got %d", client.opens)
+	}
+}
+
+func TestAnnotateKeepsRetriable(t *testing.T) {
+	err := annotate(retriable(errors.New("connection reset")), "querying names for %s", "java.lang:*")
+	if !isRetriable(err) || err.Error() != "querying names for java.lang:*: connection reset" {
+		t.Errorf("Unexpected annotated error %#v", err)
+	}
+	if isRetriable(annotate(errors.New("denied"), "open")) {
+		t.Error("Permanent errors must stay permanent")
+	}
+}
+
+func TestExitErrorClassification(t *testing.T) {
+	if !isRetriable(exitError(errors.New("nrjmx exited with error: exit status 1 (SEVERE: connection refused)"))) {
+		t.Error("Expected a lost connection to be retriable")
+	}
+	if isRetriable(exitError(errors.New("nrjmx exited with error: exit status 1 (java.lang.SecurityException: Authentication failed!)"))) {
+		t.Error("Expected rejected credentials to be permanent")
+	}
+}
+
+func TestQueryJMXContinuesAfterFailedQuery(t *testing.T) {
+	client := &fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		if strings.Contains(name, "slow") {
+			return nil, retriable(errors.New("timeout while waiting for query"))
+		}
+		return map[string]interface{}{name + ",attr=Value": 1.0}, nil
+	}}
+
+	attributes := []*attributeRequest{{attrRegexp: regexp.MustCompile("attr=Value$"), metricName: "value", metricType: metric.GAUGE}}
+	collection := []*domainDefinition{
+		{
+			domain:    "test",
+			eventType: "TestSample",
+			beans: []*beanRequest{
+				{beanQuery: "type=slow", attributes: attributes},
+				{beanQuery: "type=fast", attributes: attributes},
+			},
+		},
+	}
+
+	i, _ := integration.New("jmxtest", "0.1.0")
+	if err := queryJMX(collection, client, &jmxTarget{}, i); err == nil {
+		t.Error("Expected the query error to be returned")
+	}
+	if len(i.Entities) != 1 || len(i.Entities[0].Metrics) != 1 || i.Entities[0].Metrics[0].Metrics["bean"] != "type=fast" {
+		t.Error("Expected the metrics of the bean after the failed query")
+	}
+}
+
+func TestRetryClientDeadline(t *testing.T) {
+	timeout := retriable(errors.New("timeout while waiting for query"))
+	client := failingClient(1, timeout)
+	c := newRetryClient(client, 3, 100*time.Millisecond)
+	c.sleep = func(time.Duration) { t.Error("Retries must not wait past the deadline") }
+	c.setDeadline(time.Now().Add(500 * time.Millisecond))
+
+	if _, err := c.query("java.lang:type=Memory", 1000); err == nil {
+		t.Error("Expected the error of the first attempt")
+	}
+
+	c.client = failingClient(1, timeout)
+	if _, errs := c.queryBatch([]string{"java.lang:type=Threading"}, [][]string{nil}, 1000); errs[0] == nil {
+		t.Error("Expected the error of the first attempt of the batch")
+	}
+	if client.opens != 0 {
+		t.Errorf("Expected no reconnect, got %d", client.opens)
+	}
+}
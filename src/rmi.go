@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Constants from the Java RMI wire protocol (JRMP)
+const (
+	jrmpMagic          = 0x4a524d49
+	jrmpVersion        = 2
+	jrmpStreamProtocol = 0x4b
+	jrmpProtocolAck    = 0x4e
+	jrmpCall           = 0x50
+	jrmpReturnData     = 0x51
+
+	rmiNormalReturn      = 1
+	rmiExceptionalReturn = 2
+
+	// registryInterfaceHash and registryLookupOp identify Registry.lookup
+	// for the pre-1.2 stub protocol that the registry still speaks
+	registryInterfaceHash = 4905912898345647071
+	registryLookupOp      = 2
+
+	// jmxRMIBindingName is the registry name of the connector started by
+	// the com.sun.management.jmxremote.port system property
+	jmxRMIBindingName = "jmxrmi"
+)
+
+var (
+	rmiNewClientHash     = rmiMethodHash("newClient(Ljava/lang/Object;)Ljavax/management/remote/rmi/RMIConnection;")
+	rmiQueryNamesHash    = rmiMethodHash("queryNames(Ljavax/management/ObjectName;Ljava/rmi/MarshalledObject;Ljavax/security/auth/Subject;)Ljava/util/Set;")
+	rmiGetMBeanInfoHash  = rmiMethodHash("getMBeanInfo(Ljavax/management/ObjectName;Ljavax/security/auth/Subject;)Ljavax/management/MBeanInfo;")
+	rmiGetAttributesHash = rmiMethodHash("getAttributes(Ljavax/management/ObjectName;[Ljava/lang/String;Ljavax/security/auth/Subject;)Ljavax/management/AttributeList;")
+	rmiCloseHash         = rmiMethodHash("close()V")
+
+	// errRMIUnsupportedOption is returned for connection options that only
+	// the nrjmx backend understands
+	errRMIUnsupportedOption = errors.New("the native backend does not support jmx_remote or Java keystores, use the nrjmx backend or PEM files")
+)
+
+// rmiMethodHash computes the hash the RMI 1.2 stub protocol uses to
+// identify a remote method: the first 8 bytes, little endian, of the SHA-1
+// of the method name and descriptor as written by DataOutput.writeUTF
+func rmiMethodHash(signature string) int64 {
+	b := encodeModifiedUTF8(signature)
+	h := sha1.New()
+	_ = binary.Write(h, binary.BigEndian, uint16(len(b)))
+	_, _ = h.Write(b)
+	return int64(binary.LittleEndian.Uint64(h.Sum(nil)[:8]))
+}
+
+// rmiObjID identifies a remote object within its endpoint
+type rmiObjID struct {
+	objNum int64
+	unique int32
+	time   int64
+	count  int16
+}
+
+// rmiRef is a live reference to a remote object, as found in a stub
+type rmiRef struct {
+	host string
+	port int32
+	tls  bool
+	id   rmiObjID
+}
+
+func (r rmiRef) endpoint() string {
+	return net.JoinHostPort(r.host, strconv.Itoa(int(r.port)))
+}
+
+// jrmpConn is a stream protocol connection to a single RMI endpoint. Calls
+// on a connection are sequential
+type jrmpConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// dialJRMP connects to an RMI endpoint. tlsConfig is used for TLS endpoints
+// when not nil, otherwise the server is verified with the system roots
+func dialJRMP(endpoint string, useTLS bool, tlsConfig *tls.Config, timeout time.Duration) (*jrmpConn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if useTLS {
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		config.ServerName, _, _ = net.SplitHostPort(endpoint)
+		conn, err = tls.DialWithDialer(dialer, "tcp", endpoint, config)
+	} else {
+		conn, err = dialer.Dial("tcp", endpoint)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &jrmpConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if err := c.handshake(timeout); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("JRMP handshake with %s: %s", endpoint, err)
+	}
+
+	return c, nil
+}
+
+func (c *jrmpConn) handshake(timeout time.Duration) error {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	_ = binary.Write(c.w, binary.BigEndian, uint32(jrmpMagic))
+	_ = binary.Write(c.w, binary.BigEndian, uint16(jrmpVersion))
+	_ = c.w.WriteByte(jrmpStreamProtocol)
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	ack, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ack != jrmpProtocolAck {
+		return fmt.Errorf("unexpected protocol acknowledgement %#x", ack)
+	}
+
+	// The server tells us how it sees our address, which we echo back as
+	// our own endpoint, as the Java client does
+	var hostLength uint16
+	if err := binary.Read(c.r, binary.BigEndian, &hostLength); err != nil {
+		return err
+	}
+	host := make([]byte, hostLength)
+	if _, err := io.ReadFull(c.r, host); err != nil {
+		return err
+	}
+	var port int32
+	if err := binary.Read(c.r, binary.BigEndian, &port); err != nil {
+		return err
+	}
+
+	_ = binary.Write(c.w, binary.BigEndian, hostLength)
+	_, _ = c.w.Write(host)
+	_ = binary.Write(c.w, binary.BigEndian, int32(0))
+	return c.w.Flush()
+}
+
+// call invokes a method on a remote object and returns the decoded result.
+// writeArgs writes the method arguments, and hasResult must be false for
+// void methods
+func (c *jrmpConn) call(id rmiObjID, op int32, hash int64, writeArgs func(w *javaWriter), hasResult bool, timeout time.Duration) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	w := newJavaWriter()
+	w.writeLong(id.objNum)
+	w.writeInt(id.unique)
+	w.writeLong(id.time)
+	w.writeShort(id.count)
+	w.writeInt(op)
+	w.writeLong(hash)
+	if writeArgs != nil {
+		writeArgs(w)
+	}
+
+	_ = c.w.WriteByte(jrmpCall)
+	_, _ = c.w.Write(w.bytes())
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	msg, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if msg != jrmpReturnData {
+		return nil, fmt.Errorf("unexpected JRMP message %#x", msg)
+	}
+
+	jr, err := newJavaReader(c.r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The return header is the return type followed by a UID used for
+	// distributed garbage collection acknowledgements, which we never send.
+	// Without DGC the server unexports the connection once its lease runs
+	// out, see rmiError
+	header, err := jr.readContent()
+	if err != nil {
+		return nil, err
+	}
+	b, ok := header.([]byte)
+	if !ok || len(b) < 15 {
+		return nil, errors.New("invalid RMI return header")
+	}
+
+	switch b[0] {
+	case rmiNormalReturn:
+		if !hasResult {
+			return nil, nil
+		}
+		return jr.readObject()
+	case rmiExceptionalReturn:
+		throwable, err := jr.readObject()
+		if err != nil {
+			return nil, err
+		}
+		return nil, &javaException{throwable: throwable}
+	default:
+		return nil, fmt.Errorf("invalid RMI return type %d", b[0])
+	}
+}
+
+func (c *jrmpConn) close() {
+	_ = c.conn.Close()
+}
+
+// rmiClient is a JMX client that speaks the RMI connector protocol
+// directly, so no JVM is needed on the collector host
+type rmiClient struct {
+	host string
+	port string
+	// bindingName is the name the connector is registered with in the RMI registry
+	bindingName string
+	user        string
+	password    string
+	// tlsConfig is used for connectors exported over SSL. When set, the
+	// connector must use SSL
+	tlsConfig *tls.Config
+	// connectTimeout bounds the registry lookup and newClient calls, in milliseconds
+	connectTimeout int
+	// connection is the RMIConnection returned by RMIServer.newClient
+	connection rmiRef
+	conns      map[string]*jrmpConn
+	// catalog caches the beans matched by each query, when enabled
+	catalog *nameCatalog
+}
+
+func newRMIClient(host, port, bindingName, user, password string, connectTimeout int, tlsConfig *tls.Config) *rmiClient {
+	return &rmiClient{
+		host:           host,
+		port:           port,
+		bindingName:    bindingName,
+		user:           user,
+		password:       password,
+		connectTimeout: connectTimeout,
+		tlsConfig:      tlsConfig,
+		conns:          make(map[string]*jrmpConn),
+	}
+}
+
+// open looks up the JMX connector server in the RMI registry and creates
+// a new client connection on it
+func (c *rmiClient) open() error {
+	t := time.Duration(c.connectTimeout) * time.Millisecond
+
+	registry, err := dialJRMP(net.JoinHostPort(c.host, c.port), false, nil, t)
+	if err != nil {
+		return retriable(err)
+	}
+	defer registry.close()
+
+	stub, err := registry.call(rmiObjID{}, registryLookupOp, registryInterfaceHash, func(w *javaWriter) {
+		w.writeString(c.bindingName)
+	}, true, t)
+	if err != nil {
+		return annotate(rmiError(err), "looking up %s in the RMI registry", c.bindingName)
+	}
+	server, err := remoteRef(stub)
+	if err != nil {
+		return err
+	}
+	if c.tlsConfig != nil && !server.tls {
+		return errors.New("the JMX connector is not exported over SSL, but tls_ca_file is set")
+	}
+
+	stub, err = c.invoke(server, rmiNewClientHash, func(w *javaWriter) {
+		if c.user != "" && c.password != "" {
+			w.writeStringArray([]string{c.user, c.password})
+		} else {
+			w.writeNull()
+		}
+	}, true, t)
+	if err != nil {
+		return annotate(err, "creating JMX connection")
+	}
+	c.connection, err = remoteRef(stub)
+	return err
+}
+
+// invoke calls a method on a remote object, reusing the connection to its
+// endpoint if there is one
+func (c *rmiClient) invoke(ref rmiRef, hash int64, writeArgs func(w *javaWriter), hasResult bool, timeout time.Duration) (interface{}, error) {
+	conn, ok := c.conns[ref.endpoint()]
+	if !ok {
+		var err error
+		if conn, err = dialJRMP(ref.endpoint(), ref.tls, c.tlsConfig, timeout); err != nil {
+			return nil, retriable(err)
+		}
+		c.conns[ref.endpoint()] = conn
+	}
+
+	result, err := conn.call(ref.id, -1, hash, writeArgs, hasResult, timeout)
+	if _, remote := err.(*javaException); err != nil && !remote {
+		// The stream is in an unknown state, don't reuse it
+		conn.close()
+		delete(c.conns, ref.endpoint())
+	}
+	return result, rmiError(err)
+}
+
+// rmiError marks err as retriable unless the server threw it. Exceptions
+// such as a SecurityException are answers, while anything else means the
+// connection was lost. A NoSuchObjectException is retriable too: the
+// server throws it once it has unexported a connection whose DGC lease ran
+// out, and a new connection gets past it
+func rmiError(err error) error {
+	e, remote := err.(*javaException)
+	if err == nil || remote && !e.isA("java.rmi.NoSuchObjectException") {
+		return err
+	}
+	return retriable(err)
+}
+
+// query has the same signature and output format as jmx.Query. It lists the
+// beans matching objectPattern, then reads every readable attribute of each
+func (c *rmiClient) query(objectPattern string, timeout int) (map[string]interface{}, error) {
+	return c.queryAttributes(objectPattern, nil, timeout)
+}
+
+// queryAttributes is query, reading only attrNames of every matching bean.
+// The MBean info isn't requested then, saving a call per bean
+func (c *rmiClient) queryAttributes(objectPattern string, attrNames []string, timeout int) (map[string]interface{}, error) {
+	t := time.Duration(timeout) * time.Millisecond
+
+	names, cached := c.catalog.lookup(objectPattern)
+	if !cached {
+		var err error
+		if names, err = c.queryNames(objectPattern, t); err != nil {
+			return nil, annotate(err, "querying names for %s", objectPattern)
+		}
+		c.catalog.remember(objectPattern, names)
+	}
+	// stale searches the names again when a cached bean is gone
+	stale := func(err error) bool {
+		return cached && strings.Contains(err.Error(), "InstanceNotFoundException")
+	}
+
+	result := make(map[string]interface{})
+	for _, name := range names {
+		readNames := attrNames
+		if readNames == nil {
+			var err error
+			readNames, err = c.readableAttributes(name, t)
+			if isRetriable(err) {
+				return nil, annotate(err, "getting MBean info for %s", name)
+			}
+			if err != nil && stale(err) {
+				c.catalog.forget(objectPattern)
+				return c.queryAttributes(objectPattern, attrNames, timeout)
+			}
+			if err != nil {
+				// The bean may have been unregistered after the name query
+				logger.Warnf("Failed to get MBean info for %s: %s", name, err)
+				continue
+			}
+		}
+		if len(readNames) == 0 {
+			continue
+		}
+
+		// Attributes that the bean doesn't have are left out of the list
+		attributes, err := c.getAttributes(name, readNames, t)
+		if isRetriable(err) {
+			return nil, annotate(err, "getting attributes for %s", name)
+		}
+		if err != nil && stale(err) {
+			c.catalog.forget(objectPattern)
+			return c.queryAttributes(objectPattern, attrNames, timeout)
+		}
+		if err != nil {
+			logger.Warnf("Failed to get attributes for %s: %s", name, err)
+			continue
+		}
+		for attrName, attrValue := range attributes {
+			flattenAttributeValue(result, name, attrName, attrValue)
+		}
+	}
+
+	return result, nil
+}
+
+// listNames returns the names of the beans matching objectPattern
+func (c *rmiClient) listNames(objectPattern string, timeout int) ([]string, error) {
+	if names, ok := c.catalog.lookup(objectPattern); ok {
+		return names, nil
+	}
+	names, err := c.queryNames(objectPattern, time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		return nil, annotate(err, "querying names for %s", objectPattern)
+	}
+	c.catalog.remember(objectPattern, names)
+	return names, nil
+}
+
+func (c *rmiClient) queryNames(objectPattern string, timeout time.Duration) ([]string, error) {
+	set, err := c.invoke(c.connection, rmiQueryNamesHash, func(w *javaWriter) {
+		w.writeObjectName(objectPattern)
+		w.writeNull()
+		w.writeNull()
+	}, true, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := set.(*javaObject)
+	if !ok || !obj.class.isA("java.util.HashSet") {
+		return nil, errors.New("queryNames did not return a set")
+	}
+
+	var names []string
+	for _, element := range newBlockCursor(obj.annotations["java.util.HashSet"]).objects() {
+		name, err := objectNameString(element)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+func (c *rmiClient) readableAttributes(name string, timeout time.Duration) ([]string, error) {
+	info, err := c.invoke(c.connection, rmiGetMBeanInfoHash, func(w *javaWriter) {
+		w.writeObjectName(name)
+		w.writeNull()
+	}, true, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := info.(*javaObject)
+	if !ok {
+		return nil, errors.New("getMBeanInfo did not return an object")
+	}
+	attributes, ok := obj.fields["attributes"].(*javaArray)
+	if !ok {
+		return nil, nil
+	}
+
+	var names []string
+	for _, v := range attributes.values {
+		attribute, ok := v.(*javaObject)
+		if !ok {
+			continue
+		}
+		attrName, _ := attribute.fields["name"].(string)
+		if readable, _ := attribute.fields["isRead"].(bool); readable && attrName != "" {
+			names = append(names, attrName)
+		}
+	}
+
+	return names, nil
+}
+
+func (c *rmiClient) getAttributes(name string, attrNames []string, timeout time.Duration) (map[string]interface{}, error) {
+	list, err := c.invoke(c.connection, rmiGetAttributesHash, func(w *javaWriter) {
+		w.writeObjectName(name)
+		w.writeStringArray(attrNames)
+		w.writeNull()
+	}, true, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := list.(*javaObject)
+	if !ok || !obj.class.isA("java.util.ArrayList") {
+		return nil, errors.New("getAttributes did not return a list")
+	}
+
+	attributes := make(map[string]interface{})
+	for _, element := range newBlockCursor(obj.annotations["java.util.ArrayList"]).objects() {
+		attribute, ok := element.(*javaObject)
+		if !ok {
+			continue
+		}
+		attrName, _ := attribute.fields["name"].(string)
+		attributes[attrName] = javaToGo(attribute.fields["value"])
+	}
+
+	return attributes, nil
+}
+
+// close closes the JMX connection on the server and every open socket
+func (c *rmiClient) close() {
+	if c.connection.host != "" {
+		if _, err := c.invoke(c.connection, rmiCloseHash, nil, false, 5*time.Second); err != nil {
+			logger.Debugf("Failed to close JMX connection: %s", err)
+		}
+	}
+	for endpoint, conn := range c.conns {
+		conn.close()
+		delete(c.conns, endpoint)
+	}
+	c.connection = rmiRef{}
+}
+
+// remoteRef extracts the live reference from a decoded stub, either a
+// generated RemoteStub subclass or a dynamic proxy with a
+// RemoteObjectInvocationHandler
+func remoteRef(stub interface{}) (rmiRef, error) {
+	obj, ok := stub.(*javaObject)
+	if !ok {
+		return rmiRef{}, errors.New("remote reference is not an object")
+	}
+	if obj.class.proxyInterfaces != nil || obj.class.isA("java.lang.reflect.Proxy") {
+		return remoteRef(obj.fields["h"])
+	}
+
+	contents, ok := obj.annotations["java.rmi.server.RemoteObject"]
+	if !ok {
+		return rmiRef{}, fmt.Errorf("%s is not a remote object", obj.class.name)
+	}
+
+	return parseLiveRef(newBlockCursor(contents))
+}
+
+// parseLiveRef decodes the data written by RemoteObject.writeObject
+func parseLiveRef(bc *blockCursor) (rmiRef, error) {
+	var ref rmiRef
+
+	refClass, err := bc.readUTF()
+	if err != nil {
+		return ref, err
+	}
+
+	format := byte(0)
+	switch refClass {
+	case "UnicastRef":
+	case "UnicastRef2":
+		if format, err = bc.readByte(); err != nil {
+			return ref, err
+		}
+	default:
+		return ref, fmt.Errorf("unsupported remote reference type %s", refClass)
+	}
+
+	if ref.host, err = bc.readUTF(); err != nil {
+		return ref, err
+	}
+	if ref.port, err = bc.readInt(); err != nil {
+		return ref, err
+	}
+
+	// Format 1 carries the client socket factory the stub must use
+	if format == 1 {
+		factory, err := bc.readObject()
+		if err != nil {
+			return ref, err
+		}
+		if f, ok := factory.(*javaObject); ok {
+			if !f.class.isA("javax.rmi.ssl.SslRMIClientSocketFactory") {
+				return ref, fmt.Errorf("unsupported RMI client socket factory %s", f.class.name)
+			}
+			ref.tls = true
+		}
+	}
+
+	if ref.id.objNum, err = bc.readLong(); err != nil {
+		return ref, err
+	}
+	if ref.id.unique, err = bc.readInt(); err != nil {
+		return ref, err
+	}
+	if ref.id.time, err = bc.readLong(); err != nil {
+		return ref, err
+	}
+	if ref.id.count, err = bc.readShort(); err != nil {
+		return ref, err
+	}
+
+	return ref, nil
+}
+
+// objectNameString returns the canonical name of a decoded ObjectName
+func objectNameString(v interface{}) (string, error) {
+	obj, ok := v.(*javaObject)
+	if !ok || !obj.class.isA("javax.management.ObjectName") {
+		return "", errors.New("expected an ObjectName")
+	}
+	name, err := newBlockCursor(obj.annotations["javax.management.ObjectName"]).readObject()
+	if err != nil {
+		return "", err
+	}
+	s, ok := name.(string)
+	if !ok {
+		return "", errors.New("invalid ObjectName")
+	}
+	return s, nil
+}
+
+// javaToGo converts a decoded attribute value into the types nrjmx
+// reports: numbers as float64, strings, booleans and composite data as
+// maps. Any other type is returned as nil and skipped
+func javaToGo(v interface{}) interface{} {
+	switch value := v.(type) {
+	case string:
+		return value
+	case *javaObject:
+		switch {
+		case value.class.isA("java.lang.Number"):
+			return javaNumber(value.fields["value"])
+		case value.class.name == "java.lang.Boolean":
+			b, _ := value.fields["value"].(bool)
+			return b
+		case value.class.name == "java.lang.Character":
+			c, _ := value.fields["value"].(uint16)
+			return string(rune(c))
+		case value.class.isA("javax.management.openmbean.CompositeDataSupport"):
+			return compositeToMap(value)
+		}
+	}
+	return nil
+}
+
+func javaNumber(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int8:
+		return float64(n)
+	case int16:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		if math.IsNaN(float64(n)) || math.IsInf(float64(n), 0) {
+			return nil
+		}
+		return float64(n)
+	case float64:
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil
+		}
+		return n
+	}
+	// BigInteger and BigDecimal have no "value" field
+	return nil
+}
+
+// compositeToMap converts CompositeDataSupport, whose items are held in a
+// TreeMap written as a size followed by key/value pairs
+func compositeToMap(composite *javaObject) map[string]interface{} {
+	items := make(map[string]interface{})
+
+	contents, ok := composite.fields["contents"].(*javaObject)
+	if !ok {
+		return items
+	}
+
+	pairs := newBlockCursor(contents.annotations["java.util.TreeMap"]).objects()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if key, ok := pairs[i].(string); ok {
+			items[key] = javaToGo(pairs[i+1])
+		}
+	}
+
+	return items
+}
+
+// validateRMIOptions rejects connection settings the native backend can't honour
+func validateRMIOptions(remote bool, keyStore, trustStore string) error {
+	if remote || keyStore != "" || trustStore != "" {
+		return errRMIUnsupportedOption
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kr/pretty"
+)
+
+var (
+	testRemoteObject = &javaClass{name: "java.rmi.server.RemoteObject", suid: -3215090123894869218, flags: scSerializable | scWriteMethod}
+	testRemoteStub   = &javaClass{name: "java.rmi.server.RemoteStub", suid: -1585587260594494182, flags: scSerializable, super: testRemoteObject}
+	testServerStub   = &javaClass{name: "javax.management.remote.rmi.RMIServerImpl_Stub", suid: 2, flags: scSerializable, super: testRemoteStub}
+	testConnStub     = &javaClass{name: "javax.management.remote.rmi.RMIConnectionImpl_Stub", suid: 2, flags: scSerializable, super: testRemoteStub}
+	testHashSet      = &javaClass{name: "java.util.HashSet", suid: -5024744406713321676, flags: scSerializable | scWriteMethod}
+	testFeatureInfo  = &javaClass{
+		name:  "javax.management.MBeanFeatureInfo",
+		flags: scSerializable | scWriteMethod,
+		fields: []javaField{
+			{typeCode: 'L', name: "description", className: "Ljava/lang/String;"},
+			{typeCode: 'L', name: "name", className: "Ljava/lang/String;"},
+		},
+	}
+	testAttributeInfo = &javaClass{
+		name:  "javax.management.MBeanAttributeInfo",
+		flags: scSerializable,
+		fields: []javaField{
+			{typeCode: 'Z', name: "is"},
+			{typeCode: 'Z', name: "isRead"},
+			{typeCode: 'Z', name: "isWrite"},
+			{typeCode: 'L', name: "attributeType", className: "Ljava/lang/String;"},
+		},
+		super: testFeatureInfo,
+	}
+	testAttributeInfoArray = &javaClass{name: "[Ljavax.management.MBeanAttributeInfo;", flags: scSerializable}
+	testMBeanInfo          = &javaClass{
+		name:  "javax.management.MBeanInfo",
+		flags: scSerializable | scWriteMethod,
+		fields: []javaField{
+			{typeCode: '[', name: "attributes", className: "[Ljavax/management/MBeanAttributeInfo;"},
+			{typeCode: 'L', name: "className", className: "Ljava/lang/String;"},
+		},
+	}
+	testArrayList     = &javaClass{name: "java.util.ArrayList", flags: scSerializable | scWriteMethod, fields: []javaField{{typeCode: 'I', name: "size"}}}
+	testAttributeList = &javaClass{name: "javax.management.AttributeList", flags: scSerializable, super: testArrayList}
+	testAttribute     = &javaClass{
+		name:  "javax.management.Attribute",
+		flags: scSerializable,
+		fields: []javaField{
+			{typeCode: 'L', name: "name", className: "Ljava/lang/String;"},
+			{typeCode: 'L', name: "value", className: "Ljava/lang/Object;"},
+		},
+	}
+	testNumber    = &javaClass{name: "java.lang.Number", flags: scSerializable}
+	testLong      = &javaClass{name: "java.lang.Long", flags: scSerializable, fields: []javaField{{typeCode: 'J', name: "value"}}, super: testNumber}
+	testThrowable = &javaClass{
+		name:   "java.lang.Throwable",
+		flags:  scSerializable | scWriteMethod,
+		fields: []javaField{{typeCode: 'L', name: "detailMessage", className: "Ljava/lang/String;"}},
+	}
+	testSecurityException = &javaClass{name: "java.lang.SecurityException", flags: scSerializable, super: testThrowable}
+)
+
+// rmiScript is the server side of a JRMP exchange: for each method hash it
+// knows how many arguments to consume and writes the canned return value
+type rmiScript struct {
+	port     int32
+	user     string
+	password string
+	beans    map[string]map[string]int64
+	calls    []int64
+	// open counts the client connections that are still open
+	open int32
+}
+
+func (s *rmiScript) writeStub(w *javaWriter, class *javaClass, refType string, objNum int64) {
+	writeTestObject(w, class, func() {
+		w.writeUTF(refType)
+		if refType == "UnicastRef2" {
+			w.writeByte(0)
+		}
+		w.writeUTF("127.0.0.1")
+		w.writeInt(s.port)
+		w.writeLong(objNum)
+		w.writeInt(0)
+		w.writeLong(0)
+		w.writeShort(0)
+		w.writeBool(false)
+		endAnnotation(w)
+	})
+}
+
+// respond reads the arguments of a call and writes its return value. A
+// non-nil exception is written as an exceptional return
+func (s *rmiScript) respond(hash int64, args []interface{}, w *javaWriter) (exception string) {
+	switch hash {
+	case registryInterfaceHash:
+		s.writeStub(w, testServerStub, "UnicastRef", 1)
+	case rmiNewClientHash:
+		credentials, _ := args[0].(*javaArray)
+		if credentials == nil || !reflect.DeepEqual(credentials.values, []interface{}{s.user, s.password}) {
+			return "Authentication failed! Invalid username or password"
+		}
+		s.writeStub(w, testConnStub, "UnicastRef2", 2)
+	case rmiQueryNamesHash:
+		pattern, _ := objectNameString(args[0])
+		domain := strings.SplitN(pattern, ":", 2)[0]
+		writeTestObject(w, testHashSet, func() {
+			w.writeInt(16)
+			w.writeInt(0x3f400000)
+			w.writeInt(int32(len(s.beans)))
+			for name := range s.beans {
+				if strings.HasPrefix(name, domain+":") {
+					w.writeObjectName(name)
+				}
+			}
+			endAnnotation(w)
+		})
+	case rmiGetMBeanInfoHash:
+		name, _ := objectNameString(args[0])
+		writeTestObject(w, testMBeanInfo, func() {
+			w.out.WriteByte(tcArray)
+			w.writeClassDesc(testAttributeInfoArray)
+			writeRawField(w, int32(len(s.beans[name])+1))
+			for attr := range s.beans[name] {
+				s.writeAttributeInfo(w, attr, true)
+			}
+			s.writeAttributeInfo(w, "WriteOnly", false)
+			w.writeString("com.example.Bean")
+			endAnnotation(w)
+		})
+	case rmiGetAttributesHash:
+		name, _ := objectNameString(args[0])
+		// Like an MBean server, leave out the attributes the bean doesn't have
+		var requested []interface{}
+		for _, attr := range args[1].(*javaArray).values {
+			if _, ok := s.beans[name][attr.(string)]; ok {
+				requested = append(requested, attr)
+			}
+		}
+		writeTestObject(w, testAttributeList, func() {
+			writeRawField(w, int32(len(requested)))
+			w.writeInt(int32(len(requested)))
+			for _, attr := range requested {
+				writeTestObject(w, testAttribute, func() {
+					w.writeString(attr.(string))
+					writeTestObject(w, testLong, func() { writeRawField(w, s.beans[name][attr.(string)]) })
+				})
+			}
+			endAnnotation(w)
+		})
+	}
+	return ""
+}
+
+func (s *rmiScript) writeAttributeInfo(w *javaWriter, name string, readable bool) {
+	writeTestObject(w, testAttributeInfo, func() {
+		w.writeNull()
+		w.writeString(name)
+		endAnnotation(w)
+		writeRawField(w, false)
+		writeRawField(w, readable)
+		writeRawField(w, !readable)
+		w.writeString("long")
+	})
+}
+
+func (s *rmiScript) serve(t *testing.T, conn net.Conn) {
+	atomic.AddInt32(&s.open, 1)
+	defer func() {
+		atomic.AddInt32(&s.open, -1)
+		_ = conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	w := bufio.NewWriter(conn)
+	_ = w.WriteByte(jrmpProtocolAck)
+	_ = binary.Write(w, binary.BigEndian, uint16(9))
+	_, _ = w.WriteString("127.0.0.1")
+	_ = binary.Write(w, binary.BigEndian, int32(50000))
+	_ = w.Flush()
+
+	var hostLength uint16
+	_ = binary.Read(r, binary.BigEndian, &hostLength)
+	_, _ = io.ReadFull(r, make([]byte, hostLength+4))
+
+	argCounts := map[int64]int{
+		registryInterfaceHash: 1,
+		rmiNewClientHash:      1,
+		rmiQueryNamesHash:     3,
+		rmiGetMBeanInfoHash:   2,
+		rmiGetAttributesHash:  3,
+		rmiCloseHash:          0,
+	}
+
+	for {
+		msg, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		if msg != jrmpCall {
+			t.Errorf("Unexpected JRMP message %#x", msg)
+			return
+		}
+
+		jr, err := newJavaReader(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		callHeader, err := jr.readContent()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		hash := int64(binary.BigEndian.Uint64(callHeader.([]byte)[26:34]))
+		s.calls = append(s.calls, hash)
+
+		count, ok := argCounts[hash]
+		if !ok {
+			t.Errorf("Unexpected method hash %d", hash)
+			return
+		}
+		var args []interface{}
+		for i := 0; i < count; i++ {
+			arg, err := jr.readObject()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			args = append(args, arg)
+		}
+
+		out := newJavaWriter()
+		body := newJavaWriter()
+		body.out.Reset()
+		exception := s.respond(hash, args, body)
+		if exception != "" {
+			out.writeByte(rmiExceptionalReturn)
+		} else {
+			out.writeByte(rmiNormalReturn)
+		}
+		out.writeInt(0)
+		out.writeLong(0)
+		out.writeShort(0)
+		out.flush()
+		if exception != "" {
+			writeTestObject(out, testSecurityException, func() {
+				out.writeString(exception)
+				endAnnotation(out)
+			})
+		} else {
+			out.out.Write(body.bytes())
+		}
+
+		_ = w.WriteByte(jrmpReturnData)
+		_, _ = w.Write(out.bytes())
+		_ = w.Flush()
+	}
+}
+
+func startRMIScript(t *testing.T, script *rmiScript) (net.Listener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script.port = int32(l.Addr().(*net.TCPAddr).Port)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go script.serve(t, conn)
+		}
+	}()
+
+	return l, fmt.Sprintf("%d", script.port)
+}
+
+func TestRMIClientQuery(t *testing.T) {
+	script := &rmiScript{
+		user:     "admin",
+		password: "secret",
+		beans: map[string]map[string]int64{
+			"java.lang:name=Copy,type=GarbageCollector": {"CollectionCount": 12, "CollectionTime": 340},
+		},
+	}
+	l, port := startRMIScript(t, script)
+	defer func() {
+		_ = l.Close()
+	}()
+
+	c := newRMIClient("127.0.0.1", port, jmxRMIBindingName, "admin", "secret", 1000, nil)
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.query("java.lang:type=GarbageCollector,*", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.close()
+
+	expected := map[string]interface{}{
+		"java.lang:name=Copy,type=GarbageCollector,attr=CollectionCount": 12.0,
+		"java.lang:name=Copy,type=GarbageCollector,attr=CollectionTime":  340.0,
+	}
+	if !reflect.DeepEqual(expected, result) {
+		fmt.Println(pretty.Diff(expected, result))
+		t.Error("Failed to produce expected result")
+	}
+
+	if last := script.calls[len(script.calls)-1]; last != rmiCloseHash {
+		t.Errorf("Expected the connection to be closed, last call was %d", last)
+	}
+}
+
+func TestRMIClientQueryAttributes(t *testing.T) {
+	script := &rmiScript{
+		user:     "admin",
+		password: "secret",
+		beans: map[string]map[string]int64{
+			"java.lang:name=Copy,type=GarbageCollector":          {"CollectionCount": 12, "CollectionTime": 340},
+			"kafka.consumer:type=consumer-fetch-manager-metrics": {"records.lag.max": 7},
+		},
+	}
+	l, port := startRMIScript(t, script)
+	defer func() {
+		_ = l.Close()
+	}()
+
+	c := newRMIClient("127.0.0.1", port, jmxRMIBindingName, "admin", "secret", 1000, nil)
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	// A dotted attribute name is read along with its prefixes, which the
+	// bean doesn't have
+	result, err := c.queryAttributes("kafka.consumer:type=consumer-fetch-manager-metrics", []string{"records.lag.max", "records.lag", "records"}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]interface{}{"kafka.consumer:type=consumer-fetch-manager-metrics,attr=records.lag.max": 7.0}; !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+
+	result, err = c.queryAttributes("java.lang:type=GarbageCollector,*", []string{"CollectionCount"}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"java.lang:name=Copy,type=GarbageCollector,attr=CollectionCount": 12.0}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+	for _, call := range script.calls {
+		if call == rmiGetMBeanInfoHash {
+			t.Error("Expected the MBean info not to be requested")
+		}
+	}
+}
+
+func TestRMIClientBadCredentials(t *testing.T) {
+	script := &rmiScript{user: "admin", password: "secret"}
+	l, port := startRMIScript(t, script)
+	defer func() {
+		_ = l.Close()
+	}()
+
+	c := newRMIClient("127.0.0.1", port, jmxRMIBindingName, "admin", "wrong", 1000, nil)
+	err := c.open()
+	if err == nil || !strings.Contains(err.Error(), "java.lang.SecurityException: Authentication failed") {
+		t.Errorf("Expected authentication error, got %v", err)
+	}
+	c.close()
+}
+
+func TestRMIMethodHash(t *testing.T) {
+	// Values from the JDK generated RMIConnectionImpl_Stub and RMIServerImpl_Stub
+	if rmiCloseHash != -4742752445160157748 {
+		t.Errorf("Unexpected hash for close: %d", rmiCloseHash)
+	}
+	if rmiNewClientHash != -1089742558549201240 {
+		t.Errorf("Unexpected hash for newClient: %d", rmiNewClientHash)
+	}
+}
+
+func TestRMIError(t *testing.T) {
+	noSuchObject := &javaClass{name: "java.rmi.NoSuchObjectException", flags: scSerializable, super: testThrowable}
+	testCases := []struct {
+		err       error
+		retriable bool
+	}{
+		{&javaException{throwable: &javaObject{class: testSecurityException}}, false},
+		{&javaException{throwable: &javaObject{class: noSuchObject}}, true},
+		{io.EOF, true},
+	}
+	for _, tc := range testCases {
+		if retriable := isRetriable(rmiError(tc.err)); retriable != tc.retriable {
+			t.Errorf("Expected %v to be retriable %t", tc.err, tc.retriable)
+		}
+	}
+}
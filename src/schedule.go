@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+// intervalTolerance lets a bean be collected on a run that starts slightly
+// before its interval has elapsed, so that the jitter of the agent's run
+// schedule doesn't delay it by a whole run
+const intervalTolerance = time.Second
+
+// collectionStore keeps the time every bean with an interval was last
+// collected. It is the integration's persist.Storer, so the times survive
+// between one-shot runs. When nil, every bean is collected on every run
+var collectionStore persist.Storer
+
+// parseInterval reads an interval as a Go duration such as "5m", or as a
+// number of seconds. An empty interval is 0, collected on every run
+func parseInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		value = fmt.Sprintf("%ds", seconds)
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		return 0, fmt.Errorf("invalid interval %q, use a duration such as 5m or a number of seconds", value)
+	}
+	return interval, nil
+}
+
+// collectionKey identifies a bean query of a target in the store
+func collectionKey(target *jmxTarget, query string) string {
+	return "last-collection:" + target.String() + ":" + query
+}
+
+// isDue reports whether a bean query with an interval was last collected
+// at least interval ago, or never
+func isDue(key string, interval time.Duration, now time.Time) bool {
+	if interval <= 0 || collectionStore == nil {
+		return true
+	}
+
+	var last int64
+	if _, err := collectionStore.Get(key, &last); err != nil {
+		return true
+	}
+	return now.Sub(time.Unix(0, last)) >= interval-intervalTolerance
+}
+
+// markCollected records that a bean query with an interval was collected
+func markCollected(key string, interval time.Duration, now time.Time) {
+	if interval <= 0 || collectionStore == nil {
+		return
+	}
+	collectionStore.Set(key, now.UnixNano())
+}
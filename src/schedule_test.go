@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/integration"
+	"github.com/newrelic/infra-integrations-sdk/persist"
+)
+
+func TestParseInterval(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected time.Duration
+		fail     bool
+	}{
+		{"", 0, false},
+		{"300", 5 * time.Minute, false},
+		{"90s", 90 * time.Second, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"-5m", 0, true},
+		{"often", 0, true},
+	}
+	for _, tc := range testCases {
+		interval, err := parseInterval(tc.input)
+		if (err != nil) != tc.fail || interval != tc.expected {
+			t.Errorf("Expected %s (fail: %t) for %q, got %s, %v", tc.expected, tc.fail, tc.input, interval, err)
+		}
+	}
+}
+
+func TestParseIntervals(t *testing.T) {
+	file, _ := ioutil.ReadFile("../test/infra-intervals.yml")
+	domains, err := infraJmxParser{}.parse(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Duration{
+		"type=Memory":                  0,
+		"type=GarbageCollector,name=*": 0,
+		"type=Pool (*)":                5 * time.Minute,
+		"type=PoolConfig (*)":          30 * time.Second,
+	}
+	for _, domain := range domains {
+		for _, bean := range domain.beans {
+			if bean.interval != expected[bean.beanQuery] {
+				t.Errorf("Expected interval %s for %s, got %s", expected[bean.beanQuery], bean.beanQuery, bean.interval)
+			}
+		}
+	}
+
+	if _, err := (infraJmxParser{}).parse([]byte("collect:\n  - domain: java.lang\n    interval: weekly\n")); err == nil {
+		t.Error("Expected an invalid domain interval to fail")
+	}
+}
+
+func TestQueryJMXIntervals(t *testing.T) {
+	saved := collectionStore
+	collectionStore = persist.NewInMemoryStore()
+	defer func() {
+		collectionStore = saved
+	}()
+
+	file, _ := ioutil.ReadFile("../test/infra-intervals.yml")
+	domains, _ := infraJmxParser{}.parse(file)
+	target := &jmxTarget{JmxHost: "localhost", JmxPort: "9999"}
+	i, _ := integration.New("jmxtest", "0.1.0")
+
+	queried := make(map[string]int)
+	client := &fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		queried[name]++
+		return map[string]interface{}{}, nil
+	}}
+	for run := 0; run < 2; run++ {
+		if err := queryJMX(domains, client, target, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]int{
+		"java.lang:type=Memory":                  2,
+		"java.lang:type=GarbageCollector,name=*": 2,
+		"com.zaxxer.hikari:type=Pool (*)":        1,
+		"com.zaxxer.hikari:type=PoolConfig (*)":  1,
+	}
+	for query, count := range expected {
+		if queried[query] != count {
+			t.Errorf("Expected %s to be queried %d times, got %d", query, count, queried[query])
+		}
+	}
+
+	// Once the interval has elapsed, the bean is due again
+	key := collectionKey(target, "com.zaxxer.hikari:type=PoolConfig (*)")
+	if isDue(key, 30*time.Second, time.Now()) {
+		t.Error("Expected the bean not to be due right after its collection")
+	}
+	if !isDue(key, 30*time.Second, time.Now().Add(30*time.Second)) {
+		t.Error("Expected the bean to be due once its interval elapsed")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	secretFilePrefix      = "file:"
+	secretEnvPrefix       = "env:"
+	secretExecPrefix      = "exec:"
+	secretJmxRemotePrefix = "jmxremote:"
+
+	// secretCommandTimeout bounds the run time of exec: secret helpers
+	secretCommandTimeout = 30 * time.Second
+)
+
+// secretResolver turns secret references into their values. A reference is
+// resolved only once per run, however many targets share it:
+//
+//	file:/path         the content of the file
+//	env:VAR            the value of an environment variable
+//	exec:command args  the standard output of a command
+//	jmxremote:/path    the password of the user in a jmxremote.password file
+//
+// Any other value is used as is
+type secretResolver struct {
+	resolved map[string]string
+}
+
+func newSecretResolver() *secretResolver {
+	return &secretResolver{resolved: make(map[string]string)}
+}
+
+// resolve returns the secret referenced by value. user selects the entry
+// of jmxremote.password files
+func (r *secretResolver) resolve(value, user string) (string, error) {
+	cacheKey := value
+	if strings.HasPrefix(value, secretJmxRemotePrefix) {
+		cacheKey = user + "@" + value
+	}
+	if secret, ok := r.resolved[cacheKey]; ok {
+		return secret, nil
+	}
+
+	var secret string
+	var err error
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		secret, err = readSecretFile(strings.TrimPrefix(value, secretFilePrefix))
+	case strings.HasPrefix(value, secretEnvPrefix):
+		secret, err = readSecretEnv(strings.TrimPrefix(value, secretEnvPrefix))
+	case strings.HasPrefix(value, secretExecPrefix):
+		secret, err = runSecretCommand(strings.TrimPrefix(value, secretExecPrefix))
+	case strings.HasPrefix(value, secretJmxRemotePrefix):
+		secret, err = readJmxRemotePassword(strings.TrimPrefix(value, secretJmxRemotePrefix), user)
+	default:
+		return value, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	r.resolved[cacheKey] = secret
+	return secret, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading secret file: %s", err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func readSecretEnv(name string) (string, error) {
+	secret, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("secret environment variable %s is not set", name)
+	}
+	return secret, nil
+}
+
+// runSecretCommand runs a helper and returns its standard output without the
+// trailing newline. The output is never included in errors
+func runSecretCommand(command string) (string, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", errors.New("empty secret command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, fields[0], fields[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running secret command %s: %s (%s)", fields[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// readJmxRemotePassword looks up user in a file with the format of the JDK
+// jmxremote.password file: one "user password" pair per line, and comments
+// starting with #
+func readJmxRemotePassword(path, user string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading jmxremote password file: %s", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == user {
+			return fields[1], nil
+		}
+	}
+
+	return "", fmt.Errorf("user %s not found in jmxremote password file %s", user, path)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nri-jmx-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	secretFile := filepath.Join(dir, "jmx.pass")
+	passwordFile := filepath.Join(dir, "jmxremote.password")
+	_ = ioutil.WriteFile(secretFile, []byte("from-file\n"), 0600)
+	_ = ioutil.WriteFile(passwordFile, []byte("# JMX users\nadmin   admin-secret\nmonitorRole  monitor-secret\n"), 0600)
+	_ = os.Setenv("NRI_JMX_TEST_SECRET", "from-env")
+	defer func() {
+		_ = os.Unsetenv("NRI_JMX_TEST_SECRET")
+	}()
+
+	testCases := []struct {
+		value    string
+		user     string
+		expected string
+	}{
+		{"plain", "admin", "plain"},
+		{"file:" + secretFile, "admin", "from-file"},
+		{"env:NRI_JMX_TEST_SECRET", "admin", "from-env"},
+		{"exec:echo from-exec", "admin", "from-exec"},
+		{"jmxremote:" + passwordFile, "monitorRole", "monitor-secret"},
+		{"jmxremote:" + passwordFile, "admin", "admin-secret"},
+	}
+
+	r := newSecretResolver()
+	for _, tc := range testCases {
+		secret, err := r.resolve(tc.value, tc.user)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", tc.value, err)
+		} else if secret != tc.expected {
+			t.Errorf("Expected %s for %s, got %s", tc.expected, tc.value, secret)
+		}
+	}
+
+	// References are resolved once per run
+	_ = ioutil.WriteFile(secretFile, []byte("changed"), 0600)
+	if secret, _ := r.resolve("file:"+secretFile, "admin"); secret != "from-file" {
+		t.Errorf("Expected cached secret, got %s", secret)
+	}
+}
+
+func TestSecretResolverErrors(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected string
+	}{
+		{"file:/nonexistent/jmx.pass", "reading secret file"},
+		{"env:NRI_JMX_TEST_UNSET", "NRI_JMX_TEST_UNSET is not set"},
+		{"exec:", "empty secret command"},
+		{"exec:false", "running secret command false"},
+		{"jmxremote:../test/jmxremote.password", "user admin not found"},
+	}
+
+	for _, tc := range testCases {
+		if _, err := newSecretResolver().resolve(tc.value, "admin"); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected error containing %q for %s, got %v", tc.expected, tc.value, err)
+		}
+	}
+}
+
+func TestGetTargetsResolvesSecrets(t *testing.T) {
+	_ = os.Setenv("NRI_JMX_TEST_SECRET", "from-env")
+	defer func() {
+		_ = os.Unsetenv("NRI_JMX_TEST_SECRET")
+	}()
+	defer withArgs(argumentList{JmxHost: "localhost", JmxPort: "9999", JmxUser: "admin", JmxPass: "env:NRI_JMX_TEST_SECRET",
+		KeyStore: "/ks", KeyStorePassword: "kspass", TrustStore: "/ts", TrustStorePassword: "exec:echo ts"})()
+
+	targets, err := getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets[0].JmxPass != "from-env" || targets[0].TrustStorePassword != "ts" {
+		t.Errorf("Expected resolved secrets, got %+v", targets[0])
+	}
+
+	args.KeyStorePassword = "env:NRI_JMX_TEST_UNSET"
+	targets, err = getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := targets[0].configErr; err == nil || !strings.Contains(err.Error(), "key_store_password") {
+		t.Errorf("Expected a target error naming the setting, got %v", err)
+	}
+}
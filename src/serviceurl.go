@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	jmxURLPrefix = "service:jmx:"
+	// defaultRMIRegistryPort is used when a JNDI RMI URL has no port
+	defaultRMIRegistryPort = "1099"
+)
+
+// jmxURLProtocols are the JMXServiceURL protocols that can be collected
+// from. rmi is the JDK connector, remote+http, remote+https and
+// remoting-jmx are the JBoss/WildFly connectors, and jmxmp is the JMX
+// messaging protocol from the optional JMX remote API
+var jmxURLProtocols = map[string]bool{
+	"rmi":          true,
+	"remote+http":  true,
+	"remote+https": true,
+	"remoting-jmx": true,
+	"jmxmp":        true,
+}
+
+// jmxServiceURL is a parsed JMXServiceURL, of the form
+// service:jmx:protocol://[host[:port]][urlPath]
+type jmxServiceURL struct {
+	raw      string
+	protocol string
+	// host and port are the address to connect to. For RMI URLs they are
+	// taken from the JNDI name, as the connector host is usually empty
+	host    string
+	port    string
+	urlPath string
+	// bindingName is the registry name of an RMI connector
+	bindingName string
+}
+
+// parseJMXServiceURL parses and validates a JMXServiceURL
+func parseJMXServiceURL(raw string) (*jmxServiceURL, error) {
+	if !strings.HasPrefix(raw, jmxURLPrefix) {
+		return nil, fmt.Errorf("jmx_url %s must start with %s", raw, jmxURLPrefix)
+	}
+
+	rest := strings.TrimPrefix(raw, jmxURLPrefix)
+	sep := strings.Index(rest, "://")
+	if sep <= 0 {
+		return nil, fmt.Errorf("jmx_url %s must have the form %sprotocol://host:port", raw, jmxURLPrefix)
+	}
+
+	u := &jmxServiceURL{raw: raw, protocol: strings.ToLower(rest[:sep])}
+	if !jmxURLProtocols[u.protocol] {
+		return nil, fmt.Errorf("jmx_url protocol %s is not supported, use one of rmi, remote+http, remote+https, remoting-jmx or jmxmp", u.protocol)
+	}
+
+	address := rest[sep+3:]
+	if slash := strings.Index(address, "/"); slash >= 0 {
+		address, u.urlPath = address[:slash], address[slash:]
+	}
+
+	if u.protocol == "rmi" {
+		if err := u.parseJNDIPath(); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+
+	if u.urlPath != "" {
+		return nil, fmt.Errorf("jmx_url %s must not have a path for protocol %s", raw, u.protocol)
+	}
+	host, port, err := splitJMXAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address in jmx_url %s: %s", raw, err)
+	}
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("jmx_url %s must include a host and a port", raw)
+	}
+	u.host, u.port = host, port
+
+	return u, nil
+}
+
+// parseJNDIPath reads the registry address and binding name of an RMI URL
+// path such as /jndi/rmi://host:port/jmxrmi. Stub and IOR paths embed a
+// serialized connector and are not supported
+func (u *jmxServiceURL) parseJNDIPath() error {
+	if !strings.HasPrefix(u.urlPath, "/jndi/") {
+		return fmt.Errorf("jmx_url %s is not supported, RMI URLs must use a /jndi/rmi:// path", u.raw)
+	}
+
+	jndi := strings.TrimPrefix(u.urlPath, "/jndi/")
+	if !strings.HasPrefix(jndi, "rmi://") {
+		return fmt.Errorf("jmx_url %s is not supported, only rmi:// JNDI names can be looked up", u.raw)
+	}
+
+	address := strings.TrimPrefix(jndi, "rmi://")
+	slash := strings.Index(address, "/")
+	if slash < 0 || slash == len(address)-1 {
+		return fmt.Errorf("jmx_url %s must include the registry binding name, such as /jmxrmi", u.raw)
+	}
+	address, u.bindingName = address[:slash], address[slash+1:]
+
+	host, port, err := splitJMXAddress(address)
+	if err != nil {
+		return fmt.Errorf("invalid registry address in jmx_url %s: %s", u.raw, err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = defaultRMIRegistryPort
+	}
+	u.host, u.port = host, port
+
+	return nil
+}
+
+// splitJMXAddress splits host[:port], where host may be a bracketed IPv6
+// address. Either part may be empty
+func splitJMXAddress(address string) (string, string, error) {
+	if address == "" {
+		return "", "", nil
+	}
+
+	host, port := address, ""
+	if strings.LastIndex(address, ":") > strings.LastIndex(address, "]") {
+		var err error
+		if host, port, err = net.SplitHostPort(address); err != nil {
+			return "", "", err
+		}
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return "", "", fmt.Errorf("invalid port %s", port)
+		}
+	}
+
+	return host, port, nil
+}
+
+func (u *jmxServiceURL) String() string {
+	return u.raw
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseJMXServiceURL(t *testing.T) {
+	testCases := []struct {
+		input       string
+		protocol    string
+		host        string
+		port        string
+		bindingName string
+	}{
+		{"service:jmx:rmi:///jndi/rmi://jvm.localnet:9999/jmxrmi", "rmi", "jvm.localnet", "9999", "jmxrmi"},
+		{"service:jmx:rmi://ignored/jndi/rmi://[::1]:9999/custom", "rmi", "::1", "9999", "custom"},
+		{"service:jmx:rmi:///jndi/rmi:///jmxrmi", "rmi", "localhost", "1099", "jmxrmi"},
+		{"service:jmx:remote+http://wildfly.localnet:9990", "remote+http", "wildfly.localnet", "9990", ""},
+		{"service:jmx:remoting-jmx://jboss.localnet:9999", "remoting-jmx", "jboss.localnet", "9999", ""},
+		{"service:jmx:jmxmp://weblogic.localnet:7091", "jmxmp", "weblogic.localnet", "7091", ""},
+	}
+
+	for _, tc := range testCases {
+		u, err := parseJMXServiceURL(tc.input)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", tc.input, err)
+			continue
+		}
+		if u.protocol != tc.protocol || u.host != tc.host || u.port != tc.port || u.bindingName != tc.bindingName {
+			t.Errorf("Unexpected result for %s: %+v", tc.input, u)
+		}
+	}
+}
+
+func TestParseJMXServiceURLErrors(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"rmi://jvm.localnet:9999", "must start with service:jmx:"},
+		{"service:jmx:iiop://jvm.localnet:9999", "protocol iiop is not supported"},
+		{"service:jmx:rmi:///stub/rO0ABXNy", "must use a /jndi/rmi:// path"},
+		{"service:jmx:rmi:///jndi/ldap://directory/jmx", "only rmi:// JNDI names"},
+		{"service:jmx:rmi:///jndi/rmi://jvm.localnet:9999", "must include the registry binding name"},
+		{"service:jmx:remote+http://wildfly.localnet", "must include a host and a port"},
+		{"service:jmx:jmxmp://weblogic.localnet:http", "invalid port"},
+		{"service:jmx:jmxmp://weblogic.localnet:7091/path", "must not have a path"},
+	}
+
+	for _, tc := range testCases {
+		if _, err := parseJMXServiceURL(tc.input); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected error containing %q for %s, got %v", tc.expected, tc.input, err)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/newrelic/infra-integrations-sdk/data/metric"
+	"gopkg.in/yaml.v2"
+)
+
+// jmxTarget holds the connection settings and collection files of a single
+// JVM. Settings left empty in a targets list inherit the value of the
+// top-level argument with the same name
+type jmxTarget struct {
+	Name               string `yaml:"name"`
+	JmxURL             string `yaml:"jmx_url"`
+	JmxHost            string `yaml:"jmx_host"`
+	JmxPort            string `yaml:"jmx_port"`
+	JmxUser            string `yaml:"jmx_user"`
+	JmxPass            string `yaml:"jmx_pass"`
+	JmxRemote          *bool  `yaml:"jmx_remote"`
+	KeyStore           string `yaml:"key_store"`
+	KeyStorePassword   string `yaml:"key_store_password"`
+	TrustStore         string `yaml:"trust_store"`
+	TrustStorePassword string `yaml:"trust_store_password"`
+	TLSCaFile          string `yaml:"tls_ca_file"`
+	TLSCertFile        string `yaml:"tls_cert_file"`
+	TLSKeyFile         string `yaml:"tls_key_file"`
+	JmxBackend         string `yaml:"jmx_backend"`
+	JolokiaURL         string `yaml:"jolokia_url"`
+	CollectionFiles    string `yaml:"collection_files"`
+	// Labels are added to every metric set of the target as label.<name> attributes
+	Labels map[string]string `yaml:"labels"`
+
+	// entityPrefix qualifies the entity names of this target so that
+	// domains of different JVMs are reported as separate entities
+	entityPrefix string
+	// serviceURL is the parsed JmxURL, nil when the target is set by host and port
+	serviceURL *jmxServiceURL
+	// tls holds the PEM certificates, nil when no tls_ca_file is set
+	tls *pemTLS
+	// configErr is the error resolving the secrets or PEM files of the
+	// target, which is then reported as down instead of being collected
+	configErr error
+	// metricSets are the metric sets of the current run by entity, event
+	// type and bean, shared by the requests that collect the same bean.
+	// They are kept with the target rather than looked up in the entities,
+	// which other targets may be writing to
+	metricSets map[string]*metric.Set
+}
+
+// targetFromArgs returns the single target described by the top-level
+// arguments. Its entities keep the unqualified domain names
+func targetFromArgs() (*jmxTarget, error) {
+	t := &jmxTarget{}
+	t.inheritArgs()
+	if err := t.resolveURL(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// inheritArgs fills every unset setting with the top-level argument value.
+// The top-level jmx_url is only inherited by targets that set no address
+func (t *jmxTarget) inheritArgs() {
+	inherit := func(value *string, def string) {
+		if *value == "" {
+			*value = def
+		}
+	}
+
+	if t.JmxHost == "" && t.JmxPort == "" {
+		inherit(&t.JmxURL, args.JmxURL)
+	}
+	inherit(&t.JmxHost, args.JmxHost)
+	inherit(&t.JmxPort, args.JmxPort)
+	inherit(&t.JmxUser, args.JmxUser)
+	inherit(&t.JmxPass, args.JmxPass)
+	inherit(&t.KeyStore, args.KeyStore)
+	inherit(&t.KeyStorePassword, args.KeyStorePassword)
+	inherit(&t.TrustStore, args.TrustStore)
+	inherit(&t.TrustStorePassword, args.TrustStorePassword)
+	inherit(&t.TLSCaFile, args.TLSCaFile)
+	inherit(&t.TLSCertFile, args.TLSCertFile)
+	inherit(&t.TLSKeyFile, args.TLSKeyFile)
+	inherit(&t.JmxBackend, args.JmxBackend)
+	inherit(&t.JolokiaURL, args.JolokiaURL)
+	inherit(&t.CollectionFiles, args.CollectionFiles)
+	if t.JmxRemote == nil {
+		remote := args.JmxRemote
+		t.JmxRemote = &remote
+	}
+}
+
+// resolveURL parses JmxURL and replaces the host and port with the
+// address it points to, so that entities and metrics report it
+func (t *jmxTarget) resolveURL() error {
+	if t.JmxURL == "" {
+		return nil
+	}
+
+	u, err := parseJMXServiceURL(t.JmxURL)
+	if err != nil {
+		return err
+	}
+	t.serviceURL = u
+	t.JmxHost, t.JmxPort = u.host, u.port
+
+	return nil
+}
+
+// resolveSecrets replaces the password settings that hold a secret
+// reference with the secret itself, and registers them to be redacted
+// from the logs
+func (t *jmxTarget) resolveSecrets(secrets *secretResolver) error {
+	for _, secret := range []struct {
+		name  string
+		value *string
+	}{
+		{"jmx_pass", &t.JmxPass},
+		{"key_store_password", &t.KeyStorePassword},
+		{"trust_store_password", &t.TrustStorePassword},
+	} {
+		resolved, err := secrets.resolve(*secret.value, t.JmxUser)
+		if err != nil {
+			return fmt.Errorf("resolving %s: %s", secret.name, err)
+		}
+		*secret.value = resolved
+		registerSecret(resolved)
+	}
+
+	return nil
+}
+
+// keyStoreSSL reports whether SSL is configured with Java keystores
+func (t *jmxTarget) keyStoreSSL() bool {
+	return t.KeyStore != "" || t.KeyStorePassword != "" || t.TrustStore != "" || t.TrustStorePassword != ""
+}
+
+// resolveTLS checks that SSL is either fully configured or not configured
+// at all, and loads the PEM files. A partial configuration is an error
+// rather than a silent fallback to plaintext
+func (t *jmxTarget) resolveTLS() error {
+	pem := t.TLSCaFile != "" || t.TLSCertFile != "" || t.TLSKeyFile != ""
+	if pem && t.keyStoreSSL() {
+		return errMixedSSL
+	}
+	if t.keyStoreSSL() && (t.KeyStore == "" || t.KeyStorePassword == "" || t.TrustStore == "" || t.TrustStorePassword == "") {
+		return errPartialKeyStores
+	}
+	if !pem {
+		return nil
+	}
+
+	var err error
+	t.tls, err = loadPEMTLS(t.TLSCaFile, t.TLSCertFile, t.TLSKeyFile)
+	return err
+}
+
+// tlsConfig returns the TLS configuration for the Go backends, nil when no
+// PEM files are configured
+func (t *jmxTarget) tlsConfig() *tls.Config {
+	if t.tls == nil {
+		return nil
+	}
+	return t.tls.config()
+}
+
+// remote reports whether the target uses the JMX remote URL format
+func (t *jmxTarget) remote() bool {
+	return t.JmxRemote != nil && *t.JmxRemote
+}
+
+// entityName returns the name of the entity that holds a domain's metrics
+func (t *jmxTarget) entityName(domain string) string {
+	return t.entityPrefix + domain
+}
+
+// String identifies the target in log messages
+func (t *jmxTarget) String() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.JmxHost + ":" + t.JmxPort
+}
+
+// identities are the name and the address of the target, which is the
+// Jolokia URL for the jolokia backend. Two targets that share one would
+// report to the same entities and store keys
+func (t *jmxTarget) identities() []string {
+	address := t.JmxHost + ":" + t.JmxPort
+	if backendName(t) == "jolokia" {
+		address = t.JolokiaURL
+	}
+	if t.Name == "" || t.Name == address {
+		return []string{address}
+	}
+	return []string{t.Name, address}
+}
+
+// dedupTargets drops, with a warning, the targets that share the name or the
+// address of an earlier one, such as a JVM both listed and discovered
+func dedupTargets(targets []*jmxTarget) []*jmxTarget {
+	seen := make(map[string]*jmxTarget)
+	var unique []*jmxTarget
+	for _, t := range targets {
+		if first := firstWithIdentity(seen, t); first != nil {
+			logger.Warnf("Skipping target %s, it has the same name or address as %s", t, first)
+			continue
+		}
+		for _, identity := range t.identities() {
+			seen[identity] = t
+		}
+		unique = append(unique, t)
+	}
+	return unique
+}
+
+func firstWithIdentity(seen map[string]*jmxTarget, t *jmxTarget) *jmxTarget {
+	for _, identity := range t.identities() {
+		if first, ok := seen[identity]; ok {
+			return first
+		}
+	}
+	return nil
+}
+
+// getTargets returns the targets to collect from in this run: the entries of
+// the targets list, which must parse and not be empty, followed by the
+// targets of targets_file and of every enabled discovery, whose failing
+// sources are logged and skipped. When none of these is set, it returns the
+// single target described by the top-level arguments. A target whose secret
+// references or PEM files fail to resolve keeps the error in configErr
+func getTargets() ([]*jmxTarget, error) {
+	var targets []*jmxTarget
+	if args.Targets != "" {
+		listed, err := parseTargets(args.Targets)
+		if err != nil {
+			return nil, err
+		}
+		if len(listed) == 0 {
+			return nil, fmt.Errorf("no targets defined in %s", args.Targets)
+		}
+		targets = append(targets, listed...)
+	}
+
+	if args.TargetsFile != "" {
+		discovered, err := discoverFile(args.TargetsFile)
+		if err != nil {
+			logger.Errorf("Skipping targets source, reading targets_file: %s", err)
+		}
+		targets = append(targets, discovered...)
+	}
+
+	if args.DiscoverLocal {
+		discovered, err := discoverLocal(args.ProcRoot)
+		if err != nil {
+			logger.Errorf("Skipping targets source, discovering local JVMs: %s", err)
+		}
+		targets = append(targets, discovered...)
+	}
+
+	if args.DiscoverKubernetes {
+		discovered, err := discoverKubernetes(args.Kubeconfig, args.KubernetesNamespace, args.KubernetesNode, time.Duration(args.Timeout)*time.Millisecond)
+		if err != nil {
+			logger.Errorf("Skipping targets source, discovering Kubernetes pods: %s", err)
+		}
+		targets = append(targets, discovered...)
+	}
+
+	if args.DiscoverDocker {
+		discovered, err := discoverDocker(args.DockerSocket, time.Duration(args.Timeout)*time.Millisecond)
+		if err != nil {
+			logger.Errorf("Skipping targets source, discovering Docker containers: %s", err)
+		}
+		targets = append(targets, discovered...)
+	}
+
+	targets = dedupTargets(targets)
+
+	if usesTargetsFromArgs() {
+		t, err := targetFromArgs()
+		if err != nil {
+			return nil, err
+		}
+		targets = []*jmxTarget{t}
+	}
+
+	secrets := newSecretResolver()
+	for _, t := range targets {
+		t.configErr = t.resolveSecrets(secrets)
+		if t.configErr == nil {
+			t.configErr = t.resolveTLS()
+		}
+		if t.configErr != nil {
+			logger.Errorf("Target %s is not collected: %s", t, t.configErr)
+		}
+	}
+
+	return targets, nil
+}
+
+// usesTargetsFromArgs reports whether no targets list, targets file or
+// discovery is set, so the top-level arguments describe the only target
+func usesTargetsFromArgs() bool {
+	return args.Targets == "" && args.TargetsFile == "" && !args.DiscoverLocal && !args.DiscoverKubernetes && !args.DiscoverDocker
+}
+
+// newDiscoveredTarget returns a target found by discovery. Like the
+// targets of a list, its settings default to the top-level arguments and
+// its entities are qualified with its name
+func newDiscoveredTarget(name, host, port string) *jmxTarget {
+	t := &jmxTarget{Name: name, JmxHost: host, JmxPort: port}
+	t.inheritArgs()
+	t.entityPrefix = t.String() + ":"
+	return t
+}
+
+// withholdCredentials clears the passwords a discovered target inherited,
+// unless discover_credentials is set. It is used for the targets found from
+// pod annotations and container labels, as anyone allowed to set them could
+// point the integration at a listener of their own
+func (t *jmxTarget) withholdCredentials() {
+	if args.DiscoverCredentials {
+		return
+	}
+	t.JmxPass, t.KeyStorePassword, t.TrustStorePassword = "", "", ""
+}
+
+// parseTargets reads a list of targets, given inline as a JSON list or as
+// the path to a YAML or JSON file
+func parseTargets(targetsArg string) ([]*jmxTarget, error) {
+	var content []byte
+	if strings.HasPrefix(strings.TrimSpace(targetsArg), "[") {
+		content = []byte(targetsArg)
+	} else {
+		var err error
+		if content, err = ioutil.ReadFile(targetsArg); err != nil {
+			return nil, fmt.Errorf("reading targets file: %s", err)
+		}
+	}
+
+	// JSON is valid YAML, so a single decoder handles both formats
+	var targets []*jmxTarget
+	if err := yaml.Unmarshal(content, &targets); err != nil {
+		return nil, fmt.Errorf("parsing targets: %s", err)
+	}
+
+	seen := make(map[string]*jmxTarget)
+	for i, t := range targets {
+		if t == nil {
+			return nil, fmt.Errorf("target %d is empty", i)
+		}
+		t.inheritArgs()
+		if err := t.resolveURL(); err != nil {
+			return nil, fmt.Errorf("target %d: %s", i, err)
+		}
+		t.entityPrefix = t.String() + ":"
+		if first := firstWithIdentity(seen, t); first != nil {
+			return nil, fmt.Errorf("target %d: %s has the same name or address as %s", i, t, first)
+		}
+		for _, identity := range t.identities() {
+			seen[identity] = t
+		}
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/newrelic/infra-integrations-sdk/integration"
+)
+
+func TestParseTargetsFile(t *testing.T) {
+	defer withArgs(argumentList{JmxUser: "admin", JmxPass: "admin", CollectionFiles: "default.yml"})()
+
+	targets, err := parseTargets("../test/targets.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %d", len(targets))
+	}
+
+	orders, billing := targets[0], targets[1]
+	if orders.JmxHost != "orders.localnet" || orders.JmxPort != "9999" || orders.JmxUser != "admin" {
+		t.Errorf("Unexpected settings for first target: %+v", orders)
+	}
+	if orders.CollectionFiles != "/etc/newrelic-infra/integrations.d/jvm-metrics.yml" || orders.remote() {
+		t.Errorf("Unexpected settings for first target: %+v", orders)
+	}
+	if billing.JmxUser != "monitor" || billing.JmxPass != "admin" || billing.CollectionFiles != "default.yml" || !billing.remote() {
+		t.Errorf("Unexpected settings for second target: %+v", billing)
+	}
+
+	if name := orders.entityName("java.lang"); name != "orders:java.lang" {
+		t.Errorf("Expected named entity, got %s", name)
+	}
+	if name := billing.entityName("java.lang"); name != "billing.localnet:9998:java.lang" {
+		t.Errorf("Expected host:port entity, got %s", name)
+	}
+}
+
+func TestParseTargetsInline(t *testing.T) {
+	defer withArgs(argumentList{JmxPort: "9999"})()
+
+	targets, err := parseTargets(`[{"jmx_host": "a.localnet"}, {"jmx_host": "b.localnet", "jmx_port": 1099}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].JmxPort != "9999" || targets[1].JmxPort != "1099" {
+		t.Errorf("Unexpected targets %+v %+v", targets[0], targets[1])
+	}
+
+	if _, err := parseTargets(`[{"jmx_host": "a.localnet"`); err == nil {
+		t.Error("Expected error for invalid JSON")
+	}
+}
+
+func TestDuplicateTargets(t *testing.T) {
+	defer withArgs(argumentList{JmxPort: "9999"})()
+
+	for _, list := range []string{
+		`[{"name": "orders", "jmx_host": "a.localnet"}, {"name": "orders", "jmx_host": "b.localnet"}]`,
+		`[{"jmx_host": "a.localnet"}, {"name": "orders", "jmx_host": "a.localnet"}]`,
+	} {
+		if _, err := parseTargets(list); err == nil || !strings.Contains(err.Error(), "target 1: ") {
+			t.Errorf("Expected the duplicate target of %s to be rejected, got %v", list, err)
+		}
+	}
+	if _, err := parseTargets(`[{"name": "a", "jmx_backend": "jolokia", "jolokia_url": "http://a:8778/jolokia"}, {"name": "b", "jmx_backend": "jolokia", "jolokia_url": "http://b:8778/jolokia"}]`); err != nil {
+		t.Errorf("Expected Jolokia targets to be told apart by URL, got %s", err)
+	}
+
+	// A listed target also found in the targets file is collected once
+	args = argumentList{Targets: `[{"jmx_host": "billing.localnet", "jmx_port": 9010}]`, TargetsFile: "../test/targets.d"}
+	targets, err := getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 3 || targets[0].String() != "billing.localnet:9010" || targets[1].String() == "billing.localnet:9010" {
+		t.Errorf("Expected the discovered duplicate to be skipped, got %v", targets)
+	}
+}
+
+func TestGetTargetsFromArgs(t *testing.T) {
+	defer withArgs(argumentList{JmxHost: "localhost", JmxPort: "9999"})()
+
+	targets, err := getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].JmxHost != "localhost" || targets[0].entityName("java.lang") != "java.lang" {
+		t.Errorf("Unexpected single target %+v", targets[0])
+	}
+}
+
+func TestGetTargetsKeepsFailingTargets(t *testing.T) {
+	defer withArgs(argumentList{
+		Targets:       `[{"name": "ok", "jmx_host": "a.localnet"}, {"name": "bad", "jmx_host": "b.localnet", "jmx_pass": "env:NRI_JMX_TEST_UNSET"}]`,
+		DiscoverLocal: true,
+		ProcRoot:      "/nonexistent/proc",
+	})()
+
+	targets, err := getTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].configErr != nil || targets[1].configErr == nil {
+		t.Fatalf("Expected the failing target to be kept with its error, got %+v", targets)
+	}
+
+	i, _ := integration.New("jmxtest", "0.1.0")
+	if err := collectTargets(targets[1:], i, nil); err == nil {
+		t.Error("Expected the target error to be returned")
+	}
+	if len(i.Entities) != 1 || i.Entities[0].Metrics[0].Metrics["errorClass"] != errorClassConfig {
+		t.Errorf("Expected a config error sample for the failing target, got %+v", i.Entities)
+	}
+}
+
+func TestTargetsSeparateEntities(t *testing.T) {
+	client := &fakeClient{queryFn: func(name string, timeout int) (map[string]interface{}, error) {
+		return map[string]interface{}{"java.lang:type=Memory,attr=Verbose": "false"}, nil
+	}}
+
+	collection := []*domainDefinition{
+		{
+			domain:    "java.lang",
+			eventType: "JVMSample",
+			beans:     []*beanRequest{{beanQuery: "type=Memory", attributes: []*attributeRequest{{attrRegexp: anyAttribute(), metricType: -1}}}},
+		},
+	}
+
+	i, _ := integration.New("jmxtest", "0.1.0")
+	for _, target := range []*jmxTarget{{JmxHost: "a", entityPrefix: "a:"}, {JmxHost: "b", entityPrefix: "b:"}} {
+		if err := queryJMX(collection, client, target, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(i.Entities) != 2 {
+		t.Fatalf("Expected 2 entities, got %d", len(i.Entities))
+	}
+	if i.Entities[0].Metadata.Name != "a:java.lang" || i.Entities[1].Metrics[0].Metrics["host"] != "b" {
+		t.Errorf("Unexpected entities %+v %+v", i.Entities[0].Metadata, i.Entities[1].Metrics[0].Metrics)
+	}
+}
+
+func anyAttribute() *regexp.Regexp {
+	r, _ := createAttributeRegex(".*", false)
+	return r
+}
+
+func TestParseTargetsURL(t *testing.T) {
+	defer withArgs(argumentList{JmxHost: "localhost", JmxPort: "9999", JmxURL: "service:jmx:rmi:///jndi/rmi://default.localnet:9999/jmxrmi"})()
+
+	targets, err := parseTargets(`[{"jmx_url": "service:jmx:remote+http://wildfly.localnet:9990"}, {"jmx_host": "b.localnet"}, {}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wildfly, plain, inherited := targets[0], targets[1], targets[2]
+	if wildfly.JmxHost != "wildfly.localnet" || wildfly.JmxPort != "9990" || wildfly.serviceURL.protocol != "remote+http" {
+		t.Errorf("Unexpected settings for URL target: %+v", wildfly)
+	}
+	if plain.serviceURL != nil || plain.JmxHost != "b.localnet" {
+		t.Errorf("Expected target with a host not to inherit jmx_url: %+v", plain)
+	}
+	if inherited.serviceURL == nil || inherited.String() != "default.localnet:9999" {
+		t.Errorf("Expected target without address to inherit jmx_url: %+v", inherited)
+	}
+
+	if _, err := parseTargets(`[{"jmx_url": "service:jmx:iiop://orb.localnet:900"}]`); err == nil {
+		t.Error("Expected error for unsupported protocol")
+	}
+}
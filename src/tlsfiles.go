@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var (
+	errPartialKeyStores = errors.New("partial SSL configuration: key_store, key_store_password, trust_store and trust_store_password must all be set")
+	errPartialPEM       = errors.New("partial SSL configuration: tls_cert_file and tls_key_file must be set together, and require tls_ca_file")
+	errMixedSSL         = errors.New("SSL is configured with both Java keystores and PEM files, use only one of them")
+)
+
+// pemTLS holds the certificates read from the tls_ca_file, tls_cert_file
+// and tls_key_file PEM files
+type pemTLS struct {
+	// caCerts are the certificates trusted to sign the server certificate
+	caCerts []*x509.Certificate
+	// cert is the client certificate and key, nil if none was configured
+	cert *tls.Certificate
+}
+
+// loadPEMTLS reads the CA certificates and the optional client key pair
+func loadPEMTLS(caFile, certFile, keyFile string) (*pemTLS, error) {
+	if caFile == "" || (certFile == "") != (keyFile == "") {
+		return nil, errPartialPEM
+	}
+
+	content, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading tls_ca_file: %s", err)
+	}
+	p := &pemTLS{}
+	if p.caCerts, err = parsePEMCertificates(content); err != nil {
+		return nil, fmt.Errorf("parsing tls_ca_file %s: %s", caFile, err)
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading tls_cert_file and tls_key_file: %s", err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("parsing tls_cert_file %s: %s", certFile, err)
+		}
+		p.cert = &cert
+	}
+
+	return p, nil
+}
+
+// parsePEMCertificates returns every certificate in a PEM bundle
+func parsePEMCertificates(content []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// config returns a TLS configuration that verifies the server with the CA
+// certificates and presents the client certificate, if any
+func (p *pemTLS) config() *tls.Config {
+	roots := x509.NewCertPool()
+	for _, cert := range p.caCerts {
+		roots.AddCert(cert)
+	}
+
+	c := &tls.Config{RootCAs: roots}
+	if p.cert != nil {
+		c.Certificates = []tls.Certificate{*p.cert}
+	}
+	return c
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestPEM writes a CA certificate and a client key pair signed by it
+// to dir, and returns their paths
+func writeTestPEM(t *testing.T, dir string) (caFile, certFile, keyFile string) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "nri-jmx"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caTemplate, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(clientKey)
+
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	return write("ca.pem", "CERTIFICATE", caDER), write("client.pem", "CERTIFICATE", clientDER), write("client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func TestLoadPEMTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nri-jmx-pem")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	caFile, certFile, keyFile := writeTestPEM(t, dir)
+
+	p, err := loadPEMTLS(caFile, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.caCerts) != 1 || p.cert == nil || p.cert.Leaf.Subject.CommonName != "nri-jmx" {
+		t.Errorf("Unexpected certificates %+v", p)
+	}
+	if c := p.config(); len(c.Certificates) != 1 || c.RootCAs == nil {
+		t.Errorf("Unexpected TLS configuration %+v", c)
+	}
+
+	if p, err := loadPEMTLS(caFile, "", ""); err != nil || p.cert != nil {
+		t.Errorf("Expected a CA only configuration, got %+v, %v", p, err)
+	}
+	if _, err := loadPEMTLS(keyFile, "", ""); err == nil {
+		t.Error("Expected error for a CA file without certificates")
+	}
+}
+
+func TestResolveTLS(t *testing.T) {
+	testCases := []struct {
+		target   jmxTarget
+		expected error
+	}{
+		{jmxTarget{}, nil},
+		{jmxTarget{KeyStore: "/ks", KeyStorePassword: "ks", TrustStore: "/ts", TrustStorePassword: "ts"}, nil},
+		{jmxTarget{TrustStore: "/ts", TrustStorePassword: "ts"}, errPartialKeyStores},
+		{jmxTarget{TLSCertFile: "client.pem", TLSKeyFile: "client-key.pem"}, errPartialPEM},
+		{jmxTarget{TLSCaFile: "ca.pem", TLSCertFile: "client.pem"}, errPartialPEM},
+		{jmxTarget{TLSCaFile: "ca.pem", TrustStore: "/ts"}, errMixedSSL},
+	}
+
+	for i, tc := range testCases {
+		if err := tc.target.resolveTLS(); err != tc.expected {
+			t.Errorf("Case %d: expected %v, got %v", i, tc.expected, err)
+		}
+	}
+}
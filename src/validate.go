@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configError is a problem found in a collection file, at the given line
+// and column when they are known
+type configError struct {
+	line   int
+	column int
+	msg    string
+	// value is the offending value, used to locate problems found after
+	// the file was decoded
+	value string
+}
+
+func (e *configError) Error() string {
+	if e.line == 0 {
+		return e.msg
+	}
+	return fmt.Sprintf("line %d, column %d: %s", e.line, e.column, e.msg)
+}
+
+// configErrors are all the problems found in a collection file
+type configErrors []*configError
+
+func (e configErrors) Error() string {
+	messages := make([]string, len(e))
+	for n, err := range e {
+		messages[n] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// atValue returns an error about value, located at its first occurrence in
+// the collection file
+func atValue(value, format string, a ...interface{}) error {
+	return &configError{value: value, msg: fmt.Sprintf(format, a...)}
+}
+
+// schemaRoots are the types collection files are decoded into, whose keys
+// are suggested for unknown keys
+var schemaRoots = []interface{}{collectionDefinition{}, attributeKeys{}, javaAgentJmxConfig{}}
+
+// suggestDistance is the largest number of edits between an unknown key
+// and the known key suggested for it
+const suggestDistance = 2
+
+var (
+	typeErrorLine  = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	unknownField   = regexp.MustCompile(`^field (.+?) not found in type (.+)$`)
+	unmarshalValue = regexp.MustCompile("^cannot unmarshal \\S+ `(.*)` into")
+)
+
+// decodeStrict unmarshals a collection file into out, rejecting the keys
+// out doesn't have. The problems are returned as configErrors
+func decodeStrict(f []byte, out interface{}) error {
+	err := yaml.UnmarshalStrict(f, out)
+	if err == nil {
+		return nil
+	}
+
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+	lines := bytes.Split(f, []byte("\n"))
+	var errs configErrors
+	for _, message := range messages {
+		errs = append(errs, locateMessage(lines, message))
+	}
+	return errs
+}
+
+// locateMessage turns a yaml error message into a configError, finding the
+// column of the offending key or value on the line the message names
+func locateMessage(lines [][]byte, message string) *configError {
+	match := typeErrorLine.FindStringSubmatch(message)
+	if match == nil {
+		return &configError{msg: message}
+	}
+	line, _ := strconv.Atoi(match[1])
+	err := &configError{line: line, msg: match[2]}
+	if line < 1 || line > len(lines) {
+		return err
+	}
+	text := string(lines[line-1])
+	err.column = len(text) - len(strings.TrimLeft(text, " \t-")) + 1
+
+	if field := unknownField.FindStringSubmatch(err.msg); field != nil {
+		key := field[1]
+		err.msg = fmt.Sprintf("unknown key %q", key)
+		if suggestion := suggestKey(key, knownKeys(field[2])); suggestion != "" {
+			err.msg += fmt.Sprintf(", did you mean %q?", suggestion)
+		}
+		if column := strings.Index(text, key+":"); column != -1 {
+			err.column = column + 1
+		}
+	} else if value := unmarshalValue.FindStringSubmatch(err.msg); value != nil && value[1] != "" {
+		if column := strings.Index(text, value[1]); column != -1 {
+			err.column = column + 1
+		}
+	}
+	return err
+}
+
+// knownKeys returns the yaml keys of the schema type named typeName
+func knownKeys(typeName string) []string {
+	var keys []string
+	seen := make(map[reflect.Type]bool)
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || seen[t] {
+			return
+		}
+		seen[t] = true
+		for n := 0; n < t.NumField(); n++ {
+			field := t.Field(n)
+			if t.String() == typeName && field.PkgPath == "" {
+				key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+				if key == "" {
+					key = strings.ToLower(field.Name)
+				}
+				if key != "-" {
+					keys = append(keys, key)
+				}
+			}
+			walk(field.Type)
+		}
+	}
+	for _, root := range schemaRoots {
+		walk(reflect.TypeOf(root))
+	}
+	return keys
+}
+
+// suggestKey returns the known key closest to key, if one is close enough
+// to be a typo
+func suggestKey(key string, known []string) string {
+	best, bestDistance := "", suggestDistance+1
+	for _, candidate := range known {
+		distance := editDistance(key, candidate)
+		// Keys missing a suffix, such as exclude for exclude_regex
+		if len(key) >= 3 && strings.HasPrefix(candidate, key) {
+			distance = 1
+		}
+		if distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// locateErrors returns err as configErrors, locating the errors about a
+// value at the value's first occurrence as a scalar in the file
+func locateErrors(f []byte, err error) error {
+	if errs, ok := err.(configErrors); ok {
+		return errs
+	}
+	located, ok := err.(*configError)
+	if !ok {
+		return configErrors{{msg: err.Error()}}
+	}
+	if located.line == 0 && located.value != "" {
+		scalar := regexp.MustCompile(`(?m)(?:^|[:\[,-])[ \t]*["']?(` + regexp.QuoteMeta(located.value) + `)["']?[ \t]*(?:[,\]}#]|$)`)
+		if match := scalar.FindSubmatchIndex(f); match != nil {
+			offset := match[2]
+			lineStart := bytes.LastIndexByte(f[:offset], '\n') + 1
+			located.line = bytes.Count(f[:offset], []byte("\n")) + 1
+			located.column = offset - lineStart + 1
+		}
+	}
+	return configErrors{located}
+}
+
+// parseCollectionFile reads and parses a collection file
+func parseCollectionFile(name string) ([]*domainDefinition, error) {
+	file, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := getParser(file)
+	if err != nil {
+		return nil, err
+	}
+	return p.parse(file)
+}
+
+// fileProblems returns the problems of a collection file, one per line,
+// prefixed with the file name and, when known, the line and column
+func fileProblems(name string, err error) []string {
+	errs, ok := err.(configErrors)
+	if !ok {
+		return []string{fmt.Sprintf("%s: %s", name, err)}
+	}
+	problems := make([]string, len(errs))
+	for n, e := range errs {
+		if e.line == 0 {
+			problems[n] = fmt.Sprintf("%s: %s", name, e.msg)
+		} else {
+			problems[n] = fmt.Sprintf("%s:%d:%d: %s", name, e.line, e.column, e.msg)
+		}
+	}
+	return problems
+}
+
+// validateFiles parses every collection file and prints its problems to w.
+// It returns false when a file has problems
+func validateFiles(w io.Writer, files []string) bool {
+	if len(files) == 0 {
+		fmt.Fprintln(w, "No collection files to validate: pass them as arguments or set collection_files")
+		return false
+	}
+
+	valid := true
+	for _, name := range files {
+		if _, err := parseCollectionFile(name); err != nil {
+			valid = false
+			for _, problem := range fileProblems(name, err) {
+				fmt.Fprintln(w, problem)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%s: OK\n", name)
+	}
+	return valid
+}
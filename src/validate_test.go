@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSuggestKey(t *testing.T) {
+	testCases := []struct {
+		key        string
+		suggestion string
+	}{
+		{"attribute", "attributes"},
+		{"exclude", "exclude_regex"},
+		{"qeury", "query"},
+		{"eventtype", ""},
+		{"labels", ""},
+	}
+
+	known := knownKeys("main.beanDefinition")
+	for _, tc := range testCases {
+		if suggestion := suggestKey(tc.key, known); suggestion != tc.suggestion {
+			t.Errorf("Expected %q for %s, got %q", tc.suggestion, tc.key, suggestion)
+		}
+	}
+}
+
+func TestParseLocatesErrors(t *testing.T) {
+	testCases := []struct {
+		file     string
+		expected string
+	}{
+		{
+			"collect:\n  - domain: java.lang\n    beans:\n      - query: type=Memory\n        attribute:\n          - HeapMemoryUsage.Used\n",
+			`line 5, column 9: unknown key "attribute", did you mean "attributes"?`,
+		},
+		{
+			"collect:\n  - domain: java.lang\n    beans:\n      - query: type=GarbageCollector,*\n        exclude_regex:\n          - name=Copy\n          - name=(PS\n",
+			"line 7, column 13: invalid exclude_regex pattern name=(PS: error parsing regexp: missing closing ): `name=(PS`",
+		},
+		{
+			"collect:\n  - domain: java.lang\n    beans:\n      - query: type=Memory\n        attributes:\n          - attr: HeapMemoryUsage.Used\n            metric_type: counter\n",
+			"line 7, column 26: invalid metric type counter, use gauge, delta, attribute or rate",
+		},
+		{
+			"collect:\n  - domain: java.lang\n    beans:\n      - query: type=Memory\n        priority: high\n",
+			"line 5, column 19: cannot unmarshal !!str `high` into int",
+		},
+		{
+			"jmx:\n  - object_name: java.lang:type=Memory\n    metrics:\n      - attribute: HeapMemoryUsage.Used\n",
+			`line 4, column 9: unknown key "attribute", did you mean "attributes"?`,
+		},
+		{
+			"jmx:\n  - object_name: Memory\n",
+			"line 2, column 18: object_name Memory is not a domain:query ObjectName",
+		},
+	}
+
+	for _, tc := range testCases {
+		p, err := getParser([]byte(tc.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.parse([]byte(tc.file)); err == nil || err.Error() != tc.expected {
+			t.Errorf("Expected error %s, got %v", tc.expected, err)
+		}
+	}
+}
+
+func TestValidateFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nri-jmx-validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	bad := filepath.Join(dir, "bad.yml")
+	content := "collect:\n  - domain: java.lang\n    beans:\n      - query: type=Memory\n        attribute:\n          - HeapMemoryUsage.Used\n"
+	if err := ioutil.WriteFile(bad, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if !validateFiles(&out, []string{"../test/infra-good.yml", "../hikaridb-metrics.yml.sample"}) {
+		t.Errorf("Expected the files to be valid, got %s", out.String())
+	}
+
+	out.Reset()
+	if validateFiles(&out, []string{"../test/infra-good.yml", bad, filepath.Join(dir, "missing.yml")}) {
+		t.Error("Expected the validation to fail")
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || lines[0] != "../test/infra-good.yml: OK" ||
+		lines[1] != bad+`:5:9: unknown key "attribute", did you mean "attributes"?` ||
+		!strings.HasPrefix(lines[2], filepath.Join(dir, "missing.yml")+": ") {
+		t.Errorf("Unexpected report %s", out.String())
+	}
+
+	out.Reset()
+	if validateFiles(&out, nil) {
+		t.Error("Expected the validation to fail without files")
+	}
+}